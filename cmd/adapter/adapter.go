@@ -22,7 +22,7 @@ import (
 	"runtime"
 
 	"k8s.io/apimachinery/pkg/util/wait"
-	"k8s.io/apiserver/pkg/util/logs"
+	"k8s.io/component-base/logs"
 
 	"github.com/kairosinc/custom-metrics-prometheus-adapter/cmd/adapter/app"
 )
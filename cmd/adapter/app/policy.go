@@ -0,0 +1,101 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/authentication/serviceaccount"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	"k8s.io/klog"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+
+	cmprov "github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/custom-provider"
+)
+
+// withMetricsPolicy wraps the given handler so that requests for metrics denied
+// to the requesting service account by the given policy are rejected.  The
+// provider itself can't see who is making a request, so this is where service
+// account rules are enforced.
+func withMetricsPolicy(handler http.Handler, policy *cmprov.MetricPolicy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		info, ok := genericapirequest.RequestInfoFrom(ctx)
+		if !ok || !info.IsResourceRequest || info.APIGroup != custom_metrics.GroupName {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		// metrics for namespaces themselves are requested as
+		// `namespaces/{namespace}/metrics/{metric}`, everything
+		// else as `{resource}/{name}/{metric}`.
+		groupResource := schema.GroupResource{Resource: info.Resource}
+		name := info.Name
+		metricName := info.Subresource
+		if info.Resource == "metrics" {
+			groupResource = schema.GroupResource{Resource: "namespaces"}
+			name = info.Namespace
+			metricName = info.Name
+		}
+		if metricName == "" {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		serviceAccount := ""
+		if user, ok := genericapirequest.UserFrom(ctx); ok {
+			if saNamespace, saName, err := serviceaccount.SplitUsername(user.GetName()); err == nil {
+				serviceAccount = saNamespace + ":" + saName
+			}
+		}
+
+		// root-scoped requests for namespaced resources return objects from
+		// any namespace, and the provider filters those without knowing who's
+		// asking, so only serve them to requesters allowed wherever anyone is.
+		// (Root-scoped requests for non-namespaced resources can't be told
+		// apart here, so they're checked the same way.)
+		allowed := policy.Allows(metricName, info.Namespace, serviceAccount)
+		if allowed && info.Namespace == "" {
+			allowed = policy.AllowsWhereverAllowed(metricName, serviceAccount)
+		}
+		if allowed {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		klog.V(4).Infof("denying access to metric %q in namespace %q for %q by metrics policy", metricName, info.Namespace, serviceAccount)
+		status := cmprov.NewPolicyForbiddenError(groupResource, name, metricName).Status()
+		status.Kind = "Status"
+		status.APIVersion = "v1"
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		if err := json.NewEncoder(w).Encode(&status); err != nil {
+			klog.Errorf("unable to write policy denial response: %v", err)
+		}
+	})
+}
+
+// buildHandlerChainWithPolicy returns a handler chain builder which enforces the
+// given policy after the default filters (including authentication) have run.
+func buildHandlerChainWithPolicy(policy *cmprov.MetricPolicy) func(http.Handler, *genericapiserver.Config) http.Handler {
+	return func(apiHandler http.Handler, c *genericapiserver.Config) http.Handler {
+		return genericapiserver.DefaultBuildHandlerChain(withMetricsPolicy(apiHandler, policy), c)
+	}
+}
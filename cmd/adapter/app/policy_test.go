@@ -0,0 +1,72 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/authentication/user"
+	genericapifilters "k8s.io/apiserver/pkg/endpoints/filters"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+
+	adaptercfg "github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/config"
+	cmprov "github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/custom-provider"
+)
+
+func TestWithMetricsPolicy(t *testing.T) {
+	policy, err := cmprov.NewMetricPolicy(&adaptercfg.MetricsPolicy{
+		Rules: []adaptercfg.PolicyRule{
+			{
+				Action:          adaptercfg.PolicyDeny,
+				Metrics:         []string{"secret_sauce"},
+				Namespaces:      []string{"kitchen"},
+				ServiceAccounts: []string{"other:reader"},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	apiHandler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := genericapifilters.WithRequestInfo(withMetricsPolicy(apiHandler, policy), &genericapirequest.RequestInfoFactory{
+		APIPrefixes:          sets.NewString("apis"),
+		GrouplessAPIPrefixes: sets.NewString("api"),
+	})
+
+	serve := func(path, userName string) int {
+		req := httptest.NewRequest("GET", "/apis/custom.metrics.k8s.io/v1beta1"+path, nil)
+		req = req.WithContext(genericapirequest.WithUser(req.Context(), &user.DefaultInfo{Name: userName}))
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp.Code
+	}
+
+	denied := "system:serviceaccount:other:reader"
+	allowed := "system:serviceaccount:kitchen:chef"
+
+	assert.Equal(t, http.StatusForbidden, serve("/namespaces/kitchen/pods/*/secret_sauce", denied), "the service account should be denied in the namespace")
+	assert.Equal(t, http.StatusOK, serve("/namespaces/dining/pods/*/secret_sauce", denied), "the service account should be allowed in other namespaces")
+	assert.Equal(t, http.StatusForbidden, serve("/pods/*/secret_sauce", denied), "root-scoped requests should not bypass the namespace rule")
+	assert.Equal(t, http.StatusOK, serve("/pods/*/secret_sauce", allowed), "root-scoped requests should be allowed for other service accounts")
+	assert.Equal(t, http.StatusOK, serve("/pods/*/http_requests", denied), "root-scoped requests for other metrics should be allowed")
+}
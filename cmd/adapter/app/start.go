@@ -21,13 +21,24 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/spf13/cobra"
+	coreapi "k8s.io/api/core/v1"
+	"k8s.io/apiserver/pkg/server/healthz"
 	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 
 	prom "github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/client"
 	mprom "github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/client/metrics"
@@ -39,11 +50,19 @@ import (
 
 // NewCommandStartPrometheusAdapterServer provides a CLI handler for 'start master' command
 func NewCommandStartPrometheusAdapterServer(out, errOut io.Writer, stopCh <-chan struct{}) *cobra.Command {
-	baseOpts := server.NewCustomMetricsAdapterServerOptions(out, errOut)
+	baseOpts := server.NewCustomMetricsAdapterServerOptions()
+	// the kubelet's probes are anonymous, and the health checks don't serve any
+	// details beyond which checks failed, so they don't need to be authorized
+	baseOpts.Authorization.WithAlwaysAllowPaths("/healthz", "/healthz/*")
 	o := PrometheusAdapterServerOptions{
 		CustomMetricsAdapterServerOptions: baseOpts,
 		MetricsRelistInterval:             10 * time.Minute,
 		PrometheusURL:                     "https://localhost",
+		DeprecationReportInterval:         10 * time.Minute,
+		DiscoveryStaleRelists:             3,
+		MinRelistInterval:                 30 * time.Second,
+		TargetRelistDelay:                 30 * time.Second,
+		MetricChangesHistory:              50,
 	}
 
 	cmd := &cobra.Command{
@@ -85,6 +104,42 @@ func NewCommandStartPrometheusAdapterServer(out, errOut io.Writer, stopCh <-chan
 	flags.StringVar(&o.AdapterConfigFile, "config", o.AdapterConfigFile,
 		"Configuration file containing details of how to transform between Prometheus metrics "+
 			"and custom metrics API resources")
+	flags.BoolVar(&o.EnableRuleResources, "enable-rule-resources", o.EnableRuleResources, ""+
+		"watch MetricsDiscoveryRule and ClusterMetricsDiscoveryRule objects in the cluster, and "+
+		"use their rules in addition to those in the configuration file")
+	flags.BoolVar(&o.DeprecationEvents, "deprecation-events", o.DeprecationEvents, ""+
+		"emit Events on HorizontalPodAutoscalers which request metrics using deprecated aliases")
+	flags.DurationVar(&o.DeprecationReportInterval, "deprecation-report-interval", o.DeprecationReportInterval, ""+
+		"minimum interval between logging (and emitting Events for) requests for the same deprecated "+
+		"metric alias in the same namespace")
+	flags.DurationVar(&o.QueryBatchWindow, "query-batch-window", o.QueryBatchWindow, ""+
+		"window within which concurrent requests for the same metric on different objects are "+
+		"fetched from Prometheus with a single query (0, the default, disables batching)")
+	flags.DurationVar(&o.StaleValueMaxAge, "stale-value-max-age", o.StaleValueMaxAge, ""+
+		"if non-zero, serve the last successfully fetched value of each metric, up to this age, "+
+		"while Prometheus is unavailable")
+	flags.DurationVar(&o.ReadyGracePeriod, "ready-grace-period", o.ReadyGracePeriod, ""+
+		"time after startup after which the adapter reports ready, even if it hasn't discovered "+
+		"the available metrics yet (0 waits for discovery indefinitely)")
+	flags.IntVar(&o.DiscoveryStaleRelists, "discovery-stale-relists", o.DiscoveryStaleRelists, ""+
+		"number of relist intervals after the last successful discovery of available metrics "+
+		"after which the adapter reports discovery as degraded (must be at least 1)")
+	flags.DurationVar(&o.MinRelistInterval, "min-relist-interval", o.MinRelistInterval, ""+
+		"minimum interval between relists of available metrics requested on demand (by POSTing "+
+		"to /relist, sending SIGHUP, or annotating the relist ConfigMap)")
+	flags.StringVar(&o.RelistConfigMap, "relist-configmap", o.RelistConfigMap, ""+
+		"namespace/name of a ConfigMap to watch, requesting a relist of available metrics whenever "+
+		"its "+cmprov.RelistAnnotation+" annotation changes")
+	flags.DurationVar(&o.TargetPollInterval, "target-poll-interval", o.TargetPollInterval, ""+
+		"interval at which to poll the targets Prometheus is scraping, relisting available metrics "+
+		"early when they change (0, the default, disables polling)")
+	flags.DurationVar(&o.TargetRelistDelay, "target-relist-delay", o.TargetRelistDelay, ""+
+		"minimum delay between noticing a change in Prometheus targets and relisting available metrics, "+
+		"which backs off up to the relist interval while targets keep changing (must be positive, and no "+
+		"longer than the relist interval)")
+	flags.IntVar(&o.MetricChangesHistory, "metric-changes-history", o.MetricChangesHistory, ""+
+		"number of relists which changed the set of available metrics to keep a record of, served "+
+		"at /debug/metric-changes (0 disables the record)")
 
 	cmd.MarkFlagRequired("config")
 
@@ -130,6 +185,25 @@ func (o PrometheusAdapterServerOptions) RunCustomMetricsAdapterServer(stopCh <-c
 	if o.AdapterConfigFile == "" {
 		return fmt.Errorf("no discovery configuration file specified")
 	}
+	if o.DiscoveryStaleRelists < 1 {
+		return fmt.Errorf("invalid discovery stale relists %d, must be at least 1", o.DiscoveryStaleRelists)
+	}
+
+	var relistConfigMapNamespace, relistConfigMapName string
+	if o.RelistConfigMap != "" {
+		parts := strings.SplitN(o.RelistConfigMap, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("invalid relist ConfigMap %q, must be of the form namespace/name", o.RelistConfigMap)
+		}
+		relistConfigMapNamespace, relistConfigMapName = parts[0], parts[1]
+	}
+
+	if o.TargetPollInterval > 0 && o.TargetRelistDelay <= 0 {
+		return fmt.Errorf("invalid target relist delay %v, must be positive", o.TargetRelistDelay)
+	}
+	if o.TargetPollInterval > 0 && o.MetricsRelistInterval < o.TargetRelistDelay {
+		return fmt.Errorf("invalid target relist delay %v, must be no longer than the metrics relist interval %v", o.TargetRelistDelay, o.MetricsRelistInterval)
+	}
 
 	metricsConfig, err := adaptercfg.FromFile(o.AdapterConfigFile)
 	if err != nil {
@@ -143,6 +217,15 @@ func (o PrometheusAdapterServerOptions) RunCustomMetricsAdapterServer(stopCh <-c
 
 	config.GenericConfig.EnableMetrics = true
 
+	var metricsPolicy *cmprov.MetricPolicy
+	if metricsConfig.Policy != nil {
+		metricsPolicy, err = cmprov.NewMetricPolicy(metricsConfig.Policy)
+		if err != nil {
+			return fmt.Errorf("unable to construct metrics policy: %v", err)
+		}
+		config.GenericConfig.BuildHandlerChainFunc = buildHandlerChainWithPolicy(metricsPolicy)
+	}
+
 	var clientConfig *rest.Config
 	if len(o.RemoteKubeConfigFile) > 0 {
 		loadingRules := &clientcmd.ClientConfigLoadingRules{ExplicitPath: o.RemoteKubeConfigFile}
@@ -184,18 +267,98 @@ func (o PrometheusAdapterServerOptions) RunCustomMetricsAdapterServer(stopCh <-c
 	instrumentedGenericPromClient := mprom.InstrumentGenericAPIClient(genericPromClient, baseURL.String())
 	promClient := prom.NewClientForAPI(instrumentedGenericPromClient)
 
-	namers, err := cmprov.NamersFromConfig(metricsConfig, dynamicMapper)
+	// rules which look up objects by label value (e.g. nodes by IP) share a single cache of objects
+	objectLookups := cmprov.NewObjectLookupCache(dynamicClient, dynamicMapper, o.MetricsRelistInterval, stopCh)
+
+	namers, err := cmprov.NamersFromConfig(metricsConfig, dynamicMapper, objectLookups)
 	if err != nil {
 		return fmt.Errorf("unable to construct naming scheme from metrics rules: %v", err)
 	}
 
-	cmProvider, runner := cmprov.NewPrometheusProvider(dynamicMapper, dynamicClient, promClient, namers, o.MetricsRelistInterval)
+	var namerSource cmprov.NamerSource = cmprov.StaticNamers(namers)
+	if o.EnableRuleResources {
+		ruleSource := cmprov.NewRuleResourceSource(dynamicClient, dynamicMapper, objectLookups, metricsConfig.QueryDefaults, o.MetricsRelistInterval)
+		ruleSource.RunUntil(stopCh)
+		// wait for the initial list, so that the first discovery run sees the rule objects
+		if !cache.WaitForCacheSync(stopCh, ruleSource.HasSynced) {
+			return fmt.Errorf("unable to sync discovery rule objects")
+		}
+		namerSource = cmprov.MergeNamerSources(namerSource, ruleSource)
+	}
+
+	var eventRecorder record.EventRecorder
+	if o.DeprecationEvents {
+		kubeClient, err := kubernetes.NewForConfig(clientConfig)
+		if err != nil {
+			return fmt.Errorf("unable to construct event client: %v", err)
+		}
+		eventBroadcaster := record.NewBroadcaster()
+		eventWatcher := eventBroadcaster.StartRecordingToSink(&corev1client.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+		go func() {
+			<-stopCh
+			eventWatcher.Stop()
+		}()
+		eventRecorder = eventBroadcaster.NewRecorder(scheme.Scheme, coreapi.EventSource{Component: "custom-metrics-prometheus-adapter"})
+	}
+	deprecations := cmprov.NewDeprecationReporter(dynamicClient, dynamicMapper, eventRecorder, o.DeprecationReportInterval)
+	deprecations.RunUntil(stopCh)
+
+	var staleValues *cmprov.StaleValueCache
+	if o.StaleValueMaxAge > 0 {
+		staleValues = cmprov.NewStaleValueCache(o.StaleValueMaxAge)
+	}
+
+	var metricChanges *cmprov.DiscoveryChangeLog
+	if o.MetricChangesHistory > 0 {
+		metricChanges = cmprov.NewDiscoveryChangeLog(o.MetricChangesHistory)
+	}
+
+	cmProvider, runner := cmprov.NewPrometheusProvider(dynamicMapper, dynamicClient, promClient, namerSource, o.MetricsRelistInterval, cmprov.ProviderOptions{
+		BatchWindow:  o.QueryBatchWindow,
+		Deprecations: deprecations,
+		StaleValues:  staleValues,
+		Changes:      metricChanges,
+	})
 	runner.RunUntil(stopCh)
+	if metricsPolicy != nil {
+		cmProvider = cmprov.NewPolicyProvider(cmProvider, metricsPolicy)
+	}
 
-	server, err := config.Complete().New("prometheus-custom-metrics-adapter", cmProvider, nil)
+	server, err := config.Complete(nil).New("prometheus-custom-metrics-adapter", cmProvider, nil)
 	if err != nil {
 		return err
 	}
+
+	// allow relists to be requested on demand, since new metrics otherwise take up to a relist interval to show up
+	relists := cmprov.NewRelistTrigger(runner, o.MinRelistInterval)
+	server.GenericAPIServer.Handler.NonGoRestfulMux.Handle("/relist", relists)
+	relistSignals := make(chan os.Signal, 1)
+	signal.Notify(relistSignals, syscall.SIGHUP)
+	relists.TriggerOnSignal(relistSignals, stopCh)
+	if o.RelistConfigMap != "" {
+		relists.WatchConfigMap(dynamicClient, relistConfigMapNamespace, relistConfigMapName, stopCh)
+	}
+	if o.TargetPollInterval > 0 {
+		targetWatcher, err := cmprov.NewTargetWatcher(promClient, relists, o.TargetPollInterval, o.TargetRelistDelay, o.MetricsRelistInterval)
+		if err != nil {
+			return fmt.Errorf("unable to construct Prometheus target watcher: %v", err)
+		}
+		targetWatcher.RunUntil(stopCh)
+	}
+
+	if metricChanges != nil {
+		server.GenericAPIServer.Handler.NonGoRestfulMux.Handle("/debug/metric-changes", metricChanges)
+	}
+
+	// /healthz reflects initial discovery (so it's suitable for readiness probes),
+	// while /healthz/ping only covers the process itself (for liveness probes).
+	// Discovery freshness and Prometheus are reported under /status, which doesn't
+	// gate readiness, so that stale values can cover Prometheus outages.
+	health := cmprov.NewHealthChecks(runner, promClient, o.MetricsRelistInterval, o.ReadyGracePeriod, o.DiscoveryStaleRelists)
+	if err := server.GenericAPIServer.AddHealthzChecks(health.Checks()...); err != nil {
+		return fmt.Errorf("unable to register health checks: %v", err)
+	}
+	healthz.InstallPathHandler(server.GenericAPIServer.Handler.NonGoRestfulMux, "/status", health.StatusChecks()...)
 	return server.GenericAPIServer.PrepareRun().Run(stopCh)
 }
 
@@ -216,4 +379,28 @@ type PrometheusAdapterServerOptions struct {
 	PrometheusAuthConf string
 	// AdapterConfigFile points to the file containing the metrics discovery configuration.
 	AdapterConfigFile string
+	// EnableRuleResources enables loading additional discovery rules from rule objects in the cluster.
+	EnableRuleResources bool
+	// DeprecationEvents enables emitting Events on HPAs which use deprecated metric aliases.
+	DeprecationEvents bool
+	// DeprecationReportInterval is the minimum interval between reports of the same deprecated alias.
+	DeprecationReportInterval time.Duration
+	// QueryBatchWindow is the window within which concurrent requests for individual objects are batched.
+	QueryBatchWindow time.Duration
+	// StaleValueMaxAge is the maximum age of values served while Prometheus is unavailable (zero disables this).
+	StaleValueMaxAge time.Duration
+	// ReadyGracePeriod is the time after startup after which the adapter is ready, even without discovery.
+	ReadyGracePeriod time.Duration
+	// DiscoveryStaleRelists is the number of relist intervals after which discovery is considered degraded.
+	DiscoveryStaleRelists int
+	// MinRelistInterval is the minimum interval between relists requested on demand.
+	MinRelistInterval time.Duration
+	// RelistConfigMap is the namespace/name of a ConfigMap whose annotation requests relists.
+	RelistConfigMap string
+	// TargetPollInterval is the interval at which Prometheus targets are polled for changes (zero disables this).
+	TargetPollInterval time.Duration
+	// TargetRelistDelay is the minimum delay before relisting after Prometheus targets change.
+	TargetRelistDelay time.Duration
+	// MetricChangesHistory is the number of changes to the set of available metrics to keep a record of.
+	MetricChangesHistory int
 }
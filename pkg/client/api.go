@@ -27,8 +27,8 @@ import (
 	"path"
 	"time"
 
-	"github.com/golang/glog"
 	"github.com/prometheus/common/model"
+	"k8s.io/klog"
 )
 
 // APIClient is a raw client to the Prometheus Query API.
@@ -70,8 +70,8 @@ func (c *httpAPIClient) Do(ctx context.Context, verb, endpoint string, query url
 		return APIResponse{}, err
 	}
 
-	if glog.V(6) {
-		glog.Infof("%s %s %s", verb, u.String(), resp.Status)
+	if klog.V(6) {
+		klog.Infof("%s %s %s", verb, u.String(), resp.Status)
 	}
 
 	code := resp.StatusCode
@@ -85,12 +85,12 @@ func (c *httpAPIClient) Do(ctx context.Context, verb, endpoint string, query url
 	}
 
 	var body io.Reader = resp.Body
-	if glog.V(8) {
+	if klog.V(8) {
 		data, err := ioutil.ReadAll(body)
 		if err != nil {
 			return APIResponse{}, fmt.Errorf("unable to log response body: %v", err)
 		}
-		glog.Infof("Response Body: %s", string(data))
+		klog.Infof("Response Body: %s", string(data))
 		body = bytes.NewReader(data)
 	}
 
@@ -124,6 +124,7 @@ const (
 	queryURL      = "/api/v1/query"
 	queryRangeURL = "/api/v1/query_range"
 	seriesURL     = "/api/v1/series"
+	targetsURL    = "/api/v1/targets"
 )
 
 // queryClient is a Client that connects to the Prometheus HTTP API.
@@ -214,6 +215,21 @@ func (h *queryClient) QueryRange(ctx context.Context, r Range, query Selector) (
 	return queryRes, err
 }
 
+func (h *queryClient) Targets(ctx context.Context) (TargetsResult, error) {
+	// dropped targets can be numerous, and we don't care about them
+	vals := url.Values{}
+	vals.Set("state", "active")
+
+	res, err := h.api.Do(ctx, "GET", targetsURL, vals)
+	if err != nil {
+		return TargetsResult{}, err
+	}
+
+	var targetsRes TargetsResult
+	err = json.Unmarshal(res.Data, &targetsRes)
+	return targetsRes, err
+}
+
 // timeoutFromContext checks the context for a deadline and calculates a "timeout" duration from it,
 // when present
 func timeoutFromContext(ctx context.Context) (time.Duration, bool) {
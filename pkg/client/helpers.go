@@ -17,7 +17,11 @@ package client
 
 import (
 	"fmt"
+	"regexp"
 	"strings"
+	"unicode/utf8"
+
+	pmodel "github.com/prometheus/common/model"
 )
 
 // LabelNeq produces a not-equal label selector expression.
@@ -57,6 +61,53 @@ func NameNotMatches(expr string) string {
 	return LabelNotMatches("__name__", expr)
 }
 
+// LabelMatchesValues produces a label selector expression that matches exactly the given
+// values.  Unlike LabelMatches, the values are escaped, so that they're matched literally,
+// and the result is valid PromQL for any values.  An error is returned if the label
+// name is invalid, if no values are given, or if any value isn't valid UTF-8.
+func LabelMatchesValues(label string, values ...string) (string, error) {
+	if len(values) == 1 {
+		return labelValuesMatcher(label, "=", values[0])
+	}
+	return labelValuesMatcher(label, "=~", values...)
+}
+
+// LabelNotMatchesValues produces a label selector expression that matches anything but
+// the given values (the opposite of LabelMatchesValues).
+func LabelNotMatchesValues(label string, values ...string) (string, error) {
+	if len(values) == 1 {
+		return labelValuesMatcher(label, "!=", values[0])
+	}
+	return labelValuesMatcher(label, "!~", values...)
+}
+
+// labelValuesMatcher produces a label selector expression with the given operator,
+// which is a regexp-matching operator if there are several values.
+func labelValuesMatcher(label string, op string, values ...string) (string, error) {
+	if !pmodel.LabelName(label).IsValid() {
+		return "", fmt.Errorf("%q is not a valid label name", label)
+	}
+	if len(values) == 0 {
+		return "", fmt.Errorf("no values given to match label %q against", label)
+	}
+	for _, value := range values {
+		// Prometheus label values are always UTF-8, and its regexps can't contain anything else
+		if !utf8.ValidString(value) {
+			return "", fmt.Errorf("value %q for label %q is not valid UTF-8", value, label)
+		}
+	}
+	if len(values) == 1 {
+		// %q uses Go's escaping, which PromQL string literals share
+		return fmt.Sprintf("%s%s%q", label, op, values[0]), nil
+	}
+
+	quotedValues := make([]string, len(values))
+	for i, value := range values {
+		quotedValues[i] = regexp.QuoteMeta(value)
+	}
+	return fmt.Sprintf("%s%s%q", label, op, strings.Join(quotedValues, "|")), nil
+}
+
 // MatchSeries takes a series name, and optionally some label expressions, and returns a series selector.
 // TODO: validate series name and expressions?
 func MatchSeries(name string, labelExpressions ...string) Selector {
@@ -0,0 +1,142 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fuzzAlphabet contains the characters most likely to break out of a string literal
+// or a regexp, along with some ordinary and multi-byte ones.
+var fuzzAlphabet = []rune("ab.-_/|*+?()[]{}^$\\\"'`#,=!~ \n\t\x00é世🙂")
+
+func randomValue(r *rand.Rand) string {
+	runes := make([]rune, r.Intn(12))
+	for i := range runes {
+		runes[i] = fuzzAlphabet[r.Intn(len(fuzzAlphabet))]
+	}
+	return string(runes)
+}
+
+// parseMatcher splits a label matcher expression into its label, operator, and value,
+// failing if the value isn't exactly one PromQL string literal.
+func parseMatcher(t *testing.T, label string, expr string) (string, string) {
+	require.True(t, strings.HasPrefix(expr, label), "matcher %s should start with the label", expr)
+	rest := expr[len(label):]
+
+	var op string
+	for _, candidate := range []string{"=~", "!~", "!=", "="} {
+		if strings.HasPrefix(rest, candidate) {
+			op = candidate
+			break
+		}
+	}
+	require.NotEmpty(t, op, "matcher %s should have an operator", expr)
+
+	// Unquote only accepts a single literal, so nothing can follow the value
+	value, err := strconv.Unquote(rest[len(op):])
+	require.NoError(t, err, "matcher %s should end with a single string literal", expr)
+	return op, value
+}
+
+// matchesExactly checks whether the given value matches the given (anchored) Prometheus regexp.
+func matchesExactly(t *testing.T, expr string, value string) bool {
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	require.NoError(t, err, "regexp %q should be valid", expr)
+	return re.MatchString(value)
+}
+
+func TestLabelMatchesValues(t *testing.T) {
+	testCases := []struct {
+		values   []string
+		expected string
+	}{
+		{values: []string{"somepod"}, expected: `pod="somepod"`},
+		{values: []string{"a.b", "c"}, expected: `pod=~"a\\.b|c"`},
+		{values: []string{`x"} or vector(1) #`}, expected: `pod="x\"} or vector(1) #"`},
+		{values: []string{"a|b", ".*"}, expected: `pod=~"a\\|b|\\.\\*"`},
+		{values: []string{""}, expected: `pod=""`},
+	}
+
+	for _, testCase := range testCases {
+		matcher, err := LabelMatchesValues("pod", testCase.values...)
+		require.NoError(t, err, "values %q", testCase.values)
+		assert.Equal(t, testCase.expected, matcher, "values %q", testCase.values)
+	}
+
+	matcher, err := LabelNotMatchesValues("pod", "a.b", "c")
+	require.NoError(t, err)
+	assert.Equal(t, `pod!~"a\\.b|c"`, matcher)
+	matcher, err = LabelNotMatchesValues("pod", "")
+	require.NoError(t, err)
+	assert.Equal(t, `pod!=""`, matcher)
+
+	for _, label := range []string{"", "0pod", "pod name", `pod="x",other`, "kubernetes.io/name"} {
+		_, err := LabelMatchesValues(label, "somepod")
+		assert.Error(t, err, "label %q should be rejected", label)
+	}
+	_, err = LabelMatchesValues("pod")
+	assert.Error(t, err, "matching no values should be rejected")
+	_, err = LabelMatchesValues("pod", "ok", "bad\xff")
+	assert.Error(t, err, "values which aren't UTF-8 should be rejected")
+}
+
+func TestLabelMatchesValuesFuzz(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+
+	for i := 0; i < 2000; i++ {
+		values := make([]string, 1+r.Intn(4))
+		isValue := map[string]bool{}
+		for j := range values {
+			values[j] = randomValue(r)
+			isValue[values[j]] = true
+		}
+
+		matcher, err := LabelMatchesValues("some_label", values...)
+		require.NoError(t, err, "values %q", values)
+		op, value := parseMatcher(t, "some_label", matcher)
+
+		notMatcher, err := LabelNotMatchesValues("some_label", values...)
+		require.NoError(t, err, "values %q", values)
+		notOp, notValue := parseMatcher(t, "some_label", notMatcher)
+		assert.Equal(t, value, notValue, "values %q", values)
+
+		if len(values) == 1 {
+			assert.Equal(t, "=", op, "values %q", values)
+			assert.Equal(t, "!=", notOp, "values %q", values)
+			assert.Equal(t, values[0], value, "the value should be preserved exactly")
+			continue
+		}
+
+		assert.Equal(t, "=~", op, "values %q", values)
+		assert.Equal(t, "!~", notOp, "values %q", values)
+		for _, val := range values {
+			assert.True(t, matchesExactly(t, value, val), "regexp %q should match %q", value, val)
+		}
+		for j := 0; j < 5; j++ {
+			other := randomValue(r)
+			assert.Equal(t, isValue[other], matchesExactly(t, value, other), "regexp %q should only match %q, tried %q", value, values, other)
+		}
+	}
+}
@@ -51,6 +51,8 @@ type Client interface {
 	Query(ctx context.Context, t model.Time, query Selector) (QueryResult, error)
 	// QueryRange runs a range query at the given time.
 	QueryRange(ctx context.Context, r Range, query Selector) (QueryResult, error)
+	// Targets lists the targets currently being scraped.
+	Targets(ctx context.Context) (TargetsResult, error)
 }
 
 // QueryResult is the result of a query.
@@ -130,3 +132,19 @@ func (s *Series) String() string {
 	}
 	return fmt.Sprintf("%s{%s}", s.Name, strings.Join(lblStrings, ","))
 }
+
+// TargetsResult is the result of a targets query.
+type TargetsResult struct {
+	// Active are the targets currently being scraped.
+	Active []Target `json:"activeTargets"`
+}
+
+// Target is a target being scraped by Prometheus.
+type Target struct {
+	// Labels are the labels attached to the target's series, after relabeling.
+	Labels model.LabelSet `json:"labels"`
+	// ScrapeURL is the URL from which the target is scraped.
+	ScrapeURL string `json:"scrapeUrl"`
+	// Health is the health of the last scrape ("up", "down", or "unknown").
+	Health string `json:"health"`
+}
@@ -6,6 +6,45 @@ type MetricsDiscoveryConfig struct {
 	// and thus must be mutually exclusive.  Rules will the same SeriesQuery
 	// will make only a single API call.
 	Rules []DiscoveryRule `yaml:"rules"`
+	// Policy optionally restricts which metrics may be read, based on the
+	// namespace of the request and the service account making it.  If not
+	// specified, all discovered metrics may be read by anyone with access to
+	// the custom metrics API.
+	Policy *MetricsPolicy `yaml:"policy,omitempty"`
+	// QueryDefaults specifies values available to the metrics query templates
+	// of all rules, including rules loaded from the cluster.
+	QueryDefaults QueryDefaults `yaml:"queryDefaults,omitempty"`
+}
+
+// QueryDefaults specifies values available to the metrics query templates of all
+// rules, unless overridden by the rules themselves.
+type QueryDefaults struct {
+	// Constants are available to metrics query templates as `.Constants.<name>`.
+	Constants map[string]string `yaml:"constants,omitempty"`
+	// RateWindow is available to metrics query templates as `.RateWindow`,
+	// for use as the window of functions such as `rate`.  It's a Prometheus
+	// duration, such as `2m`.
+	RateWindow string `yaml:"rateWindow,omitempty"`
+}
+
+// ApplyTo returns a copy of the given rule, with any of these defaults that the
+// rule doesn't override filled in.
+func (d QueryDefaults) ApplyTo(rule DiscoveryRule) DiscoveryRule {
+	if rule.RateWindow == "" {
+		rule.RateWindow = d.RateWindow
+	}
+	if len(d.Constants) == 0 {
+		return rule
+	}
+	constants := make(map[string]string, len(d.Constants)+len(rule.Constants))
+	for name, value := range d.Constants {
+		constants[name] = value
+	}
+	for name, value := range rule.Constants {
+		constants[name] = value
+	}
+	rule.Constants = constants
+	return rule
 }
 
 // DiscoveryRule describes on set of rules for transforming Prometheus metrics to/from
@@ -30,8 +69,179 @@ type DiscoveryRule struct {
 	// cumulative metrics to rate metrics.  It is a template where `.LabelMatchers` is
 	// a the comma-separated base label matchers and `.Series` is the series name, and
 	// `.GroupBy` is the comma-separated expected group-by label names. The delimeters
-	// are `<<` and `>>`.
+	// are `<<` and `>>`.  See the documentation for the other available fields and
+	// helper functions.
 	MetricsQuery string `yaml:"metricsQuery,omitempty"`
+	// Constants are available to the metrics query template as `.Constants.<name>`.
+	// They override any global constants with the same name.
+	Constants map[string]string `yaml:"constants,omitempty"`
+	// RateWindow is available to the metrics query template as `.RateWindow`.  It
+	// overrides the global rate window.
+	RateWindow string `yaml:"rateWindow,omitempty"`
+	// Namespace restricts this rule to a single namespace.  Queries produced by
+	// the rule will always be limited to this namespace, and discovered series
+	// from other namespaces (or without a namespace) will be ignored, as will
+	// query results.  The metrics query must use .LabelMatchers.  Rules
+	// loaded from namespaced MetricsDiscoveryRule objects are always restricted
+	// to the namespace of the object.
+	Namespace string `yaml:"namespace,omitempty"`
+	// Merge specifies how to query metrics which are produced by several
+	// series (for instance, when a series is renamed, and both the old and
+	// new names match the rule).  If not specified, only one of the series
+	// is used for each metric.
+	Merge *SeriesMerge `yaml:"merge,omitempty"`
+	// Aliases are additional names for the metrics produced by this rule,
+	// which are queried in exactly the same way.  They're useful for renaming
+	// metrics without breaking existing consumers.
+	Aliases []MetricAlias `yaml:"aliases,omitempty"`
+	// Results specifies how to handle unusual query results, such as
+	// non-finite values, or objects without any results.
+	Results *ResultPolicy `yaml:"results,omitempty"`
+	// Unit specifies what the results of the rule's queries measure, which
+	// controls how they're presented in the API.  It's one of `bytes`,
+	// `seconds`, or `percent`.  If not specified, results are presented as
+	// plain decimal numbers, with a precision of one thousandth.
+	Unit ValueUnit `yaml:"unit,omitempty"`
+	// Scale, if set, multiplies the results of the rule's queries before
+	// they're presented in the API (for instance, to convert milliseconds
+	// to seconds, use a scale of 0.001).
+	Scale *float64 `yaml:"scale,omitempty"`
+	// Evaluation, if set, evaluates the rule's queries over a window of
+	// time, and reduces the results for each object to a single value
+	// (for instance, to smooth out spikes, or to predict future values).
+	// If not set, queries are evaluated at a single instant.
+	Evaluation *RangeEvaluation `yaml:"evaluation,omitempty"`
+}
+
+// RangeReduction is a way of reducing the results of a query over a window of
+// time into a single value.
+type RangeReduction string
+
+const (
+	// ReduceMean uses the mean of the results.
+	ReduceMean RangeReduction = "mean"
+	// ReduceMax uses the largest result.
+	ReduceMax RangeReduction = "max"
+	// ReducePercentile uses the given percentile of the results.
+	ReducePercentile RangeReduction = "percentile"
+	// ReduceForecast fits a line to the results using linear regression,
+	// and uses its value at some time in the future.
+	ReduceForecast RangeReduction = "forecast"
+)
+
+// RangeEvaluation specifies how to evaluate queries over a window of time.
+type RangeEvaluation struct {
+	// Window is how far back from the current time to evaluate the query,
+	// as a Prometheus duration (such as `5m`).
+	Window string `yaml:"window"`
+	// Step is the time between evaluations of the query, as a Prometheus
+	// duration.  It defaults to a thirtieth of the window.
+	Step string `yaml:"step,omitempty"`
+	// Reduce is one of `mean`, `max`, `percentile`, or `forecast`.
+	Reduce RangeReduction `yaml:"reduce"`
+	// Percentile is the percentile (between 0 and 100) to use when reducing
+	// by `percentile`.
+	Percentile float64 `yaml:"percentile,omitempty"`
+	// Ahead is how far into the future to forecast, as a Prometheus
+	// duration, when reducing by `forecast`.
+	Ahead string `yaml:"ahead,omitempty"`
+}
+
+// ValueUnit is the unit of the results of a rule's queries.
+type ValueUnit string
+
+const (
+	// UnitBytes presents results as whole numbers of bytes, using binary
+	// suffixes (such as `Ki` or `Mi`) where possible.
+	UnitBytes ValueUnit = "bytes"
+	// UnitSeconds presents results as seconds, with a precision of one
+	// nanosecond.
+	UnitSeconds ValueUnit = "seconds"
+	// UnitPercent presents results, which are ratios, as percentages.
+	UnitPercent ValueUnit = "percent"
+)
+
+// NonFiniteAction is the way to handle NaN and infinite query results.
+type NonFiniteAction string
+
+const (
+	// NonFiniteDrop ignores non-finite results, as if the object had no result.
+	NonFiniteDrop NonFiniteAction = "drop"
+	// NonFiniteClamp replaces infinite results with the largest (or smallest)
+	// representable value, and NaN results with zero.
+	NonFiniteClamp NonFiniteAction = "clamp"
+	// NonFiniteError fails the whole request if any result is non-finite.
+	NonFiniteError NonFiniteAction = "error"
+)
+
+// ResultPolicy specifies how to handle unusual query results.
+type ResultPolicy struct {
+	// NonFinite is one of `drop`, `clamp`, or `error`.  It defaults to `drop`.
+	NonFinite NonFiniteAction `yaml:"nonFinite,omitempty"`
+	// MissingValue, if set, is used as the value for requested objects without
+	// a result (including those whose results were dropped), so that, for
+	// instance, objects without any traffic read as zero instead of as not found.
+	MissingValue *float64 `yaml:"missingValue,omitempty"`
+	// Duplicates is one of `first`, `sum`, `max`, `min`, `avg`, or `error`.
+	// It controls how several results for the same object are reduced to
+	// one.  It defaults to `first`.
+	Duplicates DuplicateAction `yaml:"duplicates,omitempty"`
+}
+
+// DuplicateAction is the way to handle several query results for the same object.
+type DuplicateAction string
+
+const (
+	// DuplicateFirst uses the result whose labels sort first.
+	DuplicateFirst DuplicateAction = "first"
+	// DuplicateSum adds the results together.
+	DuplicateSum DuplicateAction = "sum"
+	// DuplicateMax uses the largest result.
+	DuplicateMax DuplicateAction = "max"
+	// DuplicateMin uses the smallest result.
+	DuplicateMin DuplicateAction = "min"
+	// DuplicateAvg uses the mean of the results.
+	DuplicateAvg DuplicateAction = "avg"
+	// DuplicateError fails the whole request if any object has several results.
+	DuplicateError DuplicateAction = "error"
+)
+
+// MetricAlias is an additional name for the metrics produced by a rule.
+type MetricAlias struct {
+	// As is the alias, in the same form as the `as` field of the rule's
+	// name mapping (so it has access to the same captures, or template
+	// arguments).  Templates may only refer to labels which are also
+	// used in the rule's name.
+	As string `yaml:"as"`
+	// Deprecated marks the alias as deprecated.  Requests for deprecated
+	// aliases are logged and counted, and produce Kubernetes Events on the
+	// HorizontalPodAutoscalers which refer to them.
+	Deprecated bool `yaml:"deprecated,omitempty"`
+}
+
+// MergeStrategy is a way of combining the results from several series
+// backing the same metric.
+type MergeStrategy string
+
+const (
+	// MergeFirst uses the first series (in order of preference) which has
+	// any results at all, ignoring the others.
+	MergeFirst MergeStrategy = "first"
+	// MergeOr uses the first series (in order of preference) which has a
+	// result for each object, so different objects may use different series.
+	MergeOr MergeStrategy = "or"
+	// MergeSum adds together the results from all series for each object.
+	MergeSum MergeStrategy = "sum"
+)
+
+// SeriesMerge specifies how to combine several series backing the same metric.
+type SeriesMerge struct {
+	// Strategy is one of `first`, `or`, or `sum`.  It defaults to `first`.
+	Strategy MergeStrategy `yaml:"strategy,omitempty"`
+	// Order is a list of regular expressions matched against series names,
+	// from most to least preferred.  Series which match none of them come
+	// last.  Series with the same preference are ordered by name.
+	Order []string `yaml:"order,omitempty"`
 }
 
 // RegexFilter is a filter that matches positively or negatively against a regex.
@@ -52,6 +262,60 @@ type ResourceMapping struct {
 	// Overrides specifies exceptions to the above template, mapping label names
 	// to group-resources
 	Overrides map[string]GroupResource `yaml:"overrides,omitempty"`
+	// Values specifies how to convert the values of particular labels
+	// (by label name) into Kubernetes object names, for exporters which
+	// don't emit the plain object name.  The reverse conversion is used
+	// when querying for particular objects.
+	Values map[string]LabelValueTransform `yaml:"values,omitempty"`
+	// Composites specifies resources whose object names are built from the
+	// values of several labels, rather than from a single label.
+	Composites []CompositeResource `yaml:"composites,omitempty"`
+}
+
+// CompositeResource specifies how to build the names of objects of a particular
+// group-resource from the values of several labels.
+type CompositeResource struct {
+	GroupResource `yaml:",inline"`
+	// Name is a template that produces the object name from label values,
+	// such as `<<.app>>-<<.component>>`.  So that names can be converted
+	// back into label values, it may only contain text and label
+	// references.  The delimiters are `<<` and `>>`.
+	Name string `yaml:"name"`
+}
+
+// LabelValueTransform specifies how to convert a label value into a Kubernetes
+// object name.  The steps are applied in the order that the fields are listed.
+type LabelValueTransform struct {
+	// NamespaceSeparator indicates that the label value contains both the
+	// namespace and the name of the object, separated by the given string
+	// (e.g. `/` for values like `default/web-1`).  The namespace is
+	// split off at the first occurrence of the separator.
+	NamespaceSeparator string `yaml:"namespaceSeparator,omitempty"`
+	// TrimPrefix is a prefix to remove from the label value, if present.
+	TrimPrefix string `yaml:"trimPrefix,omitempty"`
+	// Matches is a regular expression whose capture group contains the
+	// object name.  If the expression has more than one capture group,
+	// the one containing the name must be called `name`.  Values that
+	// don't match are ignored.
+	Matches string `yaml:"matches,omitempty"`
+	// Lowercase converts the value to lower case.
+	Lowercase bool `yaml:"lowercase,omitempty"`
+	// Lookup indicates that the (transformed) value identifies an object by
+	// something other than its name, such as its IP address.  The object is
+	// found by searching a cache of the objects of the label's resource.
+	Lookup *ObjectLookup `yaml:"lookup,omitempty"`
+}
+
+// ObjectLookup specifies which field of an object identifies it in a label value.
+// Exactly one field should be set.
+type ObjectLookup struct {
+	// Field is the dot-separated path to a string field in the object,
+	// such as `status.podIP`.
+	Field string `yaml:"field,omitempty"`
+	// NodeAddressType selects the addresses of the given type (such as
+	// `InternalIP` or `Hostname`) from the `status.addresses` field of
+	// nodes.
+	NodeAddressType string `yaml:"nodeAddressType,omitempty"`
 }
 
 // GroupResource represents a Kubernetes group-resource.
@@ -69,7 +333,49 @@ type NameMapping struct {
 	Matches string `yaml:"matches"`
 	// As is the name used in the API.  Captures from Matches
 	// are available for use here.  If not specified, it defaults
-	// to $0 if no capture groups are present in Matches, or $1
-	// if only one is present, and will error if multiple are.
+	// to $0 if no capture groups are present in Matches, $1
+	// if only one is present, or the group called `name` if
+	// there are several, and will error otherwise.  If it contains
+	// `<<`, it is instead a Go template (with delimiters `<<` and
+	// `>>`) with access to the captures and the series labels.
 	As string `yaml:"as"`
 }
+
+// PolicyAction is the action taken by a policy rule when it matches.
+type PolicyAction string
+
+const (
+	// PolicyAllow allows access to the matched metrics.
+	PolicyAllow PolicyAction = "allow"
+	// PolicyDeny denies access to the matched metrics.
+	PolicyDeny PolicyAction = "deny"
+)
+
+// MetricsPolicy specifies which metrics may be read in which namespaces, and by whom.
+type MetricsPolicy struct {
+	// DefaultAction is the action taken when no rule matches a request.
+	// It defaults to `allow`.
+	DefaultAction PolicyAction `yaml:"defaultAction,omitempty"`
+	// Rules are checked in order, and the first matching rule decides
+	// whether or not a request is allowed.
+	Rules []PolicyRule `yaml:"rules"`
+}
+
+// PolicyRule allows or denies access to a set of metrics.  A rule matches a
+// request if each of its non-empty fields match.
+type PolicyRule struct {
+	// Action is either `allow` or `deny`.
+	Action PolicyAction `yaml:"action"`
+	// Metrics is a list of regular expressions matched against the metric
+	// name as presented in the API.  If empty, the rule matches all metrics.
+	Metrics []string `yaml:"metrics,omitempty"`
+	// Namespaces is a list of namespaces that the rule applies to.  Requests
+	// for non-namespaced objects have the empty namespace.  If empty, the
+	// rule applies to all namespaces.
+	Namespaces []string `yaml:"namespaces,omitempty"`
+	// ServiceAccounts is a list of service accounts, in the form
+	// `<namespace>:<name>`, that the rule applies to.  The name may be `*`
+	// to match all service accounts in a namespace.  If empty, the rule
+	// applies to all users.
+	ServiceAccounts []string `yaml:"serviceAccounts,omitempty"`
+}
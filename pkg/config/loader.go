@@ -30,3 +30,14 @@ func FromYAML(contents []byte) (*MetricsDiscoveryConfig, error) {
 	}
 	return &cfg, nil
 }
+
+// RuleFromYAML loads a single discovery rule from a blob of YAML.  Since
+// YAML is a superset of JSON, this may also be used for JSON-encoded rules,
+// such as the spec of a rule custom resource.
+func RuleFromYAML(contents []byte) (*DiscoveryRule, error) {
+	var rule DiscoveryRule
+	if err := yaml.Unmarshal(contents, &rule); err != nil {
+		return nil, fmt.Errorf("unable to parse metrics discovery rule: %v", err)
+	}
+	return &rule, nil
+}
@@ -0,0 +1,299 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	"github.com/prometheus/client_golang/prometheus"
+	pmodel "github.com/prometheus/common/model"
+	coreapi "k8s.io/api/core/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog"
+
+	"github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/config"
+)
+
+var (
+	// deprecatedAliasRequests counts requests for deprecated metric aliases.
+	deprecatedAliasRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cmgateway_deprecated_metric_alias_requests_total",
+			Help: "Number of requests for deprecated metric aliases.  Broken down by alias and the metric that it's an alias for",
+		},
+		[]string{"alias", "metric"},
+	)
+
+	hpaGroupKind = schema.GroupKind{Group: "autoscaling", Kind: "HorizontalPodAutoscaler"}
+)
+
+// deprecationReportQueueSize is the number of reports which may be waiting to be
+// turned into Events before further reports are dropped.
+const deprecationReportQueueSize = 100
+
+func init() {
+	prometheus.MustRegister(deprecatedAliasRequests)
+}
+
+// MetricAlias is an additional name (as presented in the API) for a metric.
+type MetricAlias struct {
+	Name       string
+	Deprecated bool
+}
+
+// aliasNamer produces an alias for the metrics produced by a namer.
+type aliasNamer struct {
+	as         string
+	template   *template.Template
+	deprecated bool
+}
+
+// newAliasNamer constructs an aliasNamer from the given configuration.  Templates
+// may only refer to the given labels (those used by the namer's main name), so that
+// an alias always refers to the same series as the main name.
+func newAliasNamer(cfg config.MetricAlias, nameLabels []pmodel.LabelName) (aliasNamer, error) {
+	if cfg.As == "" {
+		return aliasNamer{}, fmt.Errorf("aliases must not be empty")
+	}
+	alias := aliasNamer{
+		as:         cfg.As,
+		deprecated: cfg.Deprecated,
+	}
+	if !strings.Contains(cfg.As, "<<") {
+		return alias, nil
+	}
+
+	tmpl, labels, err := newNameTemplate(cfg.As)
+	if err != nil {
+		return aliasNamer{}, err
+	}
+	allowed := make(map[pmodel.LabelName]struct{}, len(nameLabels))
+	for _, lbl := range nameLabels {
+		allowed[lbl] = struct{}{}
+	}
+	for _, lbl := range labels {
+		if _, ok := allowed[lbl]; !ok {
+			return aliasNamer{}, fmt.Errorf("alias %q refers to label %q, which is not used in the metric name", cfg.As, lbl)
+		}
+	}
+	alias.template = tmpl
+	return alias, nil
+}
+
+// deprecationKey identifies the use of a deprecated alias in a particular namespace.
+type deprecationKey struct {
+	info      provider.CustomMetricInfo
+	namespace string
+}
+
+// deprecationReport is a request for a deprecated alias which is waiting to be
+// turned into Events.
+type deprecationReport struct {
+	info      provider.CustomMetricInfo
+	target    string
+	namespace string
+	name      string
+}
+
+// DeprecationReporter reports requests for deprecated metric aliases.  Each request
+// is counted, but requests for the same alias in the same namespace are only logged
+// (and turned into Events) once per reporting interval.
+//
+// Requests don't say which HorizontalPodAutoscaler made them, so Events are created
+// on every HorizontalPodAutoscaler in the namespace which refers to the alias.  Finding
+// them and creating the Events happens in the background, off the request path.
+type DeprecationReporter struct {
+	// client is used to find HorizontalPodAutoscalers, using mapper to find the
+	// version of the autoscaling API to use.
+	client dynamic.Interface
+	mapper apimeta.RESTMapper
+	// recorder is used to create Events.  If it's nil, no Events are created.
+	recorder record.EventRecorder
+	interval time.Duration
+	now      func() time.Time
+
+	// reports are the reports waiting to be turned into Events
+	reports chan deprecationReport
+
+	mu           sync.Mutex
+	lastReported map[deprecationKey]time.Time
+}
+
+// NewDeprecationReporter constructs a new DeprecationReporter.  If the given
+// recorder is non-nil, it's used to create Events on HorizontalPodAutoscalers
+// referring to deprecated aliases, which are found with the given client and
+// mapper once the reporter is run.
+func NewDeprecationReporter(client dynamic.Interface, mapper apimeta.RESTMapper, recorder record.EventRecorder, interval time.Duration) *DeprecationReporter {
+	return &DeprecationReporter{
+		client:       client,
+		mapper:       mapper,
+		recorder:     recorder,
+		interval:     interval,
+		now:          time.Now,
+		reports:      make(chan deprecationReport, deprecationReportQueueSize),
+		lastReported: make(map[deprecationKey]time.Time),
+	}
+}
+
+// Report records a request for the given metric, which is a deprecated alias for
+// the metric called target, for objects in the given namespace.  The object name
+// is empty for requests which use a label selector.
+func (r *DeprecationReporter) Report(info provider.CustomMetricInfo, target string, namespace string, name string) {
+	deprecatedAliasRequests.With(prometheus.Labels{"alias": info.Metric, "metric": target}).Inc()
+
+	now := r.now()
+	key := deprecationKey{info: info, namespace: namespace}
+	r.mu.Lock()
+	last, reported := r.lastReported[key]
+	if reported && now.Sub(last) < r.interval {
+		r.mu.Unlock()
+		return
+	}
+	r.lastReported[key] = now
+	r.mu.Unlock()
+
+	klog.Warningf("metric %s was requested in namespace %q using deprecated alias %q, which should be replaced with %q", info.String(), namespace, info.Metric, target)
+
+	if r.recorder == nil || namespace == "" {
+		return
+	}
+	select {
+	case r.reports <- deprecationReport{info: info, target: target, namespace: namespace, name: name}:
+	default:
+		klog.Errorf("unable to record events for use of deprecated metric alias %q in namespace %q: too many reports are waiting", info.Metric, namespace)
+	}
+}
+
+func (r *DeprecationReporter) Run() {
+	r.RunUntil(wait.NeverStop)
+}
+
+// RunUntil turns reports into Events in the background until the given channel is closed.
+func (r *DeprecationReporter) RunUntil(stopChan <-chan struct{}) {
+	go func() {
+		defer utilruntime.HandleCrash()
+
+		for {
+			select {
+			case <-stopChan:
+				return
+			case report := <-r.reports:
+				if err := r.recordEvents(report); err != nil {
+					utilruntime.HandleError(fmt.Errorf("unable to record events for use of deprecated metric alias %q in namespace %q: %v", report.info.Metric, report.namespace, err))
+				}
+			}
+		}
+	}()
+}
+
+// recordEvents creates a warning Event on each HorizontalPodAutoscaler in the
+// report's namespace which refers to the reported deprecated alias.
+func (r *DeprecationReporter) recordEvents(report deprecationReport) error {
+	hpaResource, err := r.hpaResource()
+	if err != nil {
+		return err
+	}
+	hpaList, err := r.client.Resource(hpaResource).Namespace(report.namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to list horizontal pod autoscalers: %v", err)
+	}
+
+	for i := range hpaList.Items {
+		hpa := &hpaList.Items[i]
+		if !hpaRefersToMetric(hpa, report.info, report.name) {
+			continue
+		}
+		r.recorder.Eventf(hpa, coreapi.EventTypeWarning, "DeprecatedMetricAlias", "metric %q is a deprecated alias, use %q instead", report.info.Metric, report.target)
+	}
+
+	return nil
+}
+
+// hpaResource finds the resource for the preferred version of the autoscaling API
+// which has metrics in the HorizontalPodAutoscaler spec (autoscaling/v1 only has them
+// in annotations, so it's skipped).
+func (r *DeprecationReporter) hpaResource() (schema.GroupVersionResource, error) {
+	mappings, err := r.mapper.RESTMappings(hpaGroupKind)
+	if err != nil {
+		return schema.GroupVersionResource{}, fmt.Errorf("unable to find horizontal pod autoscaler resource: %v", err)
+	}
+	for _, mapping := range mappings {
+		if mapping.Resource.Version != "v1" {
+			return mapping.Resource, nil
+		}
+	}
+	return schema.GroupVersionResource{}, fmt.Errorf("no version of the autoscaling API with horizontal pod autoscaler metrics is available")
+}
+
+// hpaRefersToMetric checks if the given HorizontalPodAutoscaler uses the given
+// metric.  Pods and external metrics are requested with a label selector (so an
+// empty name), while object metrics are requested for the named object.  Both the
+// autoscaling/v2beta1 and autoscaling/v2beta2 layouts of metric specs are understood.
+func hpaRefersToMetric(hpa *unstructured.Unstructured, info provider.CustomMetricInfo, name string) bool {
+	metrics, _, err := unstructured.NestedSlice(hpa.Object, "spec", "metrics")
+	if err != nil {
+		return false
+	}
+	for _, rawMetric := range metrics {
+		metric, ok := rawMetric.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		switch metric["type"] {
+		case "Pods":
+			if metricSourceName(metric, "pods") == info.Metric && info.GroupResource.Resource == "pods" && name == "" {
+				return true
+			}
+		case "Object":
+			targetName, _, _ := unstructured.NestedString(metric, "object", "target", "name")
+			if targetName == "" {
+				targetName, _, _ = unstructured.NestedString(metric, "object", "describedObject", "name")
+			}
+			if metricSourceName(metric, "object") == info.Metric && name != "" && targetName == name {
+				return true
+			}
+		case "External":
+			// external metrics aren't tied to a resource, so only the name can be matched
+			if metricSourceName(metric, "external") == info.Metric && name == "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// metricSourceName returns the name of the metric in the given source of a metric
+// spec, which is metricName in autoscaling/v2beta1, and metric.name in autoscaling/v2beta2.
+func metricSourceName(metric map[string]interface{}, source string) string {
+	if metricName, found, _ := unstructured.NestedString(metric, source, "metricName"); found {
+		return metricName
+	}
+	metricName, _, _ := unstructured.NestedString(metric, source, "metric", "name")
+	return metricName
+}
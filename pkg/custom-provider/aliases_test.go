@@ -0,0 +1,332 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	pmodel "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakedyn "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/tools/record"
+
+	prom "github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/client"
+	cfg "github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/config"
+)
+
+func TestSeriesRegistryAliases(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	rule := cfg.DiscoveryRule{
+		SeriesQuery: `{__name__=~"^.*_total$"}`,
+		Resources:   cfg.ResourceMapping{Template: "kube_<<.Resource>>"},
+		Name: cfg.NameMapping{
+			Matches: `^(.*)_total$`,
+			As:      "${1}_per_second",
+		},
+		MetricsQuery: "sum(rate(<<.Series>>{<<.LabelMatchers>>}[2m])) by (<<.GroupBy>>)",
+		Aliases: []cfg.MetricAlias{
+			{As: "${1}_rate", Deprecated: true},
+			{As: "${1}_throughput"},
+			// aliases never replace metrics with the same name
+			{As: "other_per_second"},
+		},
+	}
+	namer, err := NamerFromRule(rule, restMapper(), nil)
+	require.NoError(err)
+
+	registry := &basicSeriesRegistry{
+		mapper: restMapper(),
+	}
+	require.NoError(registry.SetSeries([][]prom.Series{
+		{
+			{
+				Name:   "http_requests_total",
+				Labels: pmodel.LabelSet{"kube_pod": "somepod", "kube_namespace": "somens"},
+			},
+			{
+				Name:   "other_total",
+				Labels: pmodel.LabelSet{"kube_pod": "somepod", "kube_namespace": "somens"},
+			},
+		},
+	}, []MetricNamer{namer}))
+
+	var names []string
+	for _, info := range registry.ListAllMetrics() {
+		if info.GroupResource.Resource == "pods" {
+			names = append(names, info.Metric)
+		}
+	}
+	sort.Strings(names)
+	assert.Equal([]string{"http_requests_per_second", "http_requests_rate", "http_requests_throughput", "other_per_second", "other_rate", "other_throughput"}, names)
+
+	// aliases aren't counted as separate metrics
+	assert.Equal(map[MetricNamer]int{namer: 4}, registry.MetricCountsByNamer())
+
+	// aliases should produce the same query as the original metric
+	podInfo := provider.CustomMetricInfo{schema.GroupResource{Resource: "pods"}, true, "http_requests_per_second"}
+	expectedQuery, found := registry.QueryForMetric(podInfo, "somens", labels.Everything(), labels.Everything(), "somepod")
+	require.True(found)
+	for _, alias := range []string{"http_requests_rate", "http_requests_throughput"} {
+		aliasInfo := podInfo
+		aliasInfo.Metric = alias
+		query, found := registry.QueryForMetric(aliasInfo, "somens", labels.Everything(), labels.Everything(), "somepod")
+		require.True(found)
+		assert.Equal(expectedQuery, query, "alias %q should produce the same query as the original metric", alias)
+	}
+
+	// only deprecated aliases should be reported as such
+	aliasInfo := podInfo
+	aliasInfo.Metric = "http_requests_rate"
+	target, deprecated := registry.DeprecatedAliasFor(aliasInfo, "somens")
+	assert.True(deprecated)
+	assert.Equal("http_requests_per_second", target)
+	aliasInfo.Metric = "http_requests_throughput"
+	_, deprecated = registry.DeprecatedAliasFor(aliasInfo, "somens")
+	assert.False(deprecated)
+	_, deprecated = registry.DeprecatedAliasFor(podInfo, "somens")
+	assert.False(deprecated)
+
+	// the other_total series should still be queried by its real name
+	otherInfo := podInfo
+	otherInfo.Metric = "other_per_second"
+	query, found := registry.QueryForMetric(otherInfo, "somens", labels.Everything(), labels.Everything(), "somepod")
+	require.True(found)
+	assert.Equal(prom.Selector(`sum(rate(other_total{kube_namespace="somens",kube_pod="somepod"}[2m])) by (kube_pod)`), query)
+
+	// alias templates may only use labels used by the main name
+	rule.Name = cfg.NameMapping{Matches: `^(?P<base>.*)_total$`, As: "<<.Match.base>>_<<.Labels.code>>"}
+	rule.Aliases = []cfg.MetricAlias{{As: "<<.Match.base>>_<<.Labels.code>>_old"}}
+	_, err = NamerFromRule(rule, restMapper(), nil)
+	assert.NoError(err)
+	rule.Aliases = []cfg.MetricAlias{{As: "<<.Match.base>>_<<.Labels.method>>"}}
+	_, err = NamerFromRule(rule, restMapper(), nil)
+	assert.Error(err, "aliases referring to labels not used by the name should be rejected")
+}
+
+// recordingEventRecorder records the names of the objects that Events are created for.
+type recordingEventRecorder struct {
+	*record.FakeRecorder
+
+	mu      sync.Mutex
+	objects []string
+}
+
+func (r *recordingEventRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.mu.Lock()
+	r.objects = append(r.objects, object.(metav1.Object).GetName())
+	r.mu.Unlock()
+	r.FakeRecorder.Eventf(object, eventtype, reason, messageFmt, args...)
+}
+
+func (r *recordingEventRecorder) recordedObjects() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.objects...)
+}
+
+func TestDeprecationReporter(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	hpa := func(name string, metric map[string]interface{}) runtime.Object {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "autoscaling/v2beta1",
+			"kind":       "HorizontalPodAutoscaler",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": "somens",
+			},
+			"spec": map[string]interface{}{
+				"metrics": []interface{}{metric},
+			},
+		}}
+	}
+	client := fakedyn.NewSimpleDynamicClient(runtime.NewScheme(),
+		hpa("uses-alias", map[string]interface{}{
+			"type": "Pods",
+			"pods": map[string]interface{}{"metricName": "http_requests_rate"},
+		}),
+		hpa("uses-other-object", map[string]interface{}{
+			"type": "Object",
+			"object": map[string]interface{}{
+				"metricName": "http_requests_rate",
+				"target":     map[string]interface{}{"kind": "Service", "name": "othersvc"},
+			},
+		}),
+		hpa("uses-new-name", map[string]interface{}{
+			"type": "Pods",
+			"pods": map[string]interface{}{"metricName": "http_requests_per_second"},
+		}),
+	)
+
+	// autoscaling/v1 is preferred, but doesn't have metrics in the spec, so v2beta1 should be used
+	autoscalingV1 := schema.GroupVersion{Group: "autoscaling", Version: "v1"}
+	autoscalingV2beta1 := schema.GroupVersion{Group: "autoscaling", Version: "v2beta1"}
+	mapper := apimeta.NewDefaultRESTMapper([]schema.GroupVersion{autoscalingV1, autoscalingV2beta1})
+	mapper.Add(autoscalingV1.WithKind("HorizontalPodAutoscaler"), apimeta.RESTScopeNamespace)
+	mapper.Add(autoscalingV2beta1.WithKind("HorizontalPodAutoscaler"), apimeta.RESTScopeNamespace)
+
+	recorder := &recordingEventRecorder{FakeRecorder: record.NewFakeRecorder(10)}
+	now := time.Date(2018, 7, 1, 0, 0, 0, 0, time.UTC)
+	reporter := NewDeprecationReporter(client, mapper, recorder, 10*time.Minute)
+	reporter.now = func() time.Time { return now }
+	processReports := func() {
+		for {
+			select {
+			case report := <-reporter.reports:
+				require.NoError(reporter.recordEvents(report))
+			default:
+				return
+			}
+		}
+	}
+
+	info := provider.CustomMetricInfo{schema.GroupResource{Resource: "pods"}, true, "http_requests_rate"}
+	reporter.Report(info, "http_requests_per_second", "somens", "")
+	processReports()
+
+	assert.Equal([]string{"uses-alias"}, recorder.recordedObjects(), "only the HPA using the alias for pods should have an event for a selector request")
+	assert.Equal(`Warning DeprecatedMetricAlias metric "http_requests_rate" is a deprecated alias, use "http_requests_per_second" instead`, <-recorder.Events)
+
+	// repeated requests shouldn't produce more events until the interval has passed
+	now = now.Add(5 * time.Minute)
+	reporter.Report(info, "http_requests_per_second", "somens", "")
+	processReports()
+	assert.Len(recorder.recordedObjects(), 1)
+
+	now = now.Add(10 * time.Minute)
+	reporter.Report(info, "http_requests_per_second", "somens", "")
+	processReports()
+	assert.Len(recorder.recordedObjects(), 2)
+
+	// requests for a particular object should produce events on HPAs targeting that object
+	serviceInfo := provider.CustomMetricInfo{schema.GroupResource{Resource: "services"}, true, "http_requests_rate"}
+	reporter.Report(serviceInfo, "http_requests_per_second", "somens", "othersvc")
+	processReports()
+	assert.Equal([]string{"uses-alias", "uses-alias", "uses-other-object"}, recorder.recordedObjects())
+
+	// when run, reports should be turned into events in the background
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	reporter.RunUntil(stopChan)
+	now = now.Add(10 * time.Minute)
+	reporter.Report(info, "http_requests_per_second", "somens", "")
+	assert.True(waitFor(func() bool { return len(recorder.recordedObjects()) == 4 }), "reports should be processed in the background")
+}
+
+func TestHPARefersToMetric(t *testing.T) {
+	hpa := func(metric map[string]interface{}) *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"spec": map[string]interface{}{
+				"metrics": []interface{}{metric},
+			},
+		}}
+	}
+	podsInfo := provider.CustomMetricInfo{schema.GroupResource{Resource: "pods"}, true, "http_requests_rate"}
+	serviceInfo := provider.CustomMetricInfo{schema.GroupResource{Resource: "services"}, true, "http_requests_rate"}
+
+	tests := []struct {
+		desc     string
+		metric   map[string]interface{}
+		info     provider.CustomMetricInfo
+		name     string
+		expected bool
+	}{
+		{
+			desc:     "v2beta1 pods metric",
+			metric:   map[string]interface{}{"type": "Pods", "pods": map[string]interface{}{"metricName": "http_requests_rate"}},
+			info:     podsInfo,
+			expected: true,
+		},
+		{
+			desc:     "v2beta2 pods metric",
+			metric:   map[string]interface{}{"type": "Pods", "pods": map[string]interface{}{"metric": map[string]interface{}{"name": "http_requests_rate"}}},
+			info:     podsInfo,
+			expected: true,
+		},
+		{
+			desc:   "pods metric for a named object",
+			metric: map[string]interface{}{"type": "Pods", "pods": map[string]interface{}{"metricName": "http_requests_rate"}},
+			info:   podsInfo,
+			name:   "somepod",
+		},
+		{
+			desc: "v2beta1 object metric",
+			metric: map[string]interface{}{"type": "Object", "object": map[string]interface{}{
+				"metricName": "http_requests_rate",
+				"target":     map[string]interface{}{"kind": "Service", "name": "somesvc"},
+			}},
+			info:     serviceInfo,
+			name:     "somesvc",
+			expected: true,
+		},
+		{
+			desc: "v2beta2 object metric",
+			metric: map[string]interface{}{"type": "Object", "object": map[string]interface{}{
+				"metric":          map[string]interface{}{"name": "http_requests_rate"},
+				"describedObject": map[string]interface{}{"kind": "Service", "name": "somesvc"},
+				"target":          map[string]interface{}{"type": "Value", "value": "10"},
+			}},
+			info:     serviceInfo,
+			name:     "somesvc",
+			expected: true,
+		},
+		{
+			desc: "object metric for another object",
+			metric: map[string]interface{}{"type": "Object", "object": map[string]interface{}{
+				"metric":          map[string]interface{}{"name": "http_requests_rate"},
+				"describedObject": map[string]interface{}{"kind": "Service", "name": "othersvc"},
+			}},
+			info: serviceInfo,
+			name: "somesvc",
+		},
+		{
+			desc:     "v2beta1 external metric",
+			metric:   map[string]interface{}{"type": "External", "external": map[string]interface{}{"metricName": "http_requests_rate"}},
+			info:     serviceInfo,
+			expected: true,
+		},
+		{
+			desc:     "v2beta2 external metric",
+			metric:   map[string]interface{}{"type": "External", "external": map[string]interface{}{"metric": map[string]interface{}{"name": "http_requests_rate"}}},
+			info:     podsInfo,
+			expected: true,
+		},
+		{
+			desc:   "external metric with another name",
+			metric: map[string]interface{}{"type": "External", "external": map[string]interface{}{"metricName": "http_requests_per_second"}},
+			info:   podsInfo,
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, hpaRefersToMetric(hpa(test.metric), test.info, test.name), test.desc)
+	}
+}
@@ -0,0 +1,260 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"unicode/utf8"
+
+	pmodel "github.com/prometheus/common/model"
+
+	prom "github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/client"
+)
+
+const (
+	// maxCompositeSplits limits the number of ways a single object name may be
+	// split into label values, to avoid pathological templates producing huge
+	// numbers of candidates.
+	maxCompositeSplits = 100
+	// maxCompositeSplitSteps limits the work done searching for ways to split a single
+	// object name, since names come from requests, and a long name with a template
+	// whose label references are adjacent (or separated by short, repeated text) can
+	// take a huge number of steps to search even if few splits are found.
+	maxCompositeSplitSteps = 10000
+	// maxCompositeCombinations limits the number of combinations of label values
+	// selected by the matchers for several names, past which the names should be
+	// queried separately instead (see errTooManyCompositeCombinations).
+	maxCompositeCombinations = 10
+)
+
+// errTooManyCompositeCombinations indicates that the label matchers for several names
+// would match too many combinations of label values which don't build any of the
+// names (for instance, 100 names with distinct values for each of two labels match
+// 10000 combinations), so each name should be matched separately.
+var errTooManyCompositeCombinations = errors.New("too many combinations of label values for the requested names")
+
+// compositeName builds object names from the values of several labels, and
+// splits object names back into label values.
+type compositeName struct {
+	// segments are the parts of the name template, in order
+	segments []compositeSegment
+	// labels are the distinct labels referenced by the template, in order
+	labels []pmodel.LabelName
+}
+
+// compositeSegment is either a literal piece of text, or a label reference.
+type compositeSegment struct {
+	literal string
+	label   pmodel.LabelName
+}
+
+// newCompositeName parses the given name template.  The template may only contain
+// text and references to labels (`<<.label>>`), so that names can be reversed.
+func newCompositeName(nameTemplate string) (*compositeName, error) {
+	tmpl, err := template.New("composite-name").Delims("<<", ">>").Parse(nameTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse name template %q: %v", nameTemplate, err)
+	}
+	if tmpl.Tree == nil || tmpl.Tree.Root == nil {
+		return nil, fmt.Errorf("empty name template")
+	}
+
+	res := &compositeName{}
+	seen := make(map[pmodel.LabelName]struct{})
+	for _, node := range tmpl.Tree.Root.Nodes {
+		switch node := node.(type) {
+		case *parse.TextNode:
+			res.segments = append(res.segments, compositeSegment{literal: string(node.Text)})
+		case *parse.ActionNode:
+			lbl, ok := labelForAction(node)
+			if !ok {
+				return nil, fmt.Errorf("name template %q may only contain text and label references like `<<.label>>`, not %s", nameTemplate, node.String())
+			}
+			res.segments = append(res.segments, compositeSegment{label: lbl})
+			if _, ok := seen[lbl]; !ok {
+				seen[lbl] = struct{}{}
+				res.labels = append(res.labels, lbl)
+			}
+		default:
+			return nil, fmt.Errorf("name template %q may only contain text and label references like `<<.label>>`, not %s", nameTemplate, node.String())
+		}
+	}
+
+	if len(res.labels) == 0 {
+		return nil, fmt.Errorf("name template %q must reference at least one label", nameTemplate)
+	}
+
+	return res, nil
+}
+
+// labelForAction extracts the label name from an action of the form `<<.label>>`.
+func labelForAction(node *parse.ActionNode) (pmodel.LabelName, bool) {
+	if node.Pipe == nil || len(node.Pipe.Decl) != 0 || len(node.Pipe.Cmds) != 1 {
+		return "", false
+	}
+	args := node.Pipe.Cmds[0].Args
+	if len(args) != 1 {
+		return "", false
+	}
+	field, ok := args[0].(*parse.FieldNode)
+	if !ok || len(field.Ident) != 1 {
+		return "", false
+	}
+	return pmodel.LabelName(field.Ident[0]), true
+}
+
+// HasLabels checks if the given label set contains all the labels needed to build a name.
+func (c *compositeName) HasLabels(labels pmodel.LabelSet) bool {
+	for _, lbl := range c.labels {
+		if _, ok := labels[lbl]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// NameForLabels builds the object name from the given labels.  It returns
+// false if any of the referenced labels are missing or empty.
+func (c *compositeName) NameForLabels(labels pmodel.Metric) (string, bool) {
+	var buff bytes.Buffer
+	for _, seg := range c.segments {
+		if seg.label == "" {
+			buff.WriteString(seg.literal)
+			continue
+		}
+		val := labels[seg.label]
+		if val == "" {
+			return "", false
+		}
+		buff.WriteString(string(val))
+	}
+	return buff.String(), true
+}
+
+// LabelMatchers produces label matchers that select series whose labels build one
+// of the given names, as well as the values used for each label.  Names may be
+// ambiguous (for example, `a-b-c` from `<<.x>>-<<.y>>`), and several names can't
+// be matched exactly with independent label matchers, so the matchers may select
+// some extra series -- callers should check the results with NameForLabels.  If the
+// matchers for several names would match more than a few combinations of values, an
+// errTooManyCompositeCombinations error is returned instead.
+func (c *compositeName) LabelMatchers(names ...string) ([]string, map[string][]string, error) {
+	valuesByLabel := make(map[pmodel.LabelName][]string, len(c.labels))
+	seenValues := make(map[pmodel.LabelName]map[string]struct{}, len(c.labels))
+	for _, lbl := range c.labels {
+		seenValues[lbl] = make(map[string]struct{})
+	}
+
+	for _, name := range names {
+		numSplits := 0
+		steps := maxCompositeSplitSteps
+		_, err := c.splitName(name, 0, make(map[pmodel.LabelName]string, len(c.labels)), &steps, func(assigned map[pmodel.LabelName]string) bool {
+			for lbl, val := range assigned {
+				if _, seen := seenValues[lbl][val]; seen {
+					continue
+				}
+				seenValues[lbl][val] = struct{}{}
+				valuesByLabel[lbl] = append(valuesByLabel[lbl], val)
+			}
+			numSplits++
+			return numSplits < maxCompositeSplits
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to split name %q into label values: %v", name, err)
+		}
+	}
+
+	if len(valuesByLabel) == 0 {
+		return nil, nil, fmt.Errorf("none of the requested names could be split into label values")
+	}
+	if len(names) > 1 {
+		combinations := 1
+		for _, lbl := range c.labels {
+			combinations *= len(valuesByLabel[lbl])
+			if combinations > maxCompositeCombinations {
+				return nil, nil, errTooManyCompositeCombinations
+			}
+		}
+	}
+
+	matchers := make([]string, 0, len(c.labels))
+	rawValues := make(map[string][]string, len(c.labels))
+	for _, lbl := range c.labels {
+		vals := valuesByLabel[lbl]
+		rawValues[string(lbl)] = vals
+		matcher, err := prom.LabelMatchesValues(string(lbl), vals...)
+		if err != nil {
+			return nil, nil, err
+		}
+		matchers = append(matchers, matcher)
+	}
+
+	return matchers, rawValues, nil
+}
+
+// splitName calls emit with each possible assignment of (non-empty) label values
+// that would build the given name, starting from the given template segment.
+// Emit returns false to stop the search, in which case splitName returns false.
+// Each step of the search uses up one of the remaining steps, and once they run
+// out, the search stops with an error.
+func (c *compositeName) splitName(name string, segInd int, assigned map[pmodel.LabelName]string, steps *int, emit func(map[pmodel.LabelName]string) bool) (bool, error) {
+	if *steps <= 0 {
+		return false, fmt.Errorf("too many possible ways to split the name (more than %d steps)", maxCompositeSplitSteps)
+	}
+	*steps--
+
+	if segInd == len(c.segments) {
+		if name != "" {
+			return true, nil
+		}
+		return emit(assigned), nil
+	}
+
+	seg := c.segments[segInd]
+	if seg.label == "" {
+		if !strings.HasPrefix(name, seg.literal) {
+			return true, nil
+		}
+		return c.splitName(name[len(seg.literal):], segInd+1, assigned, steps, emit)
+	}
+
+	// labels referenced more than once must have the same value each time
+	if val, ok := assigned[seg.label]; ok {
+		if !strings.HasPrefix(name, val) {
+			return true, nil
+		}
+		return c.splitName(name[len(val):], segInd+1, assigned, steps, emit)
+	}
+
+	defer delete(assigned, seg.label)
+	for end := 1; end <= len(name); end++ {
+		// label values must be valid UTF-8, so don't split within a character
+		if end < len(name) && !utf8.RuneStart(name[end]) {
+			continue
+		}
+		assigned[seg.label] = name[:end]
+		if cont, err := c.splitName(name[end:], segInd+1, assigned, steps, emit); !cont || err != nil {
+			return cont, err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog"
+)
+
+var (
+	// metricChanges counts the metrics added to and removed from the set of available metrics.
+	metricChanges = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cmgateway_metric_changes_total",
+			Help: "Number of metrics added to or removed from the set of available metrics by relists.  Broken down by change and resource",
+		},
+		[]string{"change", "resource"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricChanges)
+}
+
+// MetricChange describes a metric which was added or removed by a relist.
+type MetricChange struct {
+	// Metric identifies the metric by resource and name, noting whether it's namespaced.
+	Metric string `json:"metric"`
+	// Series are the Prometheus series backing the metric.  For removed metrics,
+	// these are the series which backed it before the relist.
+	Series []string `json:"series"`
+}
+
+// DiscoveryChange describes the changes to the set of available metrics made by a relist.
+type DiscoveryChange struct {
+	// Time is the time of the relist.
+	Time time.Time `json:"time"`
+	// Added are the metrics which became available.
+	Added []MetricChange `json:"added,omitempty"`
+	// Removed are the metrics which are no longer available.
+	Removed []MetricChange `json:"removed,omitempty"`
+}
+
+// DiscoveryChangeLog keeps a bounded history of the changes to the set of available
+// metrics, so that it's possible to tell when (and why) a metric appeared or vanished.
+type DiscoveryChangeLog struct {
+	size int
+
+	mu sync.RWMutex
+	// changes are the recorded changes, oldest first
+	changes []DiscoveryChange
+}
+
+// NewDiscoveryChangeLog constructs a DiscoveryChangeLog which keeps the given number
+// of the most recent changes.
+func NewDiscoveryChangeLog(size int) *DiscoveryChangeLog {
+	return &DiscoveryChangeLog{
+		size: size,
+	}
+}
+
+// Record adds the given change to the history, forgetting the oldest change if the
+// history is full.
+func (l *DiscoveryChangeLog) Record(change DiscoveryChange) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.changes = append(l.changes, change)
+	if excess := len(l.changes) - l.size; excess > 0 {
+		// copy, so that forgotten changes don't linger in the backing array
+		l.changes = append([]DiscoveryChange(nil), l.changes[excess:]...)
+	}
+}
+
+// Changes returns the recorded changes, most recent first.
+func (l *DiscoveryChangeLog) Changes() []DiscoveryChange {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	changes := make([]DiscoveryChange, len(l.changes))
+	for i, change := range l.changes {
+		changes[len(changes)-1-i] = change
+	}
+	return changes
+}
+
+// ServeHTTP serves the recorded changes as JSON, most recent first.  It's expected to
+// be served behind the API server's authentication and authorization.
+func (l *DiscoveryChangeLog) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "metric changes must be fetched with GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := json.Marshal(struct {
+		Changes []DiscoveryChange `json:"changes"`
+	}{l.Changes()})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to encode metric changes: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// diffMetrics compares the metrics available before and after a relist, logging and
+// counting those added and removed.  The given functions describe the series backing
+// a metric before and after the relist.
+func diffMetrics(oldMetrics, newMetrics []provider.CustomMetricInfo, oldSeries, newSeries func(provider.CustomMetricInfo) []string) DiscoveryChange {
+	change := DiscoveryChange{Time: time.Now()}
+
+	for _, info := range subtractMetrics(newMetrics, oldMetrics) {
+		series := newSeries(info)
+		klog.Infof("metric %s is now available, it is backed by series %s", info.String(), strings.Join(series, ", "))
+		metricChanges.WithLabelValues("added", info.GroupResource.String()).Inc()
+		change.Added = append(change.Added, MetricChange{Metric: info.String(), Series: series})
+	}
+	for _, info := range subtractMetrics(oldMetrics, newMetrics) {
+		series := oldSeries(info)
+		klog.Infof("metric %s is no longer available, it was backed by series %s", info.String(), strings.Join(series, ", "))
+		metricChanges.WithLabelValues("removed", info.GroupResource.String()).Inc()
+		change.Removed = append(change.Removed, MetricChange{Metric: info.String(), Series: series})
+	}
+
+	return change
+}
+
+// subtractMetrics returns the metrics in the first list which aren't in the second,
+// sorted by name.
+func subtractMetrics(metrics, other []provider.CustomMetricInfo) []provider.CustomMetricInfo {
+	exclude := make(map[provider.CustomMetricInfo]struct{}, len(other))
+	for _, info := range other {
+		exclude[info] = struct{}{}
+	}
+
+	var res []provider.CustomMetricInfo
+	for _, info := range metrics {
+		if _, excluded := exclude[info]; !excluded {
+			res = append(res, info)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].String() < res[j].String()
+	})
+	return res
+}
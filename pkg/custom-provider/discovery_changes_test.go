@@ -0,0 +1,104 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	pmodel "github.com/prometheus/common/model"
+
+	prom "github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/client"
+	cfg "github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/config"
+)
+
+func TestDiscoveryChangeLog(t *testing.T) {
+	changes := NewDiscoveryChangeLog(2)
+	start := time.Date(2018, 7, 1, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		changes.Record(DiscoveryChange{
+			Time:  start.Add(time.Duration(i) * time.Minute),
+			Added: []MetricChange{{Metric: "pods/queue_length(namespaced)", Series: []string{"queue_length"}}},
+		})
+	}
+
+	recorded := changes.Changes()
+	require.Len(t, recorded, 2, "only the most recent changes should be kept")
+	assert.Equal(t, start.Add(2*time.Minute), recorded[0].Time, "the most recent change should come first")
+	assert.Equal(t, start.Add(time.Minute), recorded[1].Time)
+
+	resp := httptest.NewRecorder()
+	changes.ServeHTTP(resp, httptest.NewRequest("GET", "/debug/metric-changes", nil))
+	require.Equal(t, http.StatusOK, resp.Code)
+	var body struct {
+		Changes []DiscoveryChange `json:"changes"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &body))
+	assert.Equal(t, recorded, body.Changes)
+
+	resp = httptest.NewRecorder()
+	changes.ServeHTTP(resp, httptest.NewRequest("POST", "/debug/metric-changes", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.Code)
+}
+
+func TestSeriesRegistryRecordsChanges(t *testing.T) {
+	namer, err := NamerFromRule(cfg.DiscoveryRule{
+		SeriesQuery:  `{__name__=~"^(queue_length|jobs_processed_total)$"}`,
+		Resources:    cfg.ResourceMapping{Template: "<<.Resource>>"},
+		MetricsQuery: "sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)",
+	}, restMapper(), nil)
+	require.NoError(t, err)
+	podSeries := func(name string) prom.Series {
+		return prom.Series{Name: name, Labels: pmodel.LabelSet{"pod": "worker-0", "namespace": "somens"}}
+	}
+
+	changes := NewDiscoveryChangeLog(10)
+	registry := &basicSeriesRegistry{
+		mapper:  restMapper(),
+		changes: changes,
+	}
+	added := metricChanges.WithLabelValues("added", "pods")
+	removed := metricChanges.WithLabelValues("removed", "pods")
+	addedBefore, removedBefore := counterValue(t, added), counterValue(t, removed)
+
+	require.NoError(t, registry.SetSeries([][]prom.Series{{podSeries("queue_length")}}, []MetricNamer{namer}))
+	assert.Empty(t, changes.Changes(), "the initial metrics should not be recorded as changes")
+
+	require.NoError(t, registry.SetSeries([][]prom.Series{{podSeries("queue_length")}}, []MetricNamer{namer}))
+	assert.Empty(t, changes.Changes(), "relists without changes should not be recorded")
+
+	require.NoError(t, registry.SetSeries([][]prom.Series{{podSeries("jobs_processed_total")}}, []MetricNamer{namer}))
+	recorded := changes.Changes()
+	require.Len(t, recorded, 1)
+	assert.Equal(t, []MetricChange{
+		{Metric: "namespaces/jobs_processed_total", Series: []string{"jobs_processed_total"}},
+		{Metric: "pods/jobs_processed_total(namespaced)", Series: []string{"jobs_processed_total"}},
+	}, recorded[0].Added)
+	assert.Equal(t, []MetricChange{
+		{Metric: "namespaces/queue_length", Series: []string{"queue_length"}},
+		{Metric: "pods/queue_length(namespaced)", Series: []string{"queue_length"}},
+	}, recorded[0].Removed, "removed metrics should be described by the series which backed them")
+
+	assert.Equal(t, addedBefore+1, counterValue(t, added))
+	assert.Equal(t, removedBefore+1, counterValue(t, removed))
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	pmodel "github.com/prometheus/common/model"
+	"k8s.io/apiserver/pkg/server/healthz"
+	"k8s.io/klog"
+
+	prom "github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/client"
+)
+
+// prometheusProbeQuery is a query which any working Prometheus can answer cheaply.
+const prometheusProbeQuery = prom.Selector("vector(1)")
+
+// defaultProbeTimeout is the longest the Prometheus probe waits for a response.
+const defaultProbeTimeout = 5 * time.Second
+
+// DiscoveryRunner runs metrics discovery, and reports on its progress.
+type DiscoveryRunner interface {
+	Runnable
+
+	// LastDiscovery returns the time at which the set of available metrics was last
+	// successfully fetched from Prometheus, or the zero time if it never has been.
+	LastDiscovery() time.Time
+	// Relist requests an immediate update of the set of available metrics.
+	Relist()
+}
+
+// HealthChecks checks the health of the provider.  Each check has the signature of a
+// health check function for the generic API server, and returns an error if unhealthy.
+type HealthChecks struct {
+	discovery  DiscoveryRunner
+	promClient prom.Client
+
+	// started is the time at which the checks were constructed, which is
+	// considered to be the time at which the adapter started
+	started time.Time
+	// gracePeriod is the time after startup after which the adapter is ready,
+	// even if discovery hasn't succeeded yet
+	gracePeriod time.Duration
+	// maxDiscoveryAge is the age after which discovery results are considered stale
+	maxDiscoveryAge time.Duration
+	// probeTimeout is the longest the Prometheus probe waits for a response
+	probeTimeout time.Duration
+}
+
+// NewHealthChecks constructs health checks for the given discovery runner, which relists
+// metrics from the given client at the given interval.  The adapter is ready once discovery
+// has succeeded, or once the grace period has passed (a zero grace period waits forever).
+// Discovery is considered degraded once its results are older than the given number
+// of relist intervals.
+func NewHealthChecks(discovery DiscoveryRunner, promClient prom.Client, relistInterval time.Duration, gracePeriod time.Duration, staleRelists int) *HealthChecks {
+	return &HealthChecks{
+		discovery:  discovery,
+		promClient: promClient,
+
+		started:         time.Now(),
+		gracePeriod:     gracePeriod,
+		maxDiscoveryAge: time.Duration(staleRelists) * relistInterval,
+		probeTimeout:    defaultProbeTimeout,
+	}
+}
+
+// CheckReady checks that metrics discovery has completed, or that the grace period
+// for it has passed.
+func (h *HealthChecks) CheckReady(_ *http.Request) error {
+	if !h.discovery.LastDiscovery().IsZero() {
+		return nil
+	}
+	if h.gracePeriod > 0 && time.Since(h.started) >= h.gracePeriod {
+		return nil
+	}
+	return fmt.Errorf("available metrics have not been discovered yet")
+}
+
+// CheckDiscoveryFresh checks that metrics discovery has succeeded recently, so that
+// the set of available metrics isn't out of date.  Until discovery first succeeds,
+// that's up to CheckReady (and its grace period) instead.
+func (h *HealthChecks) CheckDiscoveryFresh(_ *http.Request) error {
+	lastDiscovery := h.discovery.LastDiscovery()
+	if lastDiscovery.IsZero() {
+		return nil
+	}
+	if age := time.Since(lastDiscovery); age > h.maxDiscoveryAge {
+		return fmt.Errorf("available metrics were last discovered %v ago, which is longer than %v", age.Round(time.Second), h.maxDiscoveryAge)
+	}
+	return nil
+}
+
+// CheckPrometheus checks that Prometheus can answer queries.
+func (h *HealthChecks) CheckPrometheus(req *http.Request) error {
+	ctx := context.Background()
+	if req != nil {
+		ctx = req.Context()
+	}
+	ctx, cancel := context.WithTimeout(ctx, h.probeTimeout)
+	defer cancel()
+
+	if _, err := h.promClient.Query(ctx, pmodel.Now(), prometheusProbeQuery); err != nil {
+		return fmt.Errorf("unable to query Prometheus: %v", err)
+	}
+	return nil
+}
+
+// errReasonWithheld replaces the reasons health checks fail, since the checks
+// may be served to unauthenticated users.
+var errReasonWithheld = errors.New("reason withheld")
+
+// Checks returns the health checks which gate the adapter's readiness, named for
+// registration with the generic API server's /healthz endpoint: it's ready once metrics
+// discovery has completed (or the grace period has passed).  /healthz/ping only checks
+// the process itself, so it's the endpoint suitable for liveness probes.  Failure reasons
+// are logged rather than served, since /healthz/<check> would otherwise include them in
+// its response.
+func (h *HealthChecks) Checks() []healthz.HealthzChecker {
+	return []healthz.HealthzChecker{
+		withholdReason("metrics-discovery", h.CheckReady),
+	}
+}
+
+// StatusChecks returns the checks which report on the adapter's dependencies without
+// gating its readiness, since stale values cover short Prometheus outages, while an
+// adapter which isn't ready can't serve anything at all.
+func (h *HealthChecks) StatusChecks() []healthz.HealthzChecker {
+	return []healthz.HealthzChecker{
+		healthz.NamedCheck("metrics-discovery-fresh", h.CheckDiscoveryFresh),
+		healthz.NamedCheck("prometheus", h.CheckPrometheus),
+	}
+}
+
+// withholdReason names the given check, logging the reasons it fails instead of returning them.
+func withholdReason(name string, check func(*http.Request) error) healthz.HealthzChecker {
+	return healthz.NamedCheck(name, func(req *http.Request) error {
+		if err := check(req); err != nil {
+			klog.V(4).Infof("health check %q failed: %v", name, err)
+			return errReasonWithheld
+		}
+		return nil
+	})
+}
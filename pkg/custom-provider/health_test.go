@@ -0,0 +1,154 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apiserver/pkg/server/healthz"
+
+	pmodel "github.com/prometheus/common/model"
+
+	prom "github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/client"
+)
+
+// fakeDiscoveryRunner is a DiscoveryRunner which last discovered metrics at a fixed time.
+type fakeDiscoveryRunner struct {
+	lastDiscovery time.Time
+	// relists counts the relists requested
+	relists int
+}
+
+func (r *fakeDiscoveryRunner) Run()                              {}
+func (r *fakeDiscoveryRunner) RunUntil(stopChan <-chan struct{}) {}
+func (r *fakeDiscoveryRunner) LastDiscovery() time.Time          { return r.lastDiscovery }
+func (r *fakeDiscoveryRunner) Relist()                           { r.relists++ }
+
+func TestHealthChecksReady(t *testing.T) {
+	discovery := &fakeDiscoveryRunner{}
+	health := NewHealthChecks(discovery, &fakePromClient{}, time.Minute, 0, 3)
+	assert.Error(t, health.CheckReady(nil), "the adapter should not be ready before discovery")
+
+	discovery.lastDiscovery = time.Now()
+	assert.NoError(t, health.CheckReady(nil), "the adapter should be ready after discovery")
+
+	// once the grace period has passed, the adapter should be ready regardless
+	health = NewHealthChecks(&fakeDiscoveryRunner{}, &fakePromClient{}, time.Minute, time.Minute, 3)
+	assert.Error(t, health.CheckReady(nil))
+	health.started = time.Now().Add(-2 * time.Minute)
+	assert.NoError(t, health.CheckReady(nil))
+}
+
+func TestHealthChecksDiscoveryFresh(t *testing.T) {
+	discovery := &fakeDiscoveryRunner{}
+	health := NewHealthChecks(discovery, &fakePromClient{}, time.Minute, 0, 3)
+	assert.NoError(t, health.CheckDiscoveryFresh(nil), "freshness should be left to the readiness check before discovery first succeeds")
+
+	discovery.lastDiscovery = time.Now().Add(-2 * time.Minute)
+	assert.NoError(t, health.CheckDiscoveryFresh(nil), "discovery within the last few intervals should be fresh")
+
+	discovery.lastDiscovery = time.Now().Add(-4 * time.Minute)
+	assert.Error(t, health.CheckDiscoveryFresh(nil), "discovery older than the stale intervals should be degraded")
+}
+
+func TestHealthChecksPrometheus(t *testing.T) {
+	fakeProm := &fakePromClient{acceptibleInterval: pmodel.Interval{Start: 0, End: pmodel.Latest}}
+	health := NewHealthChecks(&fakeDiscoveryRunner{}, fakeProm, time.Minute, 0, 3)
+	req := httptest.NewRequest("GET", "/healthz/prometheus", nil)
+
+	require.NoError(t, health.CheckPrometheus(req))
+	assert.Equal(t, []prom.Selector{prometheusProbeQuery}, fakeProm.queries)
+
+	fakeProm.errQueries = map[prom.Selector]error{prometheusProbeQuery: fmt.Errorf("connection refused")}
+	assert.Error(t, health.CheckPrometheus(req), "the check should fail if Prometheus can't be queried")
+}
+
+func TestHealthzChecks(t *testing.T) {
+	discovery := &fakeDiscoveryRunner{}
+	fakeProm := &fakePromClient{acceptibleInterval: pmodel.Interval{Start: 0, End: pmodel.Latest}}
+	health := NewHealthChecks(discovery, fakeProm, time.Minute, time.Minute, 3)
+	mux := http.NewServeMux()
+	// the generic API server always serves the ping check, too
+	healthz.InstallHandler(mux, append([]healthz.HealthzChecker{healthz.PingHealthz}, health.Checks()...)...)
+	healthz.InstallPathHandler(mux, "/status", health.StatusChecks()...)
+	get := func(path string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, httptest.NewRequest("GET", path, nil))
+		return resp
+	}
+
+	resp := get("/healthz")
+	assert.Equal(t, http.StatusInternalServerError, resp.Code, "the adapter should not be ready before discovery")
+	assert.Contains(t, resp.Body.String(), "[-]metrics-discovery failed: reason withheld")
+	resp = get("/healthz/metrics-discovery")
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+	assert.Equal(t, "internal server error: reason withheld\n", resp.Body.String(), "reasons should be withheld from individual checks")
+	assert.Equal(t, http.StatusOK, get("/healthz/ping").Code, "the liveness check should only cover the process")
+
+	// once the grace period has passed, the adapter should be ready even though discovery hasn't happened
+	health.started = time.Now().Add(-2 * time.Minute)
+	assert.Equal(t, http.StatusOK, get("/healthz").Code, "the grace period should apply to readiness")
+
+	discovery.lastDiscovery = time.Now().Add(-4 * time.Minute)
+	assert.Equal(t, http.StatusOK, get("/healthz").Code, "stale discovery should not fail readiness")
+	resp = get("/status/metrics-discovery-fresh")
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+	assert.Contains(t, resp.Body.String(), "available metrics were last discovered", "the status checks should serve their reasons")
+
+	discovery.lastDiscovery = time.Now()
+	resp = get("/status")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "ok", resp.Body.String())
+
+	fakeProm.errQueries = map[prom.Selector]error{prometheusProbeQuery: fmt.Errorf("connection refused")}
+	resp = get("/healthz")
+	assert.Equal(t, http.StatusOK, resp.Code, "Prometheus being unavailable should not fail readiness, so stale values can be served")
+	assert.Equal(t, "ok", resp.Body.String())
+	assert.Equal(t, http.StatusOK, get("/healthz/ping").Code, "Prometheus being unavailable should not fail liveness")
+	resp = get("/status")
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+	assert.Contains(t, resp.Body.String(), "[-]prometheus failed")
+	resp = get("/status/prometheus")
+	assert.Equal(t, http.StatusInternalServerError, resp.Code)
+	assert.Contains(t, resp.Body.String(), "connection refused")
+}
+
+func TestCachingMetricsListerLastDiscovery(t *testing.T) {
+	prov, fakeProm := setupPrometheusProvider(t)
+	lister := prov.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
+	assert.True(t, lister.LastDiscovery().IsZero(), "nothing should have been discovered yet")
+
+	fakeProm.errQueries = map[prom.Selector]error{}
+	for sel := range fakeProm.series {
+		fakeProm.errQueries[sel] = fmt.Errorf("connection refused")
+	}
+	require.Error(t, lister.updateMetrics())
+	assert.True(t, lister.LastDiscovery().IsZero(), "failed updates should not count as discovery")
+
+	// series queries from the failed update may still be in flight
+	fakeProm.mu.Lock()
+	fakeProm.errQueries = nil
+	fakeProm.mu.Unlock()
+	require.NoError(t, lister.updateMetrics())
+	assert.WithinDuration(t, time.Now(), lister.LastDiscovery(), time.Minute)
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+
+	"github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/config"
+)
+
+// labelValueTransform converts label values into object names, and
+// produces label matchers which select the values for given object names.
+type labelValueTransform struct {
+	nsSeparator string
+	trimPrefix  string
+	lowercase   bool
+
+	matches    *regexp.Regexp
+	captureInd int
+
+	// lookup, if set, indicates that the converted value is a lookup key
+	// for the object, rather than its name
+	lookup *config.ObjectLookup
+}
+
+func newLabelValueTransform(cfg config.LabelValueTransform) (*labelValueTransform, error) {
+	transform := &labelValueTransform{
+		nsSeparator: cfg.NamespaceSeparator,
+		trimPrefix:  cfg.TrimPrefix,
+		lowercase:   cfg.Lowercase,
+		lookup:      cfg.Lookup,
+	}
+
+	if cfg.Lookup != nil {
+		if err := validateObjectLookup(*cfg.Lookup); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Matches == "" {
+		return transform, nil
+	}
+
+	matches, err := regexp.Compile(cfg.Matches)
+	if err != nil {
+		return nil, fmt.Errorf("unable to compile value expression %q: %v", cfg.Matches, err)
+	}
+	transform.matches = matches
+
+	switch matches.NumSubexp() {
+	case 0:
+		return nil, fmt.Errorf("value expression %q must have a capture group containing the object name", cfg.Matches)
+	case 1:
+		transform.captureInd = 1
+	default:
+		for i, name := range matches.SubexpNames() {
+			if name == "name" {
+				transform.captureInd = i
+				break
+			}
+		}
+		if transform.captureInd == 0 {
+			return nil, fmt.Errorf("value expression %q has multiple capture groups, so must have one called `name`", cfg.Matches)
+		}
+	}
+
+	return transform, nil
+}
+
+// ObjectForValue converts the given label value into an object name, and the
+// namespace contained in the value (if any).  The last return value indicates
+// whether the value could be converted.
+func (t *labelValueTransform) ObjectForValue(value string) (namespace string, name string, ok bool) {
+	if t.nsSeparator != "" {
+		parts := strings.SplitN(value, t.nsSeparator, 2)
+		if len(parts) != 2 {
+			return "", "", false
+		}
+		namespace, value = parts[0], parts[1]
+	}
+
+	value = strings.TrimPrefix(value, t.trimPrefix)
+
+	if t.matches != nil {
+		match := t.matches.FindStringSubmatch(value)
+		if match == nil {
+			return "", "", false
+		}
+		value = match[t.captureInd]
+	}
+
+	if t.lowercase {
+		value = strings.ToLower(value)
+	}
+
+	return namespace, value, true
+}
+
+// ValueMatcher produces a regular expression matching label values which
+// convert to one of the given object names in the given namespace (which
+// is ignored if the values don't contain a namespace).  The expression may
+// match some extra values -- callers should check the converted values
+// with ObjectForValue.
+func (t *labelValueTransform) ValueMatcher(namespace string, names ...string) (string, error) {
+	quotedNames := make([]string, len(names))
+	for i, name := range names {
+		quotedNames[i] = regexp.QuoteMeta(name)
+	}
+	flags := ""
+	if t.lowercase {
+		flags = "i"
+	}
+
+	// work backwards through the steps in ObjectForValue
+	expr := "(?" + flags + ":" + strings.Join(quotedNames, "|") + ")"
+
+	if t.matches != nil {
+		var err error
+		expr, err = t.substituteCapture(expr)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if t.trimPrefix != "" {
+		expr = "(?:" + regexp.QuoteMeta(t.trimPrefix) + ")?" + expr
+	}
+
+	if t.nsSeparator != "" {
+		nsExpr := ".+?"
+		if namespace != "" {
+			nsExpr = regexp.QuoteMeta(namespace)
+		}
+		expr = nsExpr + regexp.QuoteMeta(t.nsSeparator) + expr
+	}
+
+	return expr, nil
+}
+
+// substituteCapture replaces the contents of the name capture group in the
+// value expression with the given expression.  Since the value expression is
+// not anchored when converting values, the result allows anything around the
+// match unless the value expression is explicitly anchored.
+func (t *labelValueTransform) substituteCapture(nameExpr string) (string, error) {
+	valueSyntax, err := syntax.Parse(t.matches.String(), syntax.Perl)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse value expression %q: %v", t.matches.String(), err)
+	}
+	nameSyntax, err := syntax.Parse(nameExpr, syntax.Perl)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse name expression %q: %v", nameExpr, err)
+	}
+
+	if !replaceCapture(valueSyntax, t.captureInd, nameSyntax) {
+		return "", fmt.Errorf("unable to find name capture group in value expression %q", t.matches.String())
+	}
+
+	expr := valueSyntax.String()
+	if !strings.HasPrefix(t.matches.String(), "^") {
+		expr = ".*" + expr
+	}
+	if !strings.HasSuffix(t.matches.String(), "$") {
+		expr = expr + ".*"
+	}
+	return expr, nil
+}
+
+// replaceCapture replaces the contents of the capture group with the given
+// index, returning whether or not the group was found.
+func replaceCapture(re *syntax.Regexp, captureInd int, replacement *syntax.Regexp) bool {
+	if re.Op == syntax.OpCapture && re.Cap == captureInd {
+		re.Sub = []*syntax.Regexp{replacement}
+		return true
+	}
+	for _, sub := range re.Sub {
+		if replaceCapture(sub, captureInd, replacement) {
+			return true
+		}
+	}
+	return false
+}
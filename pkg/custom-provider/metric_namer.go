@@ -4,14 +4,18 @@ import (
 	"bytes"
 	"fmt"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"text/template"
 
-	"github.com/golang/glog"
 	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
 
 	prom "github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/client"
 	"github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/config"
@@ -41,9 +45,35 @@ type MetricNamer interface {
 	LabelForResource(resource schema.GroupResource) (pmodel.LabelName, error)
 	// MetricNameForSeries returns the name (as presented in the API) for a given series.
 	MetricNameForSeries(series prom.Series) (string, error)
+	// MetricAliasesForSeries returns any additional names (as presented in the API)
+	// for a given series.
+	MetricAliasesForSeries(series prom.Series) ([]MetricAlias, error)
+	// SeriesLabelsForName returns the labels of the given series that its name (as
+	// presented in the API) depends on.  Queries for the metric must select series
+	// with these label values.
+	SeriesLabelsForName(series prom.Series) pmodel.LabelSet
 	// QueryForSeries returns the query for a given series (not API metric name), with
-	// the given namespace name (if relevant), resource, and resource names.
-	QueryForSeries(series string, resource schema.GroupResource, namespace string, names ...string) (prom.Selector, error)
+	// the given series labels (as returned by SeriesLabelsForName), namespace name
+	// (if relevant), resource, label selector of the request (which may be empty), metric
+	// selector (which may be empty), and resource names.
+	QueryForSeries(series string, seriesLabels pmodel.LabelSet, resource schema.GroupResource, namespace string, selector labels.Selector, metricSelector labels.Selector, names ...string) (prom.Selector, error)
+	// ObjectForLabels determines the namespace and name of the object of the given
+	// resource that a query result with the given labels refers to.  It returns false
+	// if the labels don't refer to an object, or refer to one outside of the given
+	// namespace.  If the namespace is empty, and the labels don't say which namespace
+	// the object is in, the returned namespace is empty.
+	ObjectForLabels(resource schema.GroupResource, namespace string, labels pmodel.Metric) (types.NamespacedName, bool)
+	// Namespace returns the namespace that this namer is restricted to, or the
+	// empty string if it may be used for any namespace.
+	Namespace() string
+	// Merger returns the SeriesMerger used to combine several series which produce
+	// the same metric, or nil if only one series should be used for each metric.
+	Merger() *SeriesMerger
+	// ResultPolicy returns the policy for handling unusual query results, and presenting results.
+	ResultPolicy() ResultPolicy
+	// RangeEvaluator returns the evaluator used to evaluate queries over a window of time,
+	// or nil if queries should be evaluated at a single instant.
+	RangeEvaluator() *RangeEvaluator
 }
 
 // labelGroupResExtractor extracts schema.GroupResources from series labels.
@@ -166,7 +196,19 @@ type metricNamer struct {
 	metricsQueryTemplate *template.Template
 	nameMatches          *regexp.Regexp
 	nameAs               string
+	nameTemplate         *template.Template
+	nameLabels           []pmodel.LabelName
 	seriesMatchers       []*reMatcher
+	namespace            string
+	valueTransforms      map[pmodel.LabelName]*labelValueTransform
+	lookups              *ObjectLookupCache
+	composites           map[schema.GroupResource]*compositeName
+	merger               *SeriesMerger
+	aliases              []aliasNamer
+	resultPolicy         ResultPolicy
+	rangeEvaluator       *RangeEvaluator
+	constants            map[string]string
+	rateWindow           string
 
 	labelResourceMu sync.RWMutex
 	labelToResource map[pmodel.LabelName]schema.GroupResource
@@ -179,8 +221,21 @@ type queryTemplateArgs struct {
 	Series            string
 	LabelMatchers     string
 	LabelValuesByName map[string][]string
+	MetricSelector    string
 	GroupBy           string
 	GroupBySlice      []string
+	// Resource is the group-resource being queried, such as `pods` or `deployments.apps`.
+	Resource string
+	// Kind is the kind of the objects being queried, such as `Pod`.
+	Kind string
+	// Namespace is the namespace of the request, if any.
+	Namespace string
+	// LabelSelector is the label selector of the request, if any.
+	LabelSelector string
+	// Constants are the constants configured for the rule.
+	Constants map[string]string
+	// RateWindow is the rate window configured for the rule.
+	RateWindow string
 }
 
 func (n *metricNamer) FilterSeries(initialSeries []prom.Series) []prom.Series {
@@ -202,38 +257,158 @@ SeriesLoop:
 	return finalSeries
 }
 
-func (n *metricNamer) QueryForSeries(series string, resource schema.GroupResource, namespace string, names ...string) (prom.Selector, error) {
+func (n *metricNamer) Namespace() string {
+	return n.namespace
+}
+
+func (n *metricNamer) Merger() *SeriesMerger {
+	return n.merger
+}
+
+func (n *metricNamer) ResultPolicy() ResultPolicy {
+	return n.resultPolicy
+}
+
+func (n *metricNamer) RangeEvaluator() *RangeEvaluator {
+	return n.rangeEvaluator
+}
+
+func (n *metricNamer) QueryForSeries(series string, seriesLabels pmodel.LabelSet, resource schema.GroupResource, namespace string, selector labels.Selector, metricSelector labels.Selector, names ...string) (prom.Selector, error) {
 	var exprs []string
 	valuesByName := map[string][]string{}
 
-	if namespace != "" {
+	// namespace-restricted rules may only ever query their own namespace
+	if n.namespace != "" {
+		if namespace == "" {
+			namespace = n.namespace
+		} else if namespace != n.namespace {
+			return "", fmt.Errorf("rule is restricted to namespace %q, cannot query namespace %q", n.namespace, namespace)
+		}
+		if resource == nsGroupResource {
+			for _, name := range names {
+				if name != n.namespace {
+					return "", fmt.Errorf("rule is restricted to namespace %q, cannot query namespace %q", n.namespace, name)
+				}
+			}
+		}
+	}
+
+	var resourceExprs []string
+	var groupBy []string
+	namespaceInValues := false
+	if composite, ok := n.composites[resource]; ok {
+		matchers, values, err := composite.LabelMatchers(names...)
+		if err == errTooManyCompositeCombinations {
+			return n.queryForEachName(series, seriesLabels, resource, namespace, selector, metricSelector, names)
+		}
+		if err != nil {
+			return "", fmt.Errorf("unable to construct matchers for %s: %v", resource.String(), err)
+		}
+		resourceExprs = matchers
+		for lbl, vals := range values {
+			valuesByName[lbl] = vals
+		}
+		for _, lbl := range composite.labels {
+			groupBy = append(groupBy, string(lbl))
+		}
+	} else {
+		resourceLbl, err := n.LabelForResource(resource)
+		if err != nil {
+			return "", err
+		}
+
+		if transform, ok := n.valueTransforms[resourceLbl]; ok {
+			// if the resource label values contain the namespace, there's no separate namespace label to match on
+			namespaceInValues = transform.nsSeparator != ""
+
+			values := names
+			if transform.lookup != nil {
+				values, err = n.lookupKeysForNames(transform, resource, namespace, names)
+				if err != nil {
+					return "", err
+				}
+			}
+			valueExpr, err := transform.ValueMatcher(namespace, values...)
+			if err != nil {
+				return "", fmt.Errorf("unable to construct matcher for label %q: %v", resourceLbl, err)
+			}
+			resourceExprs = append(resourceExprs, prom.LabelMatches(string(resourceLbl), valueExpr))
+		} else {
+			matcher, err := prom.LabelMatchesValues(string(resourceLbl), names...)
+			if err != nil {
+				return "", fmt.Errorf("unable to construct matcher for %s: %v", resource.String(), err)
+			}
+			resourceExprs = append(resourceExprs, matcher)
+		}
+		valuesByName[string(resourceLbl)] = names
+		groupBy = []string{string(resourceLbl)}
+	}
+
+	if namespace != "" && !namespaceInValues {
 		namespaceLbl, err := n.LabelForResource(nsGroupResource)
 		if err != nil {
 			return "", err
 		}
 		exprs = append(exprs, prom.LabelEq(string(namespaceLbl), namespace))
 		valuesByName[string(namespaceLbl)] = []string{namespace}
+		if n.namespace != "" && resource != nsGroupResource {
+			// keep the namespace on results, so that they can be checked against the rule's namespace
+			groupBy = append(groupBy, string(namespaceLbl))
+		}
+	} else if namespace == "" && !namespaceInValues && resource != nsGroupResource && isNamespacedResource(n.mapper, resource) {
+		// objects in different namespaces may have the same name, so keep their results apart
+		if namespaceLbl, err := n.LabelForResource(nsGroupResource); err == nil {
+			groupBy = append(groupBy, string(namespaceLbl))
+		}
 	}
+	exprs = append(exprs, resourceExprs...)
 
-	resourceLbl, err := n.LabelForResource(resource)
+	// select the series that produced the metric name, if it depends on labels
+	seriesLblNames := make([]string, 0, len(seriesLabels))
+	for lbl := range seriesLabels {
+		seriesLblNames = append(seriesLblNames, string(lbl))
+	}
+	sort.Strings(seriesLblNames)
+	for _, lbl := range seriesLblNames {
+		val := string(seriesLabels[pmodel.LabelName(lbl)])
+		exprs = append(exprs, prom.LabelEq(lbl, val))
+		valuesByName[lbl] = []string{val}
+	}
+
+	// narrow the series down by their own labels, if requested
+	metricExprs, metricValues, err := metricSelectorMatchers(metricSelector)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("unable to convert metric selector to label matchers: %v", err)
+	}
+	exprs = append(exprs, metricExprs...)
+	for lbl, vals := range metricValues {
+		if _, exists := valuesByName[lbl]; !exists {
+			valuesByName[lbl] = vals
+		}
+	}
+
+	kind, err := n.mapper.KindFor(resource.WithVersion(""))
+	if err != nil {
+		return "", fmt.Errorf("unable to find kind for %s: %v", resource.String(), err)
 	}
-	matcher := prom.LabelEq
-	targetValue := names[0]
-	if len(names) > 1 {
-		matcher = prom.LabelMatches
-		targetValue = strings.Join(names, "|")
+	var labelSelector string
+	if selector != nil {
+		labelSelector = selector.String()
 	}
-	exprs = append(exprs, matcher(string(resourceLbl), targetValue))
-	valuesByName[string(resourceLbl)] = names
 
 	args := queryTemplateArgs{
 		Series:            series,
 		LabelMatchers:     strings.Join(exprs, ","),
 		LabelValuesByName: valuesByName,
-		GroupBy:           string(resourceLbl),
-		GroupBySlice:      []string{string(resourceLbl)},
+		MetricSelector:    strings.Join(metricExprs, ","),
+		GroupBy:           strings.Join(groupBy, ","),
+		GroupBySlice:      groupBy,
+		Resource:          resource.String(),
+		Kind:              kind.Kind,
+		Namespace:         namespace,
+		LabelSelector:     labelSelector,
+		Constants:         n.constants,
+		RateWindow:        n.rateWindow,
 	}
 	queryBuff := new(bytes.Buffer)
 	if err := n.metricsQueryTemplate.Execute(queryBuff, args); err != nil {
@@ -247,6 +422,133 @@ func (n *metricNamer) QueryForSeries(series string, resource schema.GroupResourc
 	return prom.Selector(queryBuff.String()), nil
 }
 
+// queryForEachName produces a query for each of the given names, and combines them
+// with `or`, for names whose label matchers can't be combined into a single query.
+func (n *metricNamer) queryForEachName(series string, seriesLabels pmodel.LabelSet, resource schema.GroupResource, namespace string, selector labels.Selector, metricSelector labels.Selector, names []string) (prom.Selector, error) {
+	queries := make([]string, len(names))
+	for i, name := range names {
+		query, err := n.QueryForSeries(series, seriesLabels, resource, namespace, selector, metricSelector, name)
+		if err != nil {
+			return "", err
+		}
+		queries[i] = "(" + string(query) + ")"
+	}
+	return prom.Selector(strings.Join(queries, " or ")), nil
+}
+
+func (n *metricNamer) ObjectForLabels(resource schema.GroupResource, namespace string, labels pmodel.Metric) (types.NamespacedName, bool) {
+	// the metrics query may select series from anywhere, so results of
+	// namespace-restricted rules are only used if they're from the rule's namespace
+	if n.namespace != "" {
+		if namespace != "" && namespace != n.namespace {
+			return types.NamespacedName{}, false
+		}
+		namespace = n.namespace
+		if !n.inRestrictedNamespace(resource, labels) {
+			return types.NamespacedName{}, false
+		}
+	}
+
+	// results for namespaced objects may say which namespace the object is in
+	if resource != nsGroupResource && isNamespacedResource(n.mapper, resource) {
+		if nsLbl, err := n.LabelForResource(nsGroupResource); err == nil {
+			if valueNamespace := string(labels[nsLbl]); valueNamespace != "" {
+				if namespace != "" && valueNamespace != namespace {
+					return types.NamespacedName{}, false
+				}
+				namespace = valueNamespace
+			}
+		}
+	}
+
+	if composite, ok := n.composites[resource]; ok {
+		name, ok := composite.NameForLabels(labels)
+		return types.NamespacedName{Namespace: namespace, Name: name}, ok
+	}
+
+	lbl, err := n.LabelForResource(resource)
+	if err != nil {
+		klog.Errorf("unable to determine label for resource %s: %v", resource.String(), err)
+		return types.NamespacedName{}, false
+	}
+	value, present := labels[lbl]
+	if !present {
+		return types.NamespacedName{}, false
+	}
+
+	transform, ok := n.valueTransforms[lbl]
+	if !ok {
+		return types.NamespacedName{Namespace: namespace, Name: string(value)}, true
+	}
+
+	valueNamespace, name, ok := transform.ObjectForValue(string(value))
+	if !ok {
+		return types.NamespacedName{}, false
+	}
+	if transform.nsSeparator != "" {
+		if namespace != "" && valueNamespace != namespace {
+			return types.NamespacedName{}, false
+		}
+		namespace = valueNamespace
+	}
+
+	if transform.lookup != nil {
+		lookup, err := n.lookups.lookupFor(resource, *transform.lookup)
+		if err != nil {
+			klog.Errorf("unable to look up %s by the value of label %q: %v", resource.String(), lbl, err)
+			return types.NamespacedName{}, false
+		}
+		name, ok, err = lookup.NameForKey(namespace, name)
+		if err != nil {
+			klog.Errorf("unable to look up %s by the value of label %q: %v", resource.String(), lbl, err)
+			return types.NamespacedName{}, false
+		}
+	}
+
+	return types.NamespacedName{Namespace: namespace, Name: name}, ok
+}
+
+// inRestrictedNamespace checks if a result of a namespace-restricted rule is labeled
+// with the rule's namespace.  Results whose resource label values contain the namespace
+// are checked when the values are converted into objects instead.
+func (n *metricNamer) inRestrictedNamespace(resource schema.GroupResource, labels pmodel.Metric) bool {
+	if _, isComposite := n.composites[resource]; !isComposite {
+		if resourceLbl, err := n.LabelForResource(resource); err == nil {
+			if transform, ok := n.valueTransforms[resourceLbl]; ok && transform.nsSeparator != "" {
+				return true
+			}
+		}
+	}
+
+	nsLbl, err := n.LabelForResource(nsGroupResource)
+	if err != nil {
+		return false
+	}
+	return string(labels[nsLbl]) == n.namespace
+}
+
+// lookupKeysForNames converts the given object names into the keys that they're
+// identified by in label values, for transforms which look objects up.
+func (n *metricNamer) lookupKeysForNames(transform *labelValueTransform, resource schema.GroupResource, namespace string, names []string) ([]string, error) {
+	lookup, err := n.lookups.lookupFor(resource, *transform.lookup)
+	if err != nil {
+		return nil, fmt.Errorf("unable to look up %s: %v", resource.String(), err)
+	}
+
+	var keys []string
+	for _, name := range names {
+		nameKeys, err := lookup.KeysForName(namespace, name)
+		if err != nil {
+			return nil, fmt.Errorf("unable to look up %s %q: %v", resource.String(), name, err)
+		}
+		keys = append(keys, nameKeys...)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no lookup values known for the requested %s", resource.String())
+	}
+	return keys, nil
+}
+
 func (n *metricNamer) ResourcesForSeries(series prom.Series) ([]schema.GroupResource, bool) {
 	// use an updates map to avoid having to drop the read lock to update the cache
 	// until the end.  Since we'll probably have few updates after the first run,
@@ -275,7 +577,7 @@ func (n *metricNamer) ResourcesForSeries(series prom.Series) ([]schema.GroupReso
 				if groupRes, ok = n.labelResExtractor.GroupResourceForLabel(lbl); ok {
 					info, _, err := provider.CustomMetricInfo{GroupResource: groupRes}.Normalized(n.mapper)
 					if err != nil {
-						glog.Errorf("unable to normalize group-resource %s from label %q, skipping: %v", groupRes.String(), lbl, err)
+						klog.Errorf("unable to normalize group-resource %s from label %q, skipping: %v", groupRes.String(), lbl, err)
 						continue
 					}
 
@@ -288,9 +590,20 @@ func (n *metricNamer) ResourcesForSeries(series prom.Series) ([]schema.GroupReso
 			if groupRes == nsGroupResource {
 				namespaced = true
 			}
+			// labels whose values contain the namespace make the series namespaced, too
+			if transform, hasTransform := n.valueTransforms[lbl]; ok && hasTransform && transform.nsSeparator != "" {
+				namespaced = true
+			}
 		}
 	}()
 
+	// composite resources are present if all the labels that make up their names are
+	for groupRes, composite := range n.composites {
+		if composite.HasLabels(series.Labels) {
+			resources = append(resources, groupRes)
+		}
+	}
+
 	// update the cache for next time.  This should only be called by discovery,
 	// so we don't really have to worry about the grap between read and write locks
 	// (plus, we don't care if someone else updates the cache first, since the results
@@ -362,113 +675,291 @@ func (n *metricNamer) makeLabelForResource(resource schema.GroupResource) (pmode
 }
 
 func (n *metricNamer) MetricNameForSeries(series prom.Series) (string, error) {
+	return n.expandName(n.nameAs, n.nameTemplate, series)
+}
+
+func (n *metricNamer) MetricAliasesForSeries(series prom.Series) ([]MetricAlias, error) {
+	if len(n.aliases) == 0 {
+		return nil, nil
+	}
+	res := make([]MetricAlias, len(n.aliases))
+	for i, alias := range n.aliases {
+		name, err := n.expandName(alias.as, alias.template, series)
+		if err != nil {
+			return nil, fmt.Errorf("unable to produce alias %q: %v", alias.as, err)
+		}
+		res[i] = MetricAlias{Name: name, Deprecated: alias.deprecated}
+	}
+	return res, nil
+}
+
+// expandName produces a name for the given series, either by expanding the
+// given `as` value with the captures from the name matcher, or by executing the
+// given template, if non-nil.
+func (n *metricNamer) expandName(nameAs string, nameTemplate *template.Template, series prom.Series) (string, error) {
 	matches := n.nameMatches.FindStringSubmatchIndex(series.Name)
 	if matches == nil {
 		return "", fmt.Errorf("series name %q did not match expected pattern %q", series.Name, n.nameMatches.String())
 	}
-	outNameBytes := n.nameMatches.ExpandString(nil, n.nameAs, series.Name, matches)
-	return string(outNameBytes), nil
+	if nameTemplate == nil {
+		outNameBytes := n.nameMatches.ExpandString(nil, nameAs, series.Name, matches)
+		return string(outNameBytes), nil
+	}
+
+	args := nameTemplateArgs{
+		Series: series.Name,
+		Match:  make(map[string]string, len(matches)),
+		Labels: make(map[string]string, len(series.Labels)),
+	}
+	for i, groupName := range n.nameMatches.SubexpNames() {
+		if matches[2*i] < 0 {
+			continue
+		}
+		val := series.Name[matches[2*i]:matches[2*i+1]]
+		args.Match[strconv.Itoa(i)] = val
+		if groupName != "" {
+			args.Match[groupName] = val
+		}
+	}
+	for lbl, val := range series.Labels {
+		args.Labels[string(lbl)] = string(val)
+	}
+
+	nameBuff := new(bytes.Buffer)
+	if err := nameTemplate.Execute(nameBuff, args); err != nil {
+		return "", fmt.Errorf("unable to name series %q: %v", series.String(), err)
+	}
+	if nameBuff.Len() == 0 {
+		return "", fmt.Errorf("empty name produced by name template for series %q", series.String())
+	}
+	return nameBuff.String(), nil
+}
+
+func (n *metricNamer) SeriesLabelsForName(series prom.Series) pmodel.LabelSet {
+	if len(n.nameLabels) == 0 {
+		return nil
+	}
+	res := make(pmodel.LabelSet, len(n.nameLabels))
+	for _, lbl := range n.nameLabels {
+		res[lbl] = series.Labels[lbl]
+	}
+	return res
 }
 
 // NamersFromConfig produces a MetricNamer for each rule in the given config.
-func NamersFromConfig(cfg *config.MetricsDiscoveryConfig, mapper apimeta.RESTMapper) ([]MetricNamer, error) {
+// Rules which look up objects by label value use the given lookup cache, which may
+// be nil if no rules do so.
+func NamersFromConfig(cfg *config.MetricsDiscoveryConfig, mapper apimeta.RESTMapper, lookups *ObjectLookupCache) ([]MetricNamer, error) {
 	namers := make([]MetricNamer, len(cfg.Rules))
 
 	for i, rule := range cfg.Rules {
-		var labelTemplate *template.Template
-		var labelResExtractor *labelGroupResExtractor
-		var err error
-		if rule.Resources.Template != "" {
-			labelTemplate, err = template.New("resource-label").Delims("<<", ">>").Parse(rule.Resources.Template)
-			if err != nil {
-				return nil, fmt.Errorf("unable to parse label template %q associated with series query %q: %v", rule.Resources.Template, rule.SeriesQuery, err)
-			}
+		namer, err := NamerFromRule(cfg.QueryDefaults.ApplyTo(rule), mapper, lookups)
+		if err != nil {
+			return nil, err
+		}
+		namers[i] = namer
+	}
 
-			labelResExtractor, err = newLabelGroupResExtractor(labelTemplate)
-			if err != nil {
-				return nil, fmt.Errorf("unable to generate label format from template %q associated with series query %q: %v", rule.Resources.Template, rule.SeriesQuery, err)
-			}
+	return namers, nil
+}
+
+// NamerFromRule produces a MetricNamer for a single discovery rule.  If the rule
+// looks up objects by label value, the given lookup cache must not be nil.
+func NamerFromRule(rule config.DiscoveryRule, mapper apimeta.RESTMapper, lookups *ObjectLookupCache) (MetricNamer, error) {
+	var labelTemplate *template.Template
+	var labelResExtractor *labelGroupResExtractor
+	var err error
+	if rule.Resources.Template != "" {
+		labelTemplate, err = template.New("resource-label").Delims("<<", ">>").Parse(rule.Resources.Template)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse label template %q associated with series query %q: %v", rule.Resources.Template, rule.SeriesQuery, err)
 		}
 
-		metricsQueryTemplate, err := template.New("metrics-query").Delims("<<", ">>").Parse(rule.MetricsQuery)
+		labelResExtractor, err = newLabelGroupResExtractor(labelTemplate)
 		if err != nil {
-			return nil, fmt.Errorf("unable to parse metrics query template %q associated with series query %q: %v", rule.MetricsQuery, rule.SeriesQuery, err)
+			return nil, fmt.Errorf("unable to generate label format from template %q associated with series query %q: %v", rule.Resources.Template, rule.SeriesQuery, err)
 		}
+	}
 
-		seriesMatchers := make([]*reMatcher, len(rule.SeriesFilters))
-		for i, filterRaw := range rule.SeriesFilters {
-			matcher, err := newReMatcher(filterRaw)
-			if err != nil {
-				return nil, fmt.Errorf("unable to generate series name filter associated with series query %q: %v", rule.SeriesQuery, err)
-			}
-			seriesMatchers[i] = matcher
+	rateWindow, err := parseRateWindow(rule.RateWindow)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate window associated with series query %q: %v", rule.SeriesQuery, err)
+	}
+	metricsQueryTemplate, err := newQueryTemplate(rule.MetricsQuery, rule.Constants, rateWindow)
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct metrics query template associated with series query %q: %v", rule.SeriesQuery, err)
+	}
+	// the label matchers are what limit the query to the rule's namespace
+	if rule.Namespace != "" {
+		restricted, err := rendersLabelMatchers(metricsQueryTemplate, rule.Constants, rateWindow)
+		if err != nil {
+			return nil, fmt.Errorf("unable to check metrics query template associated with series query %q: %v", rule.SeriesQuery, err)
 		}
-		if rule.Name.Matches != "" {
-			matcher, err := newReMatcher(config.RegexFilter{Is: rule.Name.Matches})
-			if err != nil {
-				return nil, fmt.Errorf("unable to generate series name filter from name rules associated with series query %q: %v", rule.SeriesQuery, err)
-			}
-			seriesMatchers = append(seriesMatchers, matcher)
+		if !restricted {
+			return nil, fmt.Errorf("metrics query associated with series query %q must use .LabelMatchers, since the rule is restricted to namespace %q", rule.SeriesQuery, rule.Namespace)
 		}
+	}
 
-		var nameMatches *regexp.Regexp
-		if rule.Name.Matches != "" {
-			nameMatches, err = regexp.Compile(rule.Name.Matches)
-			if err != nil {
-				return nil, fmt.Errorf("unable to compile series name match expression %q associated with series query %q: %v", rule.Name.Matches, rule.SeriesQuery, err)
-			}
+	seriesMatchers := make([]*reMatcher, len(rule.SeriesFilters))
+	for i, filterRaw := range rule.SeriesFilters {
+		matcher, err := newReMatcher(filterRaw)
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate series name filter associated with series query %q: %v", rule.SeriesQuery, err)
+		}
+		seriesMatchers[i] = matcher
+	}
+	if rule.Name.Matches != "" {
+		matcher, err := newReMatcher(config.RegexFilter{Is: rule.Name.Matches})
+		if err != nil {
+			return nil, fmt.Errorf("unable to generate series name filter from name rules associated with series query %q: %v", rule.SeriesQuery, err)
+		}
+		seriesMatchers = append(seriesMatchers, matcher)
+	}
+
+	var nameMatches *regexp.Regexp
+	if rule.Name.Matches != "" {
+		nameMatches, err = regexp.Compile(rule.Name.Matches)
+		if err != nil {
+			return nil, fmt.Errorf("unable to compile series name match expression %q associated with series query %q: %v", rule.Name.Matches, rule.SeriesQuery, err)
+		}
+	} else {
+		// this will always succeed
+		nameMatches = regexp.MustCompile(".*")
+	}
+	nameAs := rule.Name.As
+	if nameAs == "" {
+		// check if we have an obvious default
+		subexpNames := nameMatches.SubexpNames()
+		if len(subexpNames) == 1 {
+			// no capture groups, use the whole thing
+			nameAs = "$0"
+		} else if len(subexpNames) == 2 {
+			// one capture group, use that
+			nameAs = "$1"
+		} else if hasSubexp(nameMatches, "name") {
+			// several capture groups, but one is clearly the name
+			nameAs = "${name}"
 		} else {
-			// this will always succeed
-			nameMatches = regexp.MustCompile(".*")
-		}
-		nameAs := rule.Name.As
-		if nameAs == "" {
-			// check if we have an obvious default
-			subexpNames := nameMatches.SubexpNames()
-			if len(subexpNames) == 1 {
-				// no capture groups, use the whole thing
-				nameAs = "$0"
-			} else if len(subexpNames) == 2 {
-				// one capture group, use that
-				nameAs = "$1"
-			} else {
-				return nil, fmt.Errorf("must specify an 'as' value for name matcher %q associated with series query %q", rule.Name.Matches, rule.SeriesQuery)
-			}
+			return nil, fmt.Errorf("must specify an 'as' value for name matcher %q associated with series query %q", rule.Name.Matches, rule.SeriesQuery)
+		}
+	}
+
+	var nameTemplate *template.Template
+	var nameLabels []pmodel.LabelName
+	if strings.Contains(nameAs, "<<") {
+		nameTemplate, nameLabels, err = newNameTemplate(nameAs)
+		if err != nil {
+			return nil, fmt.Errorf("unable to construct name template associated with series query %q: %v", rule.SeriesQuery, err)
 		}
+	}
 
-		namer := &metricNamer{
-			seriesQuery:          prom.Selector(rule.SeriesQuery),
-			labelTemplate:        labelTemplate,
-			labelResExtractor:    labelResExtractor,
-			metricsQueryTemplate: metricsQueryTemplate,
-			mapper:               mapper,
-			nameMatches:          nameMatches,
-			nameAs:               nameAs,
-			seriesMatchers:       seriesMatchers,
+	namer := &metricNamer{
+		seriesQuery:          prom.Selector(rule.SeriesQuery),
+		labelTemplate:        labelTemplate,
+		labelResExtractor:    labelResExtractor,
+		metricsQueryTemplate: metricsQueryTemplate,
+		constants:            rule.Constants,
+		rateWindow:           rateWindow,
+		mapper:               mapper,
+		nameMatches:          nameMatches,
+		nameAs:               nameAs,
+		nameTemplate:         nameTemplate,
+		nameLabels:           nameLabels,
+		seriesMatchers:       seriesMatchers,
+		namespace:            rule.Namespace,
+		valueTransforms:      make(map[pmodel.LabelName]*labelValueTransform, len(rule.Resources.Values)),
+		lookups:              lookups,
+		composites:           make(map[schema.GroupResource]*compositeName, len(rule.Resources.Composites)),
+
+		labelToResource: make(map[pmodel.LabelName]schema.GroupResource),
+		resourceToLabel: make(map[schema.GroupResource]pmodel.LabelName),
+	}
 
-			labelToResource: make(map[pmodel.LabelName]schema.GroupResource),
-			resourceToLabel: make(map[schema.GroupResource]pmodel.LabelName),
+	for _, aliasCfg := range rule.Aliases {
+		alias, err := newAliasNamer(aliasCfg, nameLabels)
+		if err != nil {
+			return nil, fmt.Errorf("unable to construct alias associated with series query %q: %v", rule.SeriesQuery, err)
 		}
+		namer.aliases = append(namer.aliases, alias)
+	}
 
-		// invert the structure for consistency with the template
-		for lbl, groupRes := range rule.Resources.Overrides {
-			infoRaw := provider.CustomMetricInfo{
-				GroupResource: schema.GroupResource{
-					Group:    groupRes.Group,
-					Resource: groupRes.Resource,
-				},
-			}
-			info, _, err := infoRaw.Normalized(mapper)
-			if err != nil {
-				return nil, fmt.Errorf("unable to normalize group-resource %v: %v", groupRes, err)
-			}
+	converter, err := NewValueConverter(rule.Unit, rule.Scale)
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct value converter associated with series query %q: %v", rule.SeriesQuery, err)
+	}
+	namer.resultPolicy, err = NewResultPolicy(rule.Results, converter)
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct result policy associated with series query %q: %v", rule.SeriesQuery, err)
+	}
 
-			namer.labelToResource[pmodel.LabelName(lbl)] = info.GroupResource
-			namer.resourceToLabel[info.GroupResource] = pmodel.LabelName(lbl)
+	if rule.Evaluation != nil {
+		namer.rangeEvaluator, err = NewRangeEvaluator(*rule.Evaluation)
+		if err != nil {
+			return nil, fmt.Errorf("unable to construct range evaluator associated with series query %q: %v", rule.SeriesQuery, err)
 		}
+	}
 
-		namers[i] = namer
+	if rule.Merge != nil {
+		namer.merger, err = NewSeriesMerger(*rule.Merge)
+		if err != nil {
+			return nil, fmt.Errorf("unable to construct series merger associated with series query %q: %v", rule.SeriesQuery, err)
+		}
 	}
 
-	return namers, nil
+	for lbl, transformCfg := range rule.Resources.Values {
+		transform, err := newLabelValueTransform(transformCfg)
+		if err != nil {
+			return nil, fmt.Errorf("unable to construct value transform for label %q associated with series query %q: %v", lbl, rule.SeriesQuery, err)
+		}
+		if transform.lookup != nil && lookups == nil {
+			return nil, fmt.Errorf("label %q associated with series query %q looks up objects, but object lookups are not available", lbl, rule.SeriesQuery)
+		}
+		namer.valueTransforms[pmodel.LabelName(lbl)] = transform
+	}
+
+	for _, compositeCfg := range rule.Resources.Composites {
+		info, _, err := provider.CustomMetricInfo{
+			GroupResource: schema.GroupResource{
+				Group:    compositeCfg.Group,
+				Resource: compositeCfg.Resource,
+			},
+		}.Normalized(mapper)
+		if err != nil {
+			return nil, fmt.Errorf("unable to normalize group-resource %v: %v", compositeCfg.GroupResource, err)
+		}
+		composite, err := newCompositeName(compositeCfg.Name)
+		if err != nil {
+			return nil, fmt.Errorf("unable to construct composite names for %s associated with series query %q: %v", info.GroupResource.String(), rule.SeriesQuery, err)
+		}
+		namer.composites[info.GroupResource] = composite
+	}
+
+	// invert the structure for consistency with the template
+	for lbl, groupRes := range rule.Resources.Overrides {
+		infoRaw := provider.CustomMetricInfo{
+			GroupResource: schema.GroupResource{
+				Group:    groupRes.Group,
+				Resource: groupRes.Resource,
+			},
+		}
+		info, _, err := infoRaw.Normalized(mapper)
+		if err != nil {
+			return nil, fmt.Errorf("unable to normalize group-resource %v: %v", groupRes, err)
+		}
+
+		namer.labelToResource[pmodel.LabelName(lbl)] = info.GroupResource
+		namer.resourceToLabel[info.GroupResource] = pmodel.LabelName(lbl)
+	}
+
+	return namer, nil
+}
+
+// hasSubexp checks if the given expression has a capture group with the given name.
+func hasSubexp(expr *regexp.Regexp, name string) bool {
+	for _, subexpName := range expr.SubexpNames() {
+		if subexpName == name {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,67 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+
+	prom "github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/client"
+)
+
+// metricSelectorMatchers converts a metric selector into Prometheus label matchers,
+// returning the matchers and the values used for each label (if any).
+func metricSelectorMatchers(metricSelector labels.Selector) ([]string, map[string][]string, error) {
+	if metricSelector == nil {
+		return nil, nil, nil
+	}
+	reqs, selectable := metricSelector.Requirements()
+	if !selectable {
+		return nil, nil, fmt.Errorf("metric selector %q cannot select any series", metricSelector.String())
+	}
+
+	matchers := make([]string, 0, len(reqs))
+	values := make(map[string][]string, len(reqs))
+	for _, req := range reqs {
+		lbl := req.Key()
+		vals := req.Values().List()
+
+		var matcher string
+		var err error
+		switch req.Operator() {
+		case selection.Equals, selection.DoubleEquals, selection.In:
+			matcher, err = prom.LabelMatchesValues(lbl, vals...)
+			values[lbl] = vals
+		case selection.NotEquals, selection.NotIn:
+			matcher, err = prom.LabelNotMatchesValues(lbl, vals...)
+		case selection.Exists:
+			matcher, err = prom.LabelNotMatchesValues(lbl, "")
+		case selection.DoesNotExist:
+			matcher, err = prom.LabelMatchesValues(lbl, "")
+		default:
+			return nil, nil, fmt.Errorf("operator %q in metric selector %q is not supported", req.Operator(), metricSelector.String())
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to use metric selector %q: %v", metricSelector.String(), err)
+		}
+		matchers = append(matchers, matcher)
+	}
+
+	return matchers, values, nil
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"unicode"
+
+	pmodel "github.com/prometheus/common/model"
+)
+
+// nameTemplateArgs are the arguments for the metric name (`as`) template.
+type nameTemplateArgs struct {
+	// Series is the full name of the series.
+	Series string
+	// Match contains the capture groups from the `matches` expression,
+	// both by name (for named groups) and by index (as a string).
+	Match map[string]string
+	// Labels contains the labels of the series.
+	Labels map[string]string
+}
+
+// nameTemplateFuncs are the helper functions available in metric name templates.
+// Functions that take extra arguments take the value being transformed last, so
+// that they can be used in pipelines.
+var nameTemplateFuncs = template.FuncMap{
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"snakeCase":  func(s string) string { return strings.Join(nameWords(s), "_") },
+	"kebabCase":  func(s string) string { return strings.Join(nameWords(s), "-") },
+	"trim":       func(cutset, s string) string { return strings.Trim(s, cutset) },
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"replace":    func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+}
+
+// nameWords splits a name into lower-case words, at non-alphanumeric characters
+// and at changes from lower to upper case (so `httpRequests_Total` becomes
+// `http`, `requests`, `total`).  Runs of upper case letters are kept together,
+// except for the last, which starts a new word if followed by lower case
+// (so `HTTPRequests` becomes `http`, `requests`).
+func nameWords(s string) []string {
+	var words []string
+	var current []rune
+	runes := []rune(s)
+
+	flush := func() {
+		if len(current) > 0 {
+			words = append(words, strings.ToLower(string(current)))
+			current = current[:0]
+		}
+	}
+
+	for i, r := range runes {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			flush()
+			continue
+		}
+		if unicode.IsUpper(r) && len(current) > 0 {
+			prev := runes[i-1]
+			nextIsLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextIsLower) {
+				flush()
+			}
+		}
+		current = append(current, r)
+	}
+	flush()
+
+	return words
+}
+
+// newNameTemplate parses a metric name template, returning the labels that it
+// refers to.  So that the labels a name depends on can be determined ahead of
+// time, labels may only be referred to as `.Labels.<name>`.
+func newNameTemplate(nameTemplate string) (*template.Template, []pmodel.LabelName, error) {
+	tmpl, err := template.New("metric-name").Delims("<<", ">>").Funcs(nameTemplateFuncs).Option("missingkey=error").Parse(nameTemplate)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to parse name template %q: %v", nameTemplate, err)
+	}
+	if tmpl.Tree == nil || tmpl.Tree.Root == nil {
+		return nil, nil, fmt.Errorf("empty name template")
+	}
+
+	labelSet := make(map[pmodel.LabelName]struct{})
+	if err := collectTemplateLabels(tmpl.Tree.Root, labelSet); err != nil {
+		return nil, nil, fmt.Errorf("invalid name template %q: %v", nameTemplate, err)
+	}
+
+	labels := make([]pmodel.LabelName, 0, len(labelSet))
+	for lbl := range labelSet {
+		labels = append(labels, lbl)
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i] < labels[j] })
+
+	return tmpl, labels, nil
+}
+
+// collectTemplateLabels walks the given template node, recording the labels referred
+// to by `.Labels.<name>`, and rejecting any other use of `.Labels` (or of the whole
+// template arguments, which would include the labels).
+func collectTemplateLabels(node parse.Node, labels map[pmodel.LabelName]struct{}) error {
+	return walkTemplate(node, func(node parse.Node) error {
+		switch node := node.(type) {
+		case *parse.FieldNode:
+			return collectLabelRef(node.Ident, labels)
+		case *parse.VariableNode:
+			if node.Ident[0] == "$" {
+				return collectLabelRef(node.Ident[1:], labels)
+			}
+		case *parse.DotNode:
+			return fmt.Errorf("the template arguments may not be used directly, only their fields")
+		case *parse.TemplateNode:
+			return fmt.Errorf("the template may not invoke other templates")
+		}
+		return nil
+	})
+}
+
+// walkTemplate calls visit with the given template node and each node beneath it,
+// parents before children, stopping at the first error.
+func walkTemplate(node parse.Node, visit func(parse.Node) error) error {
+	var children []parse.Node
+	switch node := node.(type) {
+	case nil:
+		return nil
+	case *parse.ListNode:
+		if node == nil {
+			return nil
+		}
+		children = node.Nodes
+	case *parse.ActionNode:
+		children = []parse.Node{node.Pipe}
+	case *parse.PipeNode:
+		if node == nil {
+			return nil
+		}
+		for _, cmd := range node.Cmds {
+			children = append(children, cmd)
+		}
+	case *parse.CommandNode:
+		children = node.Args
+	case *parse.IfNode:
+		children = branchChildren(&node.BranchNode)
+	case *parse.RangeNode:
+		children = branchChildren(&node.BranchNode)
+	case *parse.WithNode:
+		children = branchChildren(&node.BranchNode)
+	case *parse.ChainNode:
+		children = []parse.Node{node.Node}
+	case *parse.TemplateNode:
+		children = []parse.Node{node.Pipe}
+	}
+
+	if err := visit(node); err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err := walkTemplate(child, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// branchChildren returns the nodes beneath an if, range, or with node.
+func branchChildren(node *parse.BranchNode) []parse.Node {
+	return []parse.Node{node.Pipe, node.List, node.ElseList}
+}
+
+// collectLabelRef records the label referred to by the given field chain, if any.
+func collectLabelRef(ident []string, labels map[pmodel.LabelName]struct{}) error {
+	if len(ident) == 0 {
+		return fmt.Errorf("the template arguments may not be used directly, only their fields")
+	}
+	if ident[0] != "Labels" {
+		return nil
+	}
+	if len(ident) != 2 {
+		return fmt.Errorf("labels may only be referred to as `.Labels.<name>`")
+	}
+	labels[pmodel.LabelName(ident[1])] = struct{}{}
+	return nil
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+// NamerSource provides the set of MetricNamers that should be used during
+// discovery.  The set may change between calls (for instance, when rules
+// are loaded from the cluster), so callers should fetch the current set
+// once per discovery run, and use that for the whole run.
+type NamerSource interface {
+	// Namers returns the current set of MetricNamers.
+	Namers() []MetricNamer
+}
+
+// MetricCountReporter is optionally implemented by NamerSources that want to
+// know how many metrics each of their namers exposed after a discovery run.
+type MetricCountReporter interface {
+	// ReportMetricCounts is called after each successful discovery run with the
+	// number of metrics exposed by each namer used in that run.
+	ReportMetricCounts(counts map[MetricNamer]int)
+}
+
+// StaticNamers is a NamerSource with a fixed set of namers, such as those
+// produced from the discovery config file.
+type StaticNamers []MetricNamer
+
+func (n StaticNamers) Namers() []MetricNamer {
+	return n
+}
+
+// mergedNamerSource is a NamerSource which combines the namers of
+// several other NamerSources, in order.
+type mergedNamerSource []NamerSource
+
+// MergeNamerSources produces a NamerSource that returns the namers from
+// each of the given sources, in order.  Metric count reports are passed
+// on to each of the sources that accept them.
+func MergeNamerSources(sources ...NamerSource) NamerSource {
+	return mergedNamerSource(sources)
+}
+
+func (s mergedNamerSource) Namers() []MetricNamer {
+	var namers []MetricNamer
+	for _, source := range s {
+		namers = append(namers, source.Namers()...)
+	}
+	return namers
+}
+
+func (s mergedNamerSource) ReportMetricCounts(counts map[MetricNamer]int) {
+	for _, source := range s {
+		if reporter, ok := source.(MetricCountReporter); ok {
+			reporter.ReportMetricCounts(counts)
+		}
+	}
+}
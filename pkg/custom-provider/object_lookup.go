@@ -0,0 +1,242 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+
+	"github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/config"
+)
+
+// lookupIndex is the name of the informer index containing lookup keys.
+const lookupIndex = "lookup"
+
+// ObjectLookupCache finds objects by something other than their name, such
+// as a node's InternalIP address.  It's backed by informers, each of which is
+// started the first time a particular resource and field are looked up.  Until
+// an informer has synced, lookups will simply fail to find objects.
+type ObjectLookupCache struct {
+	client       dynamic.Interface
+	mapper       apimeta.RESTMapper
+	resyncPeriod time.Duration
+	stopCh       <-chan struct{}
+
+	mu      sync.Mutex
+	lookups map[objectLookupKey]*objectLookup
+}
+
+// objectLookupKey identifies a particular lookup.
+type objectLookupKey struct {
+	resource schema.GroupResource
+	lookup   config.ObjectLookup
+}
+
+// objectLookup finds objects of a single resource by a single field.
+type objectLookup struct {
+	informer   cache.SharedIndexInformer
+	namespaced bool
+	keysFor    func(obj *unstructured.Unstructured) []string
+}
+
+// NewObjectLookupCache constructs a new ObjectLookupCache, which lists and watches
+// objects using the given client.  Informers are stopped when the given channel is closed.
+func NewObjectLookupCache(client dynamic.Interface, mapper apimeta.RESTMapper, resyncPeriod time.Duration, stopCh <-chan struct{}) *ObjectLookupCache {
+	return &ObjectLookupCache{
+		client:       client,
+		mapper:       mapper,
+		resyncPeriod: resyncPeriod,
+		stopCh:       stopCh,
+		lookups:      make(map[objectLookupKey]*objectLookup),
+	}
+}
+
+// validateObjectLookup checks that the given lookup specifies exactly one field.
+func validateObjectLookup(lookup config.ObjectLookup) error {
+	if (lookup.Field == "") == (lookup.NodeAddressType == "") {
+		return fmt.Errorf("object lookups must specify exactly one of `field` or `nodeAddressType`")
+	}
+	return nil
+}
+
+// lookupFor fetches the lookup for the given resource and field, starting a
+// new informer if necessary.
+func (c *ObjectLookupCache) lookupFor(resource schema.GroupResource, lookupCfg config.ObjectLookup) (*objectLookup, error) {
+	key := objectLookupKey{resource: resource, lookup: lookupCfg}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if lookup, ok := c.lookups[key]; ok {
+		return lookup, nil
+	}
+
+	if err := validateObjectLookup(lookupCfg); err != nil {
+		return nil, err
+	}
+
+	kind, err := c.mapper.KindFor(resource.WithVersion(""))
+	if err != nil {
+		return nil, fmt.Errorf("unable to determine the kind of resource %s: %v", resource.String(), err)
+	}
+	mapping, err := c.mapper.RESTMapping(kind.GroupKind(), kind.Version)
+	if err != nil {
+		return nil, fmt.Errorf("unable to determine the mapping for resource %s: %v", resource.String(), err)
+	}
+
+	lookup := &objectLookup{
+		namespaced: mapping.Scope.Name() == apimeta.RESTScopeNameNamespace,
+		keysFor:    fieldValuesFunc(lookupCfg),
+	}
+
+	resClient := c.client.Resource(mapping.Resource)
+	lw := &cache.ListWatch{
+		ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+			return resClient.List(opts)
+		},
+		WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+			return resClient.Watch(opts)
+		},
+	}
+	lookup.informer = cache.NewSharedIndexInformer(lw, &unstructured.Unstructured{}, c.resyncPeriod, cache.Indexers{
+		lookupIndex: func(rawObj interface{}) ([]string, error) {
+			obj, ok := rawObj.(*unstructured.Unstructured)
+			if !ok {
+				return nil, nil
+			}
+			keys := lookup.keysFor(obj)
+			for i, key := range keys {
+				keys[i] = lookup.indexKey(obj.GetNamespace(), key)
+			}
+			return keys, nil
+		},
+	})
+	go lookup.informer.Run(c.stopCh)
+
+	klog.V(2).Infof("started object cache for looking up %s by %+v", resource.String(), lookupCfg)
+	c.lookups[key] = lookup
+	return lookup, nil
+}
+
+// fieldValuesFunc produces a function which extracts the lookup keys for an
+// object according to the given lookup.
+func fieldValuesFunc(lookupCfg config.ObjectLookup) func(obj *unstructured.Unstructured) []string {
+	if lookupCfg.NodeAddressType != "" {
+		return func(obj *unstructured.Unstructured) []string {
+			addresses, _, err := unstructured.NestedSlice(obj.Object, "status", "addresses")
+			if err != nil {
+				return nil
+			}
+			var res []string
+			for _, rawAddr := range addresses {
+				addr, ok := rawAddr.(map[string]interface{})
+				if !ok || addr["type"] != lookupCfg.NodeAddressType {
+					continue
+				}
+				if val, ok := addr["address"].(string); ok && val != "" {
+					res = append(res, val)
+				}
+			}
+			return res
+		}
+	}
+
+	path := strings.Split(lookupCfg.Field, ".")
+	return func(obj *unstructured.Unstructured) []string {
+		val, found, err := unstructured.NestedString(obj.Object, path...)
+		if err != nil || !found || val == "" {
+			return nil
+		}
+		return []string{val}
+	}
+}
+
+// indexKey produces the index key for the given lookup key in the given namespace.
+func (l *objectLookup) indexKey(namespace, key string) string {
+	if !l.namespaced {
+		return key
+	}
+	return namespace + "/" + key
+}
+
+// checkNamespace checks that a namespace is given for namespaced resources.  Keys are
+// only unique within a namespace, so lookups without one can't identify an object.
+func (l *objectLookup) checkNamespace(namespace string) error {
+	if l.namespaced && namespace == "" {
+		return fmt.Errorf("objects of namespaced resources can only be looked up within a namespace")
+	}
+	return nil
+}
+
+// NameForKey finds the name of the object with the given lookup key in the
+// given namespace (ignored for non-namespaced resources).  It returns false
+// if there is not exactly one such object, and an error if no namespace is
+// given for a namespaced resource.
+func (l *objectLookup) NameForKey(namespace, key string) (string, bool, error) {
+	if err := l.checkNamespace(namespace); err != nil {
+		return "", false, err
+	}
+	objs, err := l.informer.GetIndexer().ByIndex(lookupIndex, l.indexKey(namespace, key))
+	if err != nil {
+		return "", false, fmt.Errorf("unable to look up object by %q: %v", key, err)
+	}
+	if len(objs) != 1 {
+		if len(objs) > 1 {
+			klog.V(4).Infof("ignoring ambiguous lookup key %q, which matches %d objects", key, len(objs))
+		}
+		return "", false, nil
+	}
+	obj, ok := objs[0].(*unstructured.Unstructured)
+	if !ok {
+		return "", false, nil
+	}
+	return obj.GetName(), true, nil
+}
+
+// KeysForName returns the lookup keys for the object with the given name in the
+// given namespace (ignored for non-namespaced resources).  It returns an error if
+// no namespace is given for a namespaced resource.
+func (l *objectLookup) KeysForName(namespace, name string) ([]string, error) {
+	if err := l.checkNamespace(namespace); err != nil {
+		return nil, err
+	}
+	storeKey := name
+	if l.namespaced {
+		storeKey = namespace + "/" + name
+	}
+	rawObj, exists, err := l.informer.GetStore().GetByKey(storeKey)
+	if err != nil || !exists {
+		return nil, nil
+	}
+	obj, ok := rawObj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, nil
+	}
+	return l.keysFor(obj), nil
+}
@@ -0,0 +1,308 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+
+	"github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/config"
+)
+
+// MetricPolicy decides which metrics may be read in which namespaces, and by
+// which service accounts.
+type MetricPolicy struct {
+	defaultAllow bool
+	rules        []policyRule
+
+	// namespaces lists every namespace named by a rule.  Any other
+	// namespace is treated the same as an empty one.
+	namespaces []string
+}
+
+type policyRule struct {
+	allow           bool
+	metrics         []*regexp.Regexp
+	namespaces      map[string]struct{}
+	serviceAccounts map[string]struct{}
+}
+
+// NewMetricPolicy compiles the given policy configuration.
+func NewMetricPolicy(cfg *config.MetricsPolicy) (*MetricPolicy, error) {
+	defaultAllow, err := policyActionAllows(cfg.DefaultAction, true)
+	if err != nil {
+		return nil, fmt.Errorf("invalid default policy action: %v", err)
+	}
+
+	policy := &MetricPolicy{
+		defaultAllow: defaultAllow,
+		rules:        make([]policyRule, len(cfg.Rules)),
+	}
+	for i, ruleCfg := range cfg.Rules {
+		if ruleCfg.Action == "" {
+			return nil, fmt.Errorf("policy rule %d must specify an action", i)
+		}
+		allow, err := policyActionAllows(ruleCfg.Action, false)
+		if err != nil {
+			return nil, fmt.Errorf("invalid action for policy rule %d: %v", i, err)
+		}
+		rule := policyRule{
+			allow:   allow,
+			metrics: make([]*regexp.Regexp, len(ruleCfg.Metrics)),
+		}
+		for j, metricRaw := range ruleCfg.Metrics {
+			// expressions must match the whole name, so that a rule for a metric
+			// doesn't also apply to every other metric containing its name
+			rule.metrics[j], err = regexp.Compile("^(?:" + metricRaw + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("unable to compile metric expression %q for policy rule %d: %v", metricRaw, i, err)
+			}
+		}
+		if len(ruleCfg.Namespaces) > 0 {
+			rule.namespaces = make(map[string]struct{}, len(ruleCfg.Namespaces))
+			for _, ns := range ruleCfg.Namespaces {
+				rule.namespaces[ns] = struct{}{}
+				policy.namespaces = append(policy.namespaces, ns)
+			}
+		}
+		if len(ruleCfg.ServiceAccounts) > 0 {
+			rule.serviceAccounts = make(map[string]struct{}, len(ruleCfg.ServiceAccounts))
+			for _, sa := range ruleCfg.ServiceAccounts {
+				if parts := strings.Split(sa, ":"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+					return nil, fmt.Errorf("invalid service account %q for policy rule %d: must be of the form <namespace>:<name>", sa, i)
+				}
+				rule.serviceAccounts[sa] = struct{}{}
+			}
+		}
+		policy.rules[i] = rule
+	}
+
+	return policy, nil
+}
+
+func policyActionAllows(action config.PolicyAction, defaultAllow bool) (bool, error) {
+	switch action {
+	case "":
+		return defaultAllow, nil
+	case config.PolicyAllow:
+		return true, nil
+	case config.PolicyDeny:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unknown action %q, must be %q or %q", action, config.PolicyAllow, config.PolicyDeny)
+	}
+}
+
+// Allows checks if the given service account (in the form `<namespace>:<name>`,
+// or empty if the requester is not a service account) may read the given metric
+// in the given namespace (empty for non-namespaced objects).
+func (p *MetricPolicy) Allows(metric, namespace, serviceAccount string) bool {
+	return p.mayAllow(metric, &namespace, &serviceAccount)
+}
+
+// MayAllow checks if the given metric may be read in the given namespace by
+// at least some requester.  It's used where the identity of the requester
+// isn't known.
+func (p *MetricPolicy) MayAllow(metric, namespace string) bool {
+	return p.mayAllow(metric, &namespace, nil)
+}
+
+// AllowsWhereverAllowed checks if the given service account may read the given
+// metric in every namespace where at least some requester may read it.  It's used
+// for root-scoped requests, whose results may describe objects in any namespace,
+// since the provider can only filter those results without knowing the requester.
+func (p *MetricPolicy) AllowsWhereverAllowed(metric, serviceAccount string) bool {
+	// namespaces not named by any rule all behave like the empty namespace,
+	// so checking the named ones plus the empty one covers every namespace
+	if !p.allowsWhereverAllowedIn(metric, "", serviceAccount) {
+		return false
+	}
+	for _, ns := range p.namespaces {
+		if !p.allowsWhereverAllowedIn(metric, ns, serviceAccount) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *MetricPolicy) allowsWhereverAllowedIn(metric, namespace, serviceAccount string) bool {
+	return !p.MayAllow(metric, namespace) || p.Allows(metric, namespace, serviceAccount)
+}
+
+// MayAllowAnywhere checks if the given metric may be read in at least some
+// namespace by at least some requester.
+func (p *MetricPolicy) MayAllowAnywhere(metric string) bool {
+	return p.mayAllow(metric, nil, nil)
+}
+
+// mayAllow evaluates the policy, treating nil namespaces or service accounts
+// as unknown.  A rule which might match depending on an unknown value only
+// decides the result if it would allow access -- a rule that might deny access
+// is skipped, since some other namespace or requester could avoid it.
+func (p *MetricPolicy) mayAllow(metric string, namespace, serviceAccount *string) bool {
+	for _, rule := range p.rules {
+		if !rule.matchesMetric(metric) {
+			continue
+		}
+
+		nsMatch, nsKnown := matchesSet(rule.namespaces, namespace, nil)
+		saMatch, saKnown := matchesSet(rule.serviceAccounts, serviceAccount, wildcardServiceAccount)
+		if !nsMatch || !saMatch {
+			continue
+		}
+		if nsKnown && saKnown {
+			return rule.allow
+		}
+		if rule.allow {
+			return true
+		}
+	}
+
+	return p.defaultAllow
+}
+
+func (r policyRule) matchesMetric(metric string) bool {
+	if len(r.metrics) == 0 {
+		return true
+	}
+	for _, expr := range r.metrics {
+		if expr.MatchString(metric) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesSet checks if the given value matches the given set (where an empty
+// set matches anything).  The first return value indicates if the value could
+// match, and the second if that's definitely the case.  The wildcard function,
+// if present, produces an alternate form of the value which also matches.
+func matchesSet(set map[string]struct{}, val *string, wildcard func(string) string) (matches bool, known bool) {
+	if len(set) == 0 {
+		return true, true
+	}
+	if val == nil {
+		return true, false
+	}
+	if _, ok := set[*val]; ok {
+		return true, true
+	}
+	if wildcard != nil {
+		if _, ok := set[wildcard(*val)]; ok {
+			return true, true
+		}
+	}
+	return false, true
+}
+
+// wildcardServiceAccount converts `<namespace>:<name>` to `<namespace>:*`.
+func wildcardServiceAccount(sa string) string {
+	parts := strings.SplitN(sa, ":", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	return parts[0] + ":*"
+}
+
+// policyProvider is a CustomMetricsProvider which enforces a MetricPolicy
+// on another provider.  Since the identity of the requester isn't available
+// to providers, it only denies requests that would be denied for everyone --
+// service account rules must be enforced on the request itself.
+type policyProvider struct {
+	provider.CustomMetricsProvider
+
+	policy *MetricPolicy
+}
+
+// NewPolicyProvider wraps the given provider so that metrics denied by the given
+// policy are hidden from listing, and fail to be fetched.
+func NewPolicyProvider(prov provider.CustomMetricsProvider, policy *MetricPolicy) provider.CustomMetricsProvider {
+	return &policyProvider{
+		CustomMetricsProvider: prov,
+		policy:                policy,
+	}
+}
+
+// NewPolicyForbiddenError returns an error indicating that the given metric is denied by the metrics policy.
+func NewPolicyForbiddenError(groupResource schema.GroupResource, name, metricName string) *apierr.StatusError {
+	return apierr.NewForbidden(groupResource, name, fmt.Errorf("access to metric %q is denied by the metrics policy", metricName))
+}
+
+// checkRootScopedValue checks the policy for the namespace of the object described by
+// a value fetched by a root-scoped request.  Root-scoped requests for namespaced resources
+// describe objects in any namespace, so the namespace can only be checked once the value
+// has been fetched.
+func (p *policyProvider) checkRootScopedValue(groupResource schema.GroupResource, name, metricName string, value *custom_metrics.MetricValue) (*custom_metrics.MetricValue, error) {
+	if value.DescribedObject.Namespace != "" && !p.policy.MayAllow(metricName, value.DescribedObject.Namespace) {
+		return nil, NewPolicyForbiddenError(groupResource, name, metricName)
+	}
+	return value, nil
+}
+
+// filterRootScopedValues drops the values fetched by a root-scoped request which describe
+// objects in namespaces where the policy denies the metric.
+func (p *policyProvider) filterRootScopedValues(metricName string, values *custom_metrics.MetricValueList) *custom_metrics.MetricValueList {
+	allowed := make([]custom_metrics.MetricValue, 0, len(values.Items))
+	for _, value := range values.Items {
+		if value.DescribedObject.Namespace == "" || p.policy.MayAllow(metricName, value.DescribedObject.Namespace) {
+			allowed = append(allowed, value)
+		}
+	}
+	values.Items = allowed
+	return values
+}
+
+func (p *policyProvider) ListAllMetrics() []provider.CustomMetricInfo {
+	allMetrics := p.CustomMetricsProvider.ListAllMetrics()
+	res := make([]provider.CustomMetricInfo, 0, len(allMetrics))
+	for _, info := range allMetrics {
+		if p.policy.MayAllowAnywhere(info.Metric) {
+			res = append(res, info)
+		}
+	}
+	return res
+}
+
+func (p *policyProvider) GetMetricByName(name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
+	if !p.policy.MayAllow(info.Metric, name.Namespace) {
+		return nil, NewPolicyForbiddenError(info.GroupResource, name.Name, info.Metric)
+	}
+	value, err := p.CustomMetricsProvider.GetMetricByName(name, info, metricSelector)
+	if err != nil || name.Namespace != "" {
+		return value, err
+	}
+	return p.checkRootScopedValue(info.GroupResource, name.Name, info.Metric, value)
+}
+
+func (p *policyProvider) GetMetricBySelector(namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+	if !p.policy.MayAllow(info.Metric, namespace) {
+		return nil, NewPolicyForbiddenError(info.GroupResource, "", info.Metric)
+	}
+	values, err := p.CustomMetricsProvider.GetMetricBySelector(namespace, selector, info, metricSelector)
+	if err != nil || namespace != "" {
+		return values, err
+	}
+	return p.filterRootScopedValues(info.Metric, values), nil
+}
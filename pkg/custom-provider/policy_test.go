@@ -0,0 +1,264 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+
+	cfg "github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/config"
+	pmodel "github.com/prometheus/common/model"
+)
+
+func TestMetricPolicy(t *testing.T) {
+	policy, err := NewMetricPolicy(&cfg.MetricsPolicy{
+		Rules: []cfg.PolicyRule{
+			{
+				Action:          cfg.PolicyAllow,
+				Metrics:         []string{"^billing_.*"},
+				Namespaces:      []string{"billing"},
+				ServiceAccounts: []string{"kube-system:horizontal-pod-autoscaler", "billing:*"},
+			},
+			{
+				Action:  cfg.PolicyDeny,
+				Metrics: []string{"^billing_.*"},
+			},
+			{
+				Action:     cfg.PolicyDeny,
+				Namespaces: []string{"restricted"},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	// full checks (identity known)
+	assert.True(t, policy.Allows("billing_charges", "billing", "kube-system:horizontal-pod-autoscaler"), "an explicitly listed service account should be allowed")
+	assert.True(t, policy.Allows("billing_charges", "billing", "billing:reporter"), "a service account matched by a wildcard should be allowed")
+	assert.False(t, policy.Allows("billing_charges", "billing", "other:reporter"), "an unlisted service account should fall through to the deny rule")
+	assert.False(t, policy.Allows("billing_charges", "billing", ""), "non-service-account users should fall through to the deny rule")
+	assert.False(t, policy.Allows("billing_charges", "other", "billing:reporter"), "billing metrics should be denied outside the billing namespace")
+	assert.False(t, policy.Allows("http_requests", "restricted", "billing:reporter"), "all metrics should be denied in the restricted namespace")
+	assert.True(t, policy.Allows("http_requests", "other", ""), "unmatched requests should use the default action")
+
+	// partial checks (identity unknown)
+	assert.True(t, policy.MayAllow("billing_charges", "billing"), "billing metrics may be allowed in the billing namespace for some service accounts")
+	assert.False(t, policy.MayAllow("billing_charges", "other"), "billing metrics are never allowed outside the billing namespace")
+	assert.False(t, policy.MayAllow("http_requests", "restricted"), "nothing is ever allowed in the restricted namespace")
+	assert.True(t, policy.MayAllow("http_requests", ""), "non-namespaced metrics should use the default action")
+
+	// listing checks (namespace and identity unknown)
+	assert.True(t, policy.MayAllowAnywhere("billing_charges"))
+	assert.True(t, policy.MayAllowAnywhere("http_requests"))
+}
+
+func TestMetricPolicyRootScoped(t *testing.T) {
+	policy, err := NewMetricPolicy(&cfg.MetricsPolicy{
+		Rules: []cfg.PolicyRule{
+			{
+				Action:          cfg.PolicyDeny,
+				Metrics:         []string{"secret_sauce"},
+				Namespaces:      []string{"kitchen"},
+				ServiceAccounts: []string{"other:reader"},
+			},
+			{
+				Action:     cfg.PolicyDeny,
+				Namespaces: []string{"restricted"},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	// the provider would return results from the kitchen namespace for root-scoped
+	// requests, since other requesters may read them there
+	assert.False(t, policy.AllowsWhereverAllowed("secret_sauce", "other:reader"), "a service account denied in some namespace should not be allowed everywhere")
+	assert.True(t, policy.AllowsWhereverAllowed("secret_sauce", "kitchen:chef"), "other service accounts should be allowed everywhere")
+	assert.True(t, policy.AllowsWhereverAllowed("secret_sauce", ""), "non-service-account users should be allowed everywhere")
+	assert.True(t, policy.AllowsWhereverAllowed("http_requests", "other:reader"), "metrics not denied to the service account should be allowed everywhere")
+
+	// namespaces denied to everyone are filtered out by the provider, so they don't count
+	assert.True(t, policy.AllowsWhereverAllowed("http_requests", "kitchen:chef"))
+}
+
+func TestMetricPolicyDefaultDeny(t *testing.T) {
+	policy, err := NewMetricPolicy(&cfg.MetricsPolicy{
+		DefaultAction: cfg.PolicyDeny,
+		Rules: []cfg.PolicyRule{
+			{Action: cfg.PolicyDeny, Metrics: []string{"^secret_.*"}, ServiceAccounts: []string{"other:*"}},
+			{Action: cfg.PolicyAllow, Metrics: []string{"^http_.*", "^secret_.*"}},
+		},
+	})
+	require.NoError(t, err)
+
+	assert.True(t, policy.Allows("http_requests", "somens", ""))
+	assert.False(t, policy.Allows("queue_depth", "somens", ""), "unmatched metrics should be denied by default")
+	assert.False(t, policy.Allows("secret_sauce", "somens", "other:reader"), "the service account deny rule should apply first")
+	assert.True(t, policy.Allows("secret_sauce", "somens", "somens:reader"))
+	assert.True(t, policy.MayAllow("secret_sauce", "somens"), "a deny rule that depends on identity shouldn't deny everyone")
+	assert.False(t, policy.MayAllowAnywhere("queue_depth"))
+}
+
+func TestMetricPolicyMatchesWholeNames(t *testing.T) {
+	policy, err := NewMetricPolicy(&cfg.MetricsPolicy{
+		DefaultAction: cfg.PolicyDeny,
+		Rules: []cfg.PolicyRule{
+			{Action: cfg.PolicyAllow, Metrics: []string{"http_requests", "queue_.*"}},
+		},
+	})
+	require.NoError(t, err)
+
+	assert.True(t, policy.Allows("http_requests", "somens", ""))
+	assert.True(t, policy.Allows("queue_length", "somens", ""))
+	assert.False(t, policy.Allows("http_requests_total_secret", "somens", ""), "names merely containing an allowed name should be denied")
+	assert.False(t, policy.Allows("secret_http_requests", "somens", ""), "names merely containing an allowed name should be denied")
+	assert.False(t, policy.Allows("job_queue_length", "somens", ""), "expressions should be anchored at the start of the name")
+}
+
+func TestMetricPolicyInvalid(t *testing.T) {
+	invalidPolicies := map[string]cfg.MetricsPolicy{
+		"unknown default action":  {DefaultAction: "maybe"},
+		"missing rule action":     {Rules: []cfg.PolicyRule{{Metrics: []string{".*"}}}},
+		"unknown rule action":     {Rules: []cfg.PolicyRule{{Action: "maybe"}}},
+		"invalid metric regex":    {Rules: []cfg.PolicyRule{{Action: cfg.PolicyDeny, Metrics: []string{"(foo"}}}},
+		"invalid service account": {Rules: []cfg.PolicyRule{{Action: cfg.PolicyDeny, ServiceAccounts: []string{"somens"}}}},
+	}
+
+	for desc, policyCfg := range invalidPolicies {
+		policyCfg := policyCfg
+		_, err := NewMetricPolicy(&policyCfg)
+		assert.Error(t, err, "policy with %s should have been rejected", desc)
+	}
+}
+
+func TestPolicyProvider(t *testing.T) {
+	prov, fakeProm := setupPrometheusProvider(t)
+
+	policy, err := NewMetricPolicy(&cfg.MetricsPolicy{
+		Rules: []cfg.PolicyRule{
+			{Action: cfg.PolicyDeny, Metrics: []string{"^ingress_hits$"}},
+			{Action: cfg.PolicyDeny, Metrics: []string{"^service_proxy_packets$"}, Namespaces: []string{"somens"}},
+		},
+	})
+	require.NoError(t, err)
+	policyProv := NewPolicyProvider(prov, policy)
+
+	startTime := pmodel.Now().Add(-1*fakeProviderUpdateInterval - fakeProviderUpdateInterval/10)
+	fakeProm.acceptibleInterval = pmodel.Interval{Start: startTime, End: 0}
+	lister := prov.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
+	require.NoError(t, lister.updateMetrics())
+
+	// metrics denied everywhere should be hidden, while those only denied in some namespaces should remain
+	actualMetrics := policyProv.ListAllMetrics()
+	sort.Sort(metricInfoSorter(actualMetrics))
+	expectedMetrics := []provider.CustomMetricInfo{
+		{schema.GroupResource{Resource: "services"}, true, "service_proxy_packets"},
+		{schema.GroupResource{Resource: "namespaces"}, false, "service_proxy_packets"},
+		{schema.GroupResource{Group: "extensions", Resource: "deployments"}, true, "work_queue_wait"},
+		{schema.GroupResource{Resource: "namespaces"}, false, "work_queue_wait"},
+		{schema.GroupResource{Resource: "namespaces"}, false, "some_usage"},
+		{schema.GroupResource{Resource: "pods"}, true, "some_usage"},
+	}
+	sort.Sort(metricInfoSorter(expectedMetrics))
+	assert.Equal(t, expectedMetrics, actualMetrics)
+
+	servicesInfo := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "services"}, Namespaced: true, Metric: "service_proxy_packets"}
+	_, err = policyProv.GetMetricByName(types.NamespacedName{Namespace: "somens", Name: "somesvc"}, servicesInfo, labels.Everything())
+	assert.True(t, apierr.IsForbidden(err), "metrics denied in a namespace should be forbidden, got %v", err)
+
+	ingressInfo := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "ingress_hits"}
+	_, err = policyProv.GetMetricBySelector("otherns", labels.Everything(), ingressInfo, labels.Everything())
+	assert.True(t, apierr.IsForbidden(err), "metrics denied everywhere should be forbidden, got %v", err)
+
+	// allowed requests should be passed through to the wrapped provider, along with their metric selectors
+	recorder := &selectorRecordingProvider{CustomMetricsProvider: prov}
+	metricSelector := labels.SelectorFromSet(labels.Set{"verb": "GET"})
+	_, err = NewPolicyProvider(recorder, policy).GetMetricBySelector("otherns", labels.Everything(), servicesInfo, metricSelector)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"service_proxy_packets"}, recorder.requested, "metrics allowed in a namespace should be fetched")
+	assert.Equal(t, []labels.Selector{metricSelector}, recorder.metricSelectors, "metric selectors should be passed through")
+}
+
+// selectorRecordingProvider records the metrics fetched by selector, instead of fetching them.
+type selectorRecordingProvider struct {
+	provider.CustomMetricsProvider
+
+	requested       []string
+	metricSelectors []labels.Selector
+}
+
+func (p *selectorRecordingProvider) GetMetricBySelector(namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+	p.requested = append(p.requested, info.Metric)
+	p.metricSelectors = append(p.metricSelectors, metricSelector)
+	return &custom_metrics.MetricValueList{}, nil
+}
+
+func TestPolicyProviderRootScopedNamespacedObjects(t *testing.T) {
+	policy, err := NewMetricPolicy(&cfg.MetricsPolicy{
+		Rules: []cfg.PolicyRule{
+			{Action: cfg.PolicyDeny, Metrics: []string{"queue_length"}, Namespaces: []string{"denied"}},
+		},
+	})
+	require.NoError(t, err)
+	prov := NewPolicyProvider(&rootScopedValuesProvider{
+		values: []custom_metrics.MetricValue{
+			{DescribedObject: custom_metrics.ObjectReference{Kind: "Pod", Namespace: "allowed", Name: "worker-0"}, Metric: custom_metrics.MetricIdentifier{Name: "queue_length"}},
+			{DescribedObject: custom_metrics.ObjectReference{Kind: "Pod", Namespace: "denied", Name: "worker-1"}, Metric: custom_metrics.MetricIdentifier{Name: "queue_length"}},
+		},
+	}, policy)
+	podsGR := schema.GroupResource{Resource: "pods"}
+
+	// root-scoped requests for namespaced resources return objects from every namespace
+	info := provider.CustomMetricInfo{GroupResource: podsGR, Metric: "queue_length"}
+	values, err := prov.GetMetricBySelector("", labels.Everything(), info, labels.Everything())
+	require.NoError(t, err)
+	require.Len(t, values.Items, 1, "values for objects in denied namespaces should be dropped")
+	assert.Equal(t, "allowed", values.Items[0].DescribedObject.Namespace)
+
+	_, err = prov.GetMetricByName(types.NamespacedName{Name: "worker-1"}, info, labels.Everything())
+	assert.True(t, apierr.IsForbidden(err), "values for objects in denied namespaces should be forbidden, got %v", err)
+	value, err := prov.GetMetricByName(types.NamespacedName{Name: "worker-0"}, info, labels.Everything())
+	require.NoError(t, err)
+	assert.Equal(t, "allowed", value.DescribedObject.Namespace)
+}
+
+// rootScopedValuesProvider serves fixed values for root-scoped requests.
+type rootScopedValuesProvider struct {
+	provider.CustomMetricsProvider
+
+	values []custom_metrics.MetricValue
+}
+
+func (p *rootScopedValuesProvider) GetMetricByName(name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
+	for _, value := range p.values {
+		if value.DescribedObject.Name == name.Name {
+			return &value, nil
+		}
+	}
+	return nil, provider.NewMetricNotFoundForError(info.GroupResource, info.Metric, name.Name)
+}
+
+func (p *rootScopedValuesProvider) GetMetricBySelector(namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+	return &custom_metrics.MetricValueList{Items: append([]custom_metrics.MetricValue(nil), p.values...)}, nil
+}
@@ -19,9 +19,10 @@ package provider
 import (
 	"context"
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 
-	"github.com/golang/glog"
 	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
 	pmodel "github.com/prometheus/common/model"
 	apierr "k8s.io/apimachinery/pkg/api/errors"
@@ -32,9 +33,11 @@ import (
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/dynamic"
+	"k8s.io/klog"
 	"k8s.io/metrics/pkg/apis/custom_metrics"
 
 	prom "github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/client"
@@ -53,66 +56,155 @@ type prometheusProvider struct {
 	kubeClient dynamic.Interface
 	promClient prom.Client
 
+	// deprecations reports requests for deprecated metric aliases (it may be nil)
+	deprecations *DeprecationReporter
+
+	// batcher coalesces concurrent requests for individual objects
+	batcher *queryBatcher
+	// inflight deduplicates identical queries made at the same time
+	inflight inflightQueries
+
+	// staleValues serves recent values while Prometheus is unavailable (it may be nil)
+	staleValues *StaleValueCache
+
 	SeriesRegistry
 }
 
-func NewPrometheusProvider(mapper apimeta.RESTMapper, kubeClient dynamic.Interface, promClient prom.Client, namers []MetricNamer, updateInterval time.Duration) (provider.CustomMetricsProvider, Runnable) {
+// ProviderOptions holds the optional behaviour of a provider constructed by
+// NewPrometheusProvider.  The zero value disables all of it.
+type ProviderOptions struct {
+	// BatchWindow is how long concurrent requests for a metric on individual
+	// objects are collected for, so that they can be fetched with a single
+	// query.  A zero window disables batching.
+	BatchWindow time.Duration
+	// Deprecations, if non-nil, is told about requests for deprecated metric aliases.
+	Deprecations *DeprecationReporter
+	// StaleValues, if non-nil, serves the last known values while Prometheus
+	// is unavailable.
+	StaleValues *StaleValueCache
+	// Changes, if non-nil, records the metrics added and removed by each relist.
+	Changes *DiscoveryChangeLog
+}
+
+// NewPrometheusProvider constructs a new provider which fetches metrics from Prometheus.
+func NewPrometheusProvider(mapper apimeta.RESTMapper, kubeClient dynamic.Interface, promClient prom.Client, namers NamerSource, updateInterval time.Duration, opts ProviderOptions) (provider.CustomMetricsProvider, DiscoveryRunner) {
 	lister := &cachingMetricsLister{
 		updateInterval: updateInterval,
 		promClient:     promClient,
 		namers:         namers,
+		relists:        make(chan struct{}, 1),
 
 		SeriesRegistry: &basicSeriesRegistry{
-			mapper: mapper,
+			mapper:  mapper,
+			changes: opts.Changes,
 		},
 	}
 
-	return &prometheusProvider{
+	p := &prometheusProvider{
 		mapper:     mapper,
 		kubeClient: kubeClient,
 		promClient: promClient,
 
+		deprecations: opts.Deprecations,
+		staleValues:  opts.StaleValues,
+
 		SeriesRegistry: lister,
-	}, lister
+	}
+	p.batcher = newQueryBatcher(opts.BatchWindow, p.queryForNames)
+	return p, lister
 }
 
-func (p *prometheusProvider) metricFor(value pmodel.SampleValue, groupResource schema.GroupResource, namespace string, name string, metricName string) (*custom_metrics.MetricValue, error) {
+// kindFor finds the kind, at the preferred served version, of the given resource.
+func (p *prometheusProvider) kindFor(groupResource schema.GroupResource) (schema.GroupVersionKind, error) {
 	kind, err := p.mapper.KindFor(groupResource.WithVersion(""))
 	if err != nil {
-		return nil, err
+		return schema.GroupVersionKind{}, err
 	}
+	return kind, nil
+}
 
-	return &custom_metrics.MetricValue{
+func (p *prometheusProvider) metricFor(value resource.Quantity, kind schema.GroupVersionKind, namespace string, name string, metricName string, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
+	apiVersion, kindName := kind.ToAPIVersionAndKind()
+	metric := &custom_metrics.MetricValue{
 		DescribedObject: custom_metrics.ObjectReference{
-			APIVersion: groupResource.Group + "/" + runtime.APIVersionInternal,
-			Kind:       kind.Kind,
+			APIVersion: apiVersion,
+			Kind:       kindName,
 			Name:       name,
 			Namespace:  namespace,
 		},
-		MetricName: metricName,
-		Timestamp:  metav1.Time{time.Now()},
-		Value:      *resource.NewMilliQuantity(int64(value*1000.0), resource.DecimalSI),
-	}, nil
+		Metric: custom_metrics.MetricIdentifier{
+			Name: metricName,
+		},
+		Timestamp: metav1.Time{time.Now()},
+		Value:     value,
+	}
+
+	// record the metric selector the value was fetched with, so that clients can tell it apart
+	if metricSelector != nil && !metricSelector.Empty() {
+		sel, err := metav1.ParseToLabelSelector(metricSelector.String())
+		if err != nil {
+			return nil, err
+		}
+		metric.Metric.Selector = sel
+	}
+	return metric, nil
 }
 
-func (p *prometheusProvider) metricsFor(valueSet pmodel.Vector, info provider.CustomMetricInfo, list runtime.Object) (*custom_metrics.MetricValueList, error) {
+// quantityFor presents the result for the given object as a quantity, using the
+// given policy.  Results which are too large to be presented are reported.
+func (p *prometheusProvider) quantityFor(policy ResultPolicy, value pmodel.SampleValue, info provider.CustomMetricInfo, name string) (*resource.Quantity, error) {
+	quantity, err := policy.Quantity(value)
+	if err != nil {
+		valueOverflows.WithLabelValues(info.Metric).Inc()
+		klog.Errorf("unable to present result when fetching metric %s for %q: %v", info.String(), name, err)
+		return nil, apierr.NewInternalError(fmt.Errorf("unable to fetch metrics: value for %q is out of range", name))
+	}
+	return quantity, nil
+}
+
+func (p *prometheusProvider) metricsFor(valueSet pmodel.Vector, info provider.CustomMetricInfo, namespace string, metricSelector labels.Selector, list runtime.Object) (*custom_metrics.MetricValueList, error) {
 	if !apimeta.IsListType(list) {
 		return nil, apierr.NewInternalError(fmt.Errorf("result of label selector list operation was not a list"))
 	}
 
-	values, found := p.MatchValuesToNames(info, valueSet)
+	matchedValues, found := p.MatchValuesToNames(info, namespace, valueSet)
 	if !found {
 		return nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
 	}
+	policy := p.ResultPolicyFor(info, namespace)
+	values, err := p.reduceDuplicates(policy, matchedValues, info)
+	if err != nil {
+		return nil, err
+	}
 	res := []custom_metrics.MetricValue{}
 
-	err := apimeta.EachListItem(list, func(item runtime.Object) error {
+	preferredKind, err := p.kindFor(info.GroupResource)
+	if err != nil {
+		return nil, err
+	}
+
+	err = apimeta.EachListItem(list, func(item runtime.Object) error {
 		objUnstructured := item.(*unstructured.Unstructured)
 		objName := objUnstructured.GetName()
-		if _, found := values[objName]; !found {
+		// describe objects as they were listed, where possible
+		kind := objUnstructured.GroupVersionKind()
+		if kind.Version == "" || kind.Kind == "" {
+			kind = preferredKind
+		}
+		resultValue, found := valueForObject(values, objUnstructured.GetNamespace(), objName)
+		resultValue, found, err := policy.Value(resultValue, found)
+		if err != nil {
+			klog.Errorf("unable to use result when fetching metric %s for %q: %v", info.String(), objName, err)
+			return apierr.NewInternalError(fmt.Errorf("unable to fetch metrics: non-finite value for %q", objName))
+		}
+		if !found {
 			return nil
 		}
-		value, err := p.metricFor(values[objName], info.GroupResource, objUnstructured.GetNamespace(), objName, info.Metric)
+		quantity, err := p.quantityFor(policy, resultValue, info, objName)
+		if err != nil {
+			return err
+		}
+		value, err := p.metricFor(*quantity, kind, objUnstructured.GetNamespace(), objName, info.Metric, metricSelector)
 		if err != nil {
 			return err
 		}
@@ -129,63 +221,207 @@ func (p *prometheusProvider) metricsFor(valueSet pmodel.Vector, info provider.Cu
 	}, nil
 }
 
-func (p *prometheusProvider) buildQuery(info provider.CustomMetricInfo, namespace string, names ...string) (pmodel.Vector, error) {
-	query, found := p.QueryForMetric(info, namespace, names...)
+func (p *prometheusProvider) buildQuery(info provider.CustomMetricInfo, namespace string, selector labels.Selector, metricSelector labels.Selector, names ...string) (pmodel.Vector, error) {
+	query, found := p.QueryForMetric(info, namespace, selector, metricSelector, names...)
 	if !found {
 		return nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
 	}
 
+	evaluator := p.RangeEvaluatorFor(info, namespace)
+	return p.inflight.Do(query, evaluator, func() (pmodel.Vector, error) {
+		now := pmodel.Now()
+		if evaluator != nil {
+			return p.buildRangeQuery(evaluator, query, now)
+		}
+		return p.buildInstantQuery(query, now)
+	})
+}
+
+// queryForNames fetches the results of a metric for the named objects.
+func (p *prometheusProvider) queryForNames(info provider.CustomMetricInfo, namespace string, metricSelector labels.Selector, names ...string) (pmodel.Vector, error) {
+	return p.buildQuery(info, namespace, labels.Everything(), metricSelector, names...)
+}
+
+// buildInstantQuery evaluates the given query at the given time.
+func (p *prometheusProvider) buildInstantQuery(query prom.Selector, now pmodel.Time) (pmodel.Vector, error) {
 	// TODO: use an actual context
-	queryResults, err := p.promClient.Query(context.TODO(), pmodel.Now(), query)
+	queryResults, err := p.promClient.Query(context.TODO(), now, query)
 	if err != nil {
-		glog.Errorf("unable to fetch metrics from prometheus: %v", err)
+		klog.Errorf("unable to fetch metrics from prometheus: %v", err)
 		// don't leak implementation details to the user
-		return nil, apierr.NewInternalError(fmt.Errorf("unable to fetch metrics"))
+		return nil, newFetchError()
 	}
 
 	if queryResults.Type != pmodel.ValVector {
-		glog.Errorf("unexpected results from prometheus: expected %s, got %s on results %v", pmodel.ValVector, queryResults.Type, queryResults)
+		klog.Errorf("unexpected results from prometheus: expected %s, got %s on results %v", pmodel.ValVector, queryResults.Type, queryResults)
 		return nil, apierr.NewInternalError(fmt.Errorf("unable to fetch metrics"))
 	}
 
 	return *queryResults.Vector, nil
 }
 
-func (p *prometheusProvider) getSingle(info provider.CustomMetricInfo, namespace, name string) (*custom_metrics.MetricValue, error) {
-	queryResults, err := p.buildQuery(info, namespace, name)
+// buildRangeQuery evaluates the given query over the evaluator's window, and reduces the
+// results for each series to a single sample.
+func (p *prometheusProvider) buildRangeQuery(evaluator *RangeEvaluator, query prom.Selector, now pmodel.Time) (pmodel.Vector, error) {
+	// TODO: use an actual context
+	queryResults, err := p.promClient.QueryRange(context.TODO(), evaluator.Range(now), query)
 	if err != nil {
-		return nil, err
+		klog.Errorf("unable to fetch metrics from prometheus: %v", err)
+		// don't leak implementation details to the user
+		return nil, newFetchError()
 	}
 
-	if len(queryResults) < 1 {
-		return nil, provider.NewMetricNotFoundForError(info.GroupResource, info.Metric, name)
+	if queryResults.Type != pmodel.ValMatrix {
+		klog.Errorf("unexpected results from prometheus: expected %s, got %s on results %v", pmodel.ValMatrix, queryResults.Type, queryResults)
+		return nil, apierr.NewInternalError(fmt.Errorf("unable to fetch metrics"))
 	}
 
-	namedValues, found := p.MatchValuesToNames(info, queryResults)
+	return evaluator.Reduce(*queryResults.Matrix, now), nil
+}
+
+// reportDeprecatedAlias reports the request if the given metric is a deprecated alias.
+// The name is empty for requests using a label selector.
+func (p *prometheusProvider) reportDeprecatedAlias(info provider.CustomMetricInfo, namespace, name string) {
+	if p.deprecations == nil {
+		return
+	}
+	if target, deprecated := p.DeprecatedAliasFor(info, namespace); deprecated {
+		p.deprecations.Report(info, target, namespace, name)
+	}
+}
+
+func (p *prometheusProvider) getSingle(info provider.CustomMetricInfo, namespace, name string, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
+	p.reportDeprecatedAlias(info, namespace, name)
+
+	// the results may be shared with requests for other objects
+	queryResults, err := p.batcher.Query(info, namespace, metricSelector, name)
+	if err != nil {
+		if p.staleValues != nil && isFetchError(err) {
+			if value, found := p.staleValues.Lookup(info, metricSelector, types.NamespacedName{Namespace: namespace, Name: name}); found {
+				klog.V(2).Infof("Prometheus is unavailable, serving the value of metric %s for %q from %v", info.String(), name, value.Timestamp)
+				return value, nil
+			}
+		}
+		return nil, err
+	}
+
+	matchedValues, found := p.MatchValuesToNames(info, namespace, queryResults)
 	if !found {
 		return nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
 	}
+	if len(matchedValues) == 0 && len(queryResults) > 0 {
+		klog.Errorf("None of the results returned when fetching metric %s for %q matched any objects", info.String(), name)
+	}
+
+	// only consider the requested object, so that problems with other objects don't fail the request
+	for object := range matchedValues {
+		if object.Name != name {
+			delete(matchedValues, object)
+		}
+	}
 
-	if len(namedValues) > 1 {
-		glog.V(2).Infof("Got more than one result (%v results) when fetching metric %s for %q, using the first one with a matching name...", len(queryResults), info.String(), name)
+	policy := p.ResultPolicyFor(info, namespace)
+	namedValues, err := p.reduceDuplicates(policy, matchedValues, info)
+	if err != nil {
+		return nil, err
 	}
 
-	resultValue, nameFound := namedValues[name]
+	objectNamespace, resultValue, nameFound := singleValueForName(namedValues, namespace, name)
+
+	resultValue, nameFound, err = policy.Value(resultValue, nameFound)
+	if err != nil {
+		klog.Errorf("unable to use result when fetching metric %s for %q: %v", info.String(), name, err)
+		return nil, apierr.NewInternalError(fmt.Errorf("unable to fetch metrics: non-finite value for %q", name))
+	}
 	if !nameFound {
-		glog.Errorf("None of the results returned by when fetching metric %s for %q matched the resource name", info.String(), name)
 		return nil, provider.NewMetricNotFoundForError(info.GroupResource, info.Metric, name)
 	}
 
-	return p.metricFor(resultValue, info.GroupResource, "", name, info.Metric)
+	quantity, err := p.quantityFor(policy, resultValue, info, name)
+	if err != nil {
+		return nil, err
+	}
+	kind, err := p.kindFor(info.GroupResource)
+	if err != nil {
+		return nil, err
+	}
+	value, err := p.metricFor(*quantity, kind, objectNamespace, name, info.Metric, metricSelector)
+	if err != nil {
+		return nil, err
+	}
+	if p.staleValues != nil {
+		// store the value under the requested object, since that's what it'll be looked up by
+		p.staleValues.Store(info, metricSelector, types.NamespacedName{Namespace: namespace, Name: name}, *value)
+	}
+	return value, nil
+}
+
+// reduceDuplicates reduces the matched values for each object to a single value, using
+// the given policy.  Objects with several values are counted, since they usually mean
+// that the metrics query doesn't aggregate its results properly.
+func (p *prometheusProvider) reduceDuplicates(policy ResultPolicy, matchedValues map[types.NamespacedName][]pmodel.SampleValue, info provider.CustomMetricInfo) (map[types.NamespacedName]pmodel.SampleValue, error) {
+	res := make(map[types.NamespacedName]pmodel.SampleValue, len(matchedValues))
+	for object, values := range matchedValues {
+		if len(values) > 1 {
+			duplicateResults.WithLabelValues(info.Metric).Add(float64(len(values) - 1))
+			klog.V(2).Infof("Got %v results for %s when fetching metric %s, reducing them to one", len(values), object.String(), info.String())
+		}
+		value, err := policy.Reduce(values)
+		if err != nil {
+			klog.Errorf("unable to use results when fetching metric %s for %s: %v", info.String(), object.String(), err)
+			return nil, apierr.NewInternalError(fmt.Errorf("unable to fetch metrics: several results for %q", object.Name))
+		}
+		res[object] = value
+	}
+	return res, nil
 }
 
-func (p *prometheusProvider) getMultiple(info provider.CustomMetricInfo, namespace string, selector labels.Selector) (*custom_metrics.MetricValueList, error) {
+// valueForObject finds the value for the given object.  Values from results which
+// didn't say which namespace their object is in match objects in any namespace.
+func valueForObject(values map[types.NamespacedName]pmodel.SampleValue, namespace, name string) (pmodel.SampleValue, bool) {
+	if value, found := values[types.NamespacedName{Namespace: namespace, Name: name}]; found {
+		return value, true
+	}
+	value, found := values[types.NamespacedName{Name: name}]
+	return value, found
+}
+
+// singleValueForName finds the value for the object with the given name, returning the
+// namespace of the object as well.  If the namespace is empty (as for requests across all
+// namespaces), and objects with the given name exist in several namespaces, the value for
+// the first namespace (in alphabetical order) is used.
+func singleValueForName(values map[types.NamespacedName]pmodel.SampleValue, namespace, name string) (string, pmodel.SampleValue, bool) {
+	if namespace != "" {
+		value, found := valueForObject(values, namespace, name)
+		return namespace, value, found
+	}
+
+	var namespaces []string
+	for object := range values {
+		if object.Name == name {
+			namespaces = append(namespaces, object.Namespace)
+		}
+	}
+	if len(namespaces) == 0 {
+		return "", 0, false
+	}
+	sort.Strings(namespaces)
+	if len(namespaces) > 1 {
+		klog.Warningf("objects called %q exist in several namespaces (%v), using the one in namespace %q", name, namespaces, namespaces[0])
+	}
+	object := types.NamespacedName{Namespace: namespaces[0], Name: name}
+	return object.Namespace, values[object], true
+}
+
+func (p *prometheusProvider) getMultiple(info provider.CustomMetricInfo, namespace string, selector labels.Selector, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+	p.reportDeprecatedAlias(info, namespace, "")
+
 	fullResources, err := p.mapper.ResourcesFor(info.GroupResource.WithVersion(""))
 	if err == nil && len(fullResources) == 0 {
 		err = fmt.Errorf("no fully versioned resources known for group-resource %v", info.GroupResource)
 	}
 	if err != nil {
-		glog.Errorf("unable to find preferred version to list matching resource names: %v", err)
+		klog.Errorf("unable to find preferred version to list matching resource names: %v", err)
 		// don't leak implementation details to the user
 		return nil, apierr.NewInternalError(fmt.Errorf("unable to list matching resources"))
 	}
@@ -199,7 +435,7 @@ func (p *prometheusProvider) getMultiple(info provider.CustomMetricInfo, namespa
 	// actually list the objects matching the label selector
 	matchingObjectsRaw, err := client.List(metav1.ListOptions{LabelSelector: selector.String()})
 	if err != nil {
-		glog.Errorf("unable to list matching resource names: %v", err)
+		klog.Errorf("unable to list matching resource names: %v", err)
 		// don't leak implementation details to the user
 		return nil, apierr.NewInternalError(fmt.Errorf("unable to list matching resources"))
 	}
@@ -218,49 +454,54 @@ func (p *prometheusProvider) getMultiple(info provider.CustomMetricInfo, namespa
 	})
 
 	// construct the actual query
-	queryResults, err := p.buildQuery(info, namespace, resourceNames...)
+	queryResults, err := p.buildQuery(info, namespace, selector, metricSelector, resourceNames...)
 	if err != nil {
+		if p.staleValues != nil && isFetchError(err) {
+			if values, found := p.staleMetricsFor(info, metricSelector, matchingObjectsRaw); found {
+				klog.V(2).Infof("Prometheus is unavailable, serving previous values of metric %s", info.String())
+				return values, nil
+			}
+		}
 		return nil, err
 	}
-	return p.metricsFor(queryResults, info, matchingObjectsRaw)
-}
-
-func (p *prometheusProvider) GetRootScopedMetricByName(groupResource schema.GroupResource, name string, metricName string) (*custom_metrics.MetricValue, error) {
-	info := provider.CustomMetricInfo{
-		GroupResource: groupResource,
-		Metric:        metricName,
-		Namespaced:    false,
+	values, err := p.metricsFor(queryResults, info, namespace, metricSelector, matchingObjectsRaw)
+	if err != nil {
+		return nil, err
 	}
-
-	return p.getSingle(info, "", name)
-}
-
-func (p *prometheusProvider) GetRootScopedMetricBySelector(groupResource schema.GroupResource, selector labels.Selector, metricName string) (*custom_metrics.MetricValueList, error) {
-	info := provider.CustomMetricInfo{
-		GroupResource: groupResource,
-		Metric:        metricName,
-		Namespaced:    false,
+	if p.staleValues != nil {
+		// the values describe the listed objects, which is what they'll be looked up by
+		for _, value := range values.Items {
+			object := types.NamespacedName{Namespace: value.DescribedObject.Namespace, Name: value.DescribedObject.Name}
+			p.staleValues.Store(info, metricSelector, object, value)
+		}
 	}
-	return p.getMultiple(info, "", selector)
+	return values, nil
 }
 
-func (p *prometheusProvider) GetNamespacedMetricByName(groupResource schema.GroupResource, namespace string, name string, metricName string) (*custom_metrics.MetricValue, error) {
-	info := provider.CustomMetricInfo{
-		GroupResource: groupResource,
-		Metric:        metricName,
-		Namespaced:    true,
+// staleMetricsFor fetches the last known values of the given metric for the objects
+// in the given list, if there are any.
+func (p *prometheusProvider) staleMetricsFor(info provider.CustomMetricInfo, metricSelector labels.Selector, list runtime.Object) (*custom_metrics.MetricValueList, bool) {
+	res := []custom_metrics.MetricValue{}
+	apimeta.EachListItem(list, func(item runtime.Object) error {
+		objUnstructured := item.(*unstructured.Unstructured)
+		object := types.NamespacedName{Namespace: objUnstructured.GetNamespace(), Name: objUnstructured.GetName()}
+		if value, found := p.staleValues.Lookup(info, metricSelector, object); found {
+			res = append(res, *value)
+		}
+		return nil
+	})
+	if len(res) == 0 {
+		return nil, false
 	}
+	return &custom_metrics.MetricValueList{Items: res}, true
+}
 
-	return p.getSingle(info, namespace, name)
+func (p *prometheusProvider) GetMetricByName(name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
+	return p.getSingle(info, name.Namespace, name.Name, metricSelector)
 }
 
-func (p *prometheusProvider) GetNamespacedMetricBySelector(groupResource schema.GroupResource, namespace string, selector labels.Selector, metricName string) (*custom_metrics.MetricValueList, error) {
-	info := provider.CustomMetricInfo{
-		GroupResource: groupResource,
-		Metric:        metricName,
-		Namespaced:    true,
-	}
-	return p.getMultiple(info, namespace, selector)
+func (p *prometheusProvider) GetMetricBySelector(namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+	return p.getMultiple(info, namespace, selector, metricSelector)
 }
 
 type cachingMetricsLister struct {
@@ -268,19 +509,57 @@ type cachingMetricsLister struct {
 
 	promClient     prom.Client
 	updateInterval time.Duration
-	namers         []MetricNamer
+	namers         NamerSource
+
+	// relists receives requests for an immediate update
+	relists chan struct{}
+
+	// mu guards lastDiscovery
+	mu sync.RWMutex
+	// lastDiscovery is the time of the last successful update
+	lastDiscovery time.Time
 }
 
 func (l *cachingMetricsLister) Run() {
 	l.RunUntil(wait.NeverStop)
 }
 
+func (l *cachingMetricsLister) LastDiscovery() time.Time {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.lastDiscovery
+}
+
+// Relist requests an immediate update, which will happen as soon as any update in
+// progress has finished.  Requests made while one is already pending are merged.
+func (l *cachingMetricsLister) Relist() {
+	select {
+	case l.relists <- struct{}{}:
+	default:
+	}
+}
+
 func (l *cachingMetricsLister) RunUntil(stopChan <-chan struct{}) {
-	go wait.Until(func() {
-		if err := l.updateMetrics(); err != nil {
-			utilruntime.HandleError(err)
+	go func() {
+		defer utilruntime.HandleCrash()
+
+		for {
+			if err := l.updateMetrics(); err != nil {
+				utilruntime.HandleError(err)
+			}
+
+			// wait for the next interval, unless a relist is requested before then
+			timer := time.NewTimer(l.updateInterval)
+			select {
+			case <-stopChan:
+				timer.Stop()
+				return
+			case <-l.relists:
+				timer.Stop()
+			case <-timer.C:
+			}
 		}
-	}, l.updateInterval, stopChan)
+	}()
 }
 
 type selectorSeries struct {
@@ -291,15 +570,18 @@ type selectorSeries struct {
 func (l *cachingMetricsLister) updateMetrics() error {
 	startTime := pmodel.Now().Add(-1 * l.updateInterval)
 
+	// fetch the namers once, since the set may change underneath us
+	namers := l.namers.Namers()
+
 	// don't do duplicate queries when it's just the matchers that change
 	seriesCacheByQuery := make(map[prom.Selector][]prom.Series)
 
 	// these can take a while on large clusters, so launch in parallel
 	// and don't duplicate
 	selectors := make(map[prom.Selector]struct{})
-	selectorSeriesChan := make(chan selectorSeries, len(l.namers))
-	errs := make(chan error, len(l.namers))
-	for _, namer := range l.namers {
+	selectorSeriesChan := make(chan selectorSeries, len(namers))
+	errs := make(chan error, len(namers))
+	for _, namer := range namers {
 		sel := namer.Selector()
 		if _, ok := selectors[sel]; ok {
 			errs <- nil
@@ -322,7 +604,7 @@ func (l *cachingMetricsLister) updateMetrics() error {
 	}
 
 	// iterate through, blocking until we've got all results
-	for range l.namers {
+	for range namers {
 		if err := <-errs; err != nil {
 			return fmt.Errorf("unable to update list of all metrics: %v", err)
 		}
@@ -332,8 +614,8 @@ func (l *cachingMetricsLister) updateMetrics() error {
 	}
 	close(errs)
 
-	newSeries := make([][]prom.Series, len(l.namers))
-	for i, namer := range l.namers {
+	newSeries := make([][]prom.Series, len(namers))
+	for i, namer := range namers {
 		series, cached := seriesCacheByQuery[namer.Selector()]
 		if !cached {
 			return fmt.Errorf("unable to update list of all metrics: no metrics retrieved for query %q", namer.Selector())
@@ -341,7 +623,19 @@ func (l *cachingMetricsLister) updateMetrics() error {
 		newSeries[i] = namer.FilterSeries(series)
 	}
 
-	glog.V(10).Infof("Set available metric list from Prometheus to: %v", newSeries)
+	klog.V(10).Infof("Set available metric list from Prometheus to: %v", newSeries)
+
+	if err := l.SetSeries(newSeries, namers); err != nil {
+		return err
+	}
+
+	if reporter, ok := l.namers.(MetricCountReporter); ok {
+		reporter.ReportMetricCounts(l.MetricCountsByNamer())
+	}
+
+	l.mu.Lock()
+	l.lastDiscovery = time.Now()
+	l.mu.Unlock()
 
-	return l.SetSeries(newSeries, l.namers)
+	return nil
 }
@@ -19,18 +19,39 @@ package provider
 import (
 	"context"
 	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"sort"
+	"sync"
 	"testing"
 	"time"
 
+	cmapiserver "github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/apiserver"
 	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	metricstorage "github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/registry/custom_metrics"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	metainternalversion "k8s.io/apimachinery/pkg/apis/meta/internalversion"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	genericapiserver "k8s.io/apiserver/pkg/server"
 	fakedyn "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/rest"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	cmv1beta1 "k8s.io/metrics/pkg/apis/custom_metrics/v1beta1"
+	cmv1beta2 "k8s.io/metrics/pkg/apis/custom_metrics/v1beta2"
 
 	config "github.com/kairosinc/custom-metrics-prometheus-adapter/cmd/config-gen/utils"
 	prom "github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/client"
+	cfg "github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/config"
 	pmodel "github.com/prometheus/common/model"
 )
 
@@ -46,12 +67,30 @@ type fakePromClient struct {
 	series map[prom.Selector][]prom.Series
 	// queryResults are non-error responses to Query
 	queryResults map[prom.Selector]prom.QueryResult
+	// rangeQueryResults are non-error responses to QueryRange
+	rangeQueryResults map[prom.Selector]prom.QueryResult
+	// lastRange is the range of the last call to QueryRange
+	lastRange prom.Range
+
+	// mu guards the queries made and the targets, since the provider may query concurrently
+	// (tests changing errQueries while a query may be in flight must hold it too)
+	mu sync.Mutex
+	// queries are the queries passed to Query, in order
+	queries []prom.Selector
+	// targets is the response to Targets, unless targetsErr is set
+	targets    prom.TargetsResult
+	targetsErr error
+	// targetsCalls counts the calls to Targets
+	targetsCalls int
 }
 
 func (c *fakePromClient) Series(_ context.Context, interval pmodel.Interval, selectors ...prom.Selector) ([]prom.Series, error) {
 	if (interval.Start != 0 && interval.Start < c.acceptibleInterval.Start) || (interval.End != 0 && interval.End > c.acceptibleInterval.End) {
 		return nil, fmt.Errorf("interval [%v, %v] for query is outside range [%v, %v]", interval.Start, interval.End, c.acceptibleInterval.Start, c.acceptibleInterval.End)
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	res := []prom.Series{}
 	for _, sel := range selectors {
 		if err, found := c.errQueries[sel]; found {
@@ -70,6 +109,10 @@ func (c *fakePromClient) Query(_ context.Context, t pmodel.Time, query prom.Sele
 		return prom.QueryResult{}, fmt.Errorf("time %v for query is outside range [%v, %v]", t, c.acceptibleInterval.Start, c.acceptibleInterval.End)
 	}
 
+	c.mu.Lock()
+	c.queries = append(c.queries, query)
+	c.mu.Unlock()
+
 	if err, found := c.errQueries[query]; found {
 		return prom.QueryResult{}, err
 	}
@@ -84,7 +127,40 @@ func (c *fakePromClient) Query(_ context.Context, t pmodel.Time, query prom.Sele
 	}, nil
 }
 func (c *fakePromClient) QueryRange(_ context.Context, r prom.Range, query prom.Selector) (prom.QueryResult, error) {
-	return prom.QueryResult{}, nil
+	c.mu.Lock()
+	c.lastRange = r
+	c.mu.Unlock()
+
+	if err, found := c.errQueries[query]; found {
+		return prom.QueryResult{}, err
+	}
+
+	if res, found := c.rangeQueryResults[query]; found {
+		return res, nil
+	}
+
+	return prom.QueryResult{
+		Type:   pmodel.ValMatrix,
+		Matrix: &pmodel.Matrix{},
+	}, nil
+}
+
+func (c *fakePromClient) Targets(_ context.Context) (prom.TargetsResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.targetsCalls++
+	return c.targets, c.targetsErr
+}
+
+// waitFor polls the given condition for up to a second.
+func waitFor(condition func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
 }
 
 func setupPrometheusProvider(t *testing.T) (provider.CustomMetricsProvider, *fakePromClient) {
@@ -92,10 +168,10 @@ func setupPrometheusProvider(t *testing.T) (provider.CustomMetricsProvider, *fak
 	fakeKubeClient := &fakedyn.FakeDynamicClient{}
 
 	cfg := config.DefaultConfig(1*time.Minute, "")
-	namers, err := NamersFromConfig(cfg, restMapper())
+	namers, err := NamersFromConfig(cfg, restMapper(), nil)
 	require.NoError(t, err)
 
-	prov, _ := NewPrometheusProvider(restMapper(), fakeKubeClient, fakeProm, namers, fakeProviderUpdateInterval)
+	prov, _ := NewPrometheusProvider(restMapper(), fakeKubeClient, fakeProm, StaticNamers(namers), fakeProviderUpdateInterval, ProviderOptions{})
 
 	containerSel := prom.MatchSeries("", prom.NameMatches("^container_.*"), prom.LabelNeq("container_name", "POD"), prom.LabelNeq("namespace", ""), prom.LabelNeq("pod_name", ""))
 	namespacedSel := prom.MatchSeries("", prom.LabelNeq("namespace", ""), prom.NameNotMatches("^container_.*"))
@@ -129,6 +205,38 @@ func setupPrometheusProvider(t *testing.T) (provider.CustomMetricsProvider, *fak
 	return prov, fakeProm
 }
 
+// sumRule constructs a discovery rule for the given series which sums its
+// values for each object.
+func sumRule(series string) cfg.DiscoveryRule {
+	return cfg.DiscoveryRule{
+		SeriesQuery:  series,
+		Resources:    cfg.ResourceMapping{Template: "<<.Resource>>"},
+		MetricsQuery: "sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)",
+	}
+}
+
+// fakePod constructs a pod for the fake cluster used by setupRuleProvider.
+func fakePod(namespace, name string) runtime.Object {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata":   map[string]interface{}{"name": name, "namespace": namespace},
+	}}
+}
+
+// setupRuleProvider constructs a provider which discovers metrics using the given
+// rule, backed by a fake Prometheus and a fake cluster containing the given objects.
+func setupRuleProvider(t *testing.T, rule cfg.DiscoveryRule, opts ProviderOptions, objects ...runtime.Object) (provider.CustomMetricsProvider, *fakePromClient) {
+	fakeProm := &fakePromClient{acceptibleInterval: pmodel.Interval{Start: 0, End: pmodel.Latest}}
+	fakeKubeClient := fakedyn.NewSimpleDynamicClient(runtime.NewScheme(), objects...)
+
+	namer, err := NamerFromRule(rule, restMapper(), nil)
+	require.NoError(t, err)
+
+	prov, _ := NewPrometheusProvider(restMapper(), fakeKubeClient, fakeProm, StaticNamers{namer}, fakeProviderUpdateInterval, opts)
+	return prov, fakeProm
+}
+
 func TestListAllMetrics(t *testing.T) {
 	// setup
 	prov, fakeProm := setupPrometheusProvider(t)
@@ -165,3 +273,409 @@ func TestListAllMetrics(t *testing.T) {
 	// assert that we got what we expected
 	assert.Equal(t, expectedMetrics, actualMetrics)
 }
+
+func TestGetMetricByNameWithMetricSelector(t *testing.T) {
+	prov, fakeProm := setupPrometheusProvider(t)
+	fakeProm.acceptibleInterval = pmodel.Interval{Start: 0, End: pmodel.Latest}
+
+	lister := prov.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
+	require.NoError(t, lister.updateMetrics())
+
+	expectedQuery := prom.Selector(`sum(rate(ingress_hits_total{namespace="somens",service="somesvc",verb=~"GET|HEAD"}[1m])) by (service)`)
+	fakeProm.queryResults = map[prom.Selector]prom.QueryResult{
+		expectedQuery: {
+			Type: pmodel.ValVector,
+			Vector: &pmodel.Vector{
+				{
+					Metric: pmodel.Metric{"service": "somesvc"},
+					Value:  pmodel.SampleValue(4),
+				},
+			},
+		},
+	}
+
+	metricSelector, err := labels.Parse("verb in (GET,HEAD)")
+	require.NoError(t, err)
+	info := provider.CustomMetricInfo{schema.GroupResource{Resource: "services"}, true, "ingress_hits"}
+	value, err := prov.GetMetricByName(types.NamespacedName{Namespace: "somens", Name: "somesvc"}, info, metricSelector)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4000), value.Value.MilliValue())
+
+	// unsupported operators should be rejected, rather than ignored
+	metricSelector, err = labels.Parse("code>400")
+	require.NoError(t, err)
+	_, err = prov.GetMetricByName(types.NamespacedName{Namespace: "somens", Name: "somesvc"}, info, metricSelector)
+	assert.Error(t, err)
+}
+
+func TestMetricSelectorThroughAPIServer(t *testing.T) {
+	prov, fakeProm := setupPrometheusProvider(t)
+	fakeProm.acceptibleInterval = pmodel.Interval{Start: 0, End: pmodel.Latest}
+
+	lister := prov.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
+	require.NoError(t, lister.updateMetrics())
+
+	fakeProm.queryResults = map[prom.Selector]prom.QueryResult{
+		`sum(rate(ingress_hits_total{namespace="somens",service="somesvc",verb=~"GET|HEAD"}[1m])) by (service)`: {
+			Type:   pmodel.ValVector,
+			Vector: &pmodel.Vector{{Metric: pmodel.Metric{"service": "somesvc"}, Value: pmodel.SampleValue(4)}},
+		},
+	}
+
+	// serve the API the same way the adapter does (minus authentication and authorization)
+	serverConfig := genericapiserver.NewConfig(cmapiserver.Codecs)
+	serverConfig.LoopbackClientConfig = &rest.Config{}
+	serverConfig.ExternalAddress = "127.0.0.1:6443"
+	config := &cmapiserver.Config{GenericConfig: serverConfig}
+	server, err := config.Complete(nil).New("test-adapter", prov, nil)
+	require.NoError(t, err)
+
+	// the metric selector is passed as a query parameter, in either version
+	for _, version := range []string{"v1beta1", "v1beta2"} {
+		path := "/apis/custom.metrics.k8s.io/" + version + "/namespaces/somens/services/somesvc/ingress_hits"
+		req := httptest.NewRequest("GET", path+"?metricLabelSelector="+url.QueryEscape("verb in (GET,HEAD)"), nil)
+		resp := httptest.NewRecorder()
+		server.GenericAPIServer.Handler.ServeHTTP(resp, req)
+		require.Equal(t, http.StatusOK, resp.Code, "unexpected response for %s: %s", version, resp.Body.String())
+		assert.Contains(t, resp.Body.String(), `"value":"4"`, "the value for the metric selector should be served by %s", version)
+	}
+}
+
+func TestResultPolicy(t *testing.T) {
+	zero := 0.0
+	dropPolicy, err := NewResultPolicy(nil, nil)
+	require.NoError(t, err)
+	defaultPolicy, err := NewResultPolicy(&cfg.ResultPolicy{MissingValue: &zero}, nil)
+	require.NoError(t, err)
+	clampPolicy, err := NewResultPolicy(&cfg.ResultPolicy{NonFinite: cfg.NonFiniteClamp}, nil)
+	require.NoError(t, err)
+	errorPolicy, err := NewResultPolicy(&cfg.ResultPolicy{NonFinite: cfg.NonFiniteError}, nil)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		title    string
+		policy   ResultPolicy
+		value    pmodel.SampleValue
+		found    bool
+		expected pmodel.SampleValue
+		hasValue bool
+		isErr    bool
+	}{
+		{title: "finite values are left alone", policy: dropPolicy, value: 3, found: true, expected: 3, hasValue: true},
+		{title: "non-finite values are dropped", policy: dropPolicy, value: pmodel.SampleValue(math.NaN()), found: true},
+		{title: "missing values stay missing", policy: dropPolicy},
+		{title: "missing values use the default", policy: defaultPolicy, expected: 0, hasValue: true},
+		{title: "dropped values use the default", policy: defaultPolicy, value: pmodel.SampleValue(math.Inf(1)), found: true, expected: 0, hasValue: true},
+		{title: "positive infinity is clamped", policy: clampPolicy, value: pmodel.SampleValue(math.Inf(1)), found: true, expected: pmodel.SampleValue(defaultValueConverter.MaxValue()), hasValue: true},
+		{title: "negative infinity is clamped", policy: clampPolicy, value: pmodel.SampleValue(math.Inf(-1)), found: true, expected: pmodel.SampleValue(-defaultValueConverter.MaxValue()), hasValue: true},
+		{title: "NaN is clamped to zero", policy: clampPolicy, value: pmodel.SampleValue(math.NaN()), found: true, expected: 0, hasValue: true},
+		{title: "non-finite values cause errors", policy: errorPolicy, value: pmodel.SampleValue(math.NaN()), found: true, isErr: true},
+	}
+
+	for _, testCase := range testCases {
+		value, hasValue, err := testCase.policy.Value(testCase.value, testCase.found)
+		if testCase.isErr {
+			assert.Error(t, err, testCase.title)
+			continue
+		}
+		require.NoError(t, err, testCase.title)
+		assert.Equal(t, testCase.hasValue, hasValue, testCase.title)
+		if hasValue {
+			assert.Equal(t, testCase.expected, value, testCase.title)
+		}
+	}
+
+	_, err = NewResultPolicy(&cfg.ResultPolicy{NonFinite: "ignore"}, nil)
+	assert.Error(t, err, "unknown non-finite actions should be rejected")
+}
+
+func TestProviderResultPolicy(t *testing.T) {
+	zero := 0.0
+	rule := sumRule("http_requests_total")
+	rule.Results = &cfg.ResultPolicy{MissingValue: &zero}
+	prov, fakeProm := setupRuleProvider(t, rule, ProviderOptions{}, fakePod("somens", "busy"), fakePod("somens", "idle"))
+
+	fakeProm.series = map[prom.Selector][]prom.Series{
+		"http_requests_total": {
+			{Name: "http_requests_total", Labels: pmodel.LabelSet{"pod": "busy", "namespace": "somens"}},
+		},
+	}
+	fakeProm.queryResults = map[prom.Selector]prom.QueryResult{
+		`sum(http_requests_total{namespace="somens",pod=~"busy|idle"}) by (pod)`: {
+			Type: pmodel.ValVector,
+			Vector: &pmodel.Vector{
+				{Metric: pmodel.Metric{"pod": "busy"}, Value: pmodel.SampleValue(5)},
+			},
+		},
+	}
+	lister := prov.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
+	require.NoError(t, lister.updateMetrics())
+
+	// objects without results should read as the missing value
+	podsGR := schema.GroupResource{Resource: "pods"}
+	values, err := prov.GetMetricBySelector("somens", labels.Everything(), provider.CustomMetricInfo{GroupResource: podsGR, Namespaced: true, Metric: "http_requests_total"}, labels.Everything())
+	require.NoError(t, err)
+	valuesByName := map[string]int64{}
+	for _, value := range values.Items {
+		valuesByName[value.DescribedObject.Name] = value.Value.MilliValue()
+		assert.Equal(t, "v1", value.DescribedObject.APIVersion, "listed objects should be described with their own version")
+		assert.Equal(t, "Pod", value.DescribedObject.Kind)
+	}
+	assert.Equal(t, map[string]int64{"busy": 5000, "idle": 0}, valuesByName)
+
+	value, err := prov.GetMetricByName(types.NamespacedName{Namespace: "somens", Name: "idle"}, provider.CustomMetricInfo{GroupResource: podsGR, Namespaced: true, Metric: "http_requests_total"}, labels.Everything())
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), value.Value.MilliValue())
+}
+
+func TestValueConverter(t *testing.T) {
+	milliToSeconds := 0.001
+	testCases := []struct {
+		title    string
+		unit     cfg.ValueUnit
+		scale    *float64
+		value    pmodel.SampleValue
+		expected string
+	}{
+		{title: "plain values have milli precision", value: 1.5, expected: "1500m"},
+		{title: "bytes use binary suffixes", unit: cfg.UnitBytes, value: 2048, expected: "2Ki"},
+		{title: "bytes can exceed the range of milli-units", unit: cfg.UnitBytes, value: 1 << 60, expected: "1Ei"},
+		{title: "seconds keep sub-milli precision", unit: cfg.UnitSeconds, value: 0.0000015, expected: "1500n"},
+		{title: "percentages are scaled ratios", unit: cfg.UnitPercent, value: 0.25, expected: "25"},
+		{title: "scales are applied to results", unit: cfg.UnitSeconds, scale: &milliToSeconds, value: 250, expected: "250m"},
+	}
+
+	for _, testCase := range testCases {
+		converter, err := NewValueConverter(testCase.unit, testCase.scale)
+		require.NoError(t, err, testCase.title)
+		quantity, err := converter.Quantity(testCase.value)
+		require.NoError(t, err, testCase.title)
+		assert.Equal(t, testCase.expected, quantity.String(), testCase.title)
+	}
+
+	// values too large to present should be errors, rather than wrapping around
+	_, err := defaultValueConverter.Quantity(pmodel.SampleValue(1e17))
+	assert.Error(t, err, "values which overflow should be rejected")
+	_, err = defaultValueConverter.Quantity(pmodel.SampleValue(-1e17))
+	assert.Error(t, err, "values which overflow should be rejected")
+	_, err = defaultValueConverter.Quantity(pmodel.SampleValue(defaultValueConverter.MaxValue()))
+	assert.NoError(t, err, "the largest value should be presentable")
+
+	zero := 0.0
+	_, err = NewValueConverter(cfg.UnitBytes, &zero)
+	assert.Error(t, err, "zero scales should be rejected")
+	_, err = NewValueConverter("furlongs", nil)
+	assert.Error(t, err, "unknown units should be rejected")
+}
+
+func TestProviderNamespaceAwareMatching(t *testing.T) {
+	prov, fakeProm := setupRuleProvider(t, sumRule("http_requests_total"), ProviderOptions{}, fakePod("somens", "web-0"), fakePod("otherns", "web-0"))
+
+	fakeProm.series = map[prom.Selector][]prom.Series{
+		"http_requests_total": {
+			{Name: "http_requests_total", Labels: pmodel.LabelSet{"pod": "web-0", "namespace": "somens"}},
+			{Name: "http_requests_total", Labels: pmodel.LabelSet{"pod": "web-0", "namespace": "otherns"}},
+		},
+	}
+	bothNamespaces := prom.QueryResult{
+		Type: pmodel.ValVector,
+		Vector: &pmodel.Vector{
+			{Metric: pmodel.Metric{"pod": "web-0", "namespace": "somens"}, Value: pmodel.SampleValue(1)},
+			{Metric: pmodel.Metric{"pod": "web-0", "namespace": "otherns"}, Value: pmodel.SampleValue(2)},
+		},
+	}
+	fakeProm.queryResults = map[prom.Selector]prom.QueryResult{
+		// requests across all namespaces should keep the namespace in the results
+		`sum(http_requests_total{pod="web-0"}) by (pod,namespace)`:        bothNamespaces,
+		`sum(http_requests_total{pod=~"web-0|web-0"}) by (pod,namespace)`: bothNamespaces,
+		`sum(http_requests_total{namespace="otherns",pod="web-0"}) by (pod)`: {
+			Type:   pmodel.ValVector,
+			Vector: &pmodel.Vector{{Metric: pmodel.Metric{"pod": "web-0"}, Value: pmodel.SampleValue(2)}},
+		},
+	}
+	lister := prov.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
+	require.NoError(t, lister.updateMetrics())
+
+	podsGR := schema.GroupResource{Resource: "pods"}
+	value, err := prov.GetMetricByName(types.NamespacedName{Namespace: "otherns", Name: "web-0"}, provider.CustomMetricInfo{GroupResource: podsGR, Namespaced: true, Metric: "http_requests_total"}, labels.Everything())
+	require.NoError(t, err)
+	assert.Equal(t, "otherns", value.DescribedObject.Namespace, "single objects should be described with their namespace")
+	assert.Equal(t, int64(2000), value.Value.MilliValue())
+
+	values, err := prov.GetMetricBySelector("", labels.Everything(), provider.CustomMetricInfo{GroupResource: podsGR, Metric: "http_requests_total"}, labels.Everything())
+	require.NoError(t, err)
+	valuesByNamespace := map[string]int64{}
+	for _, value := range values.Items {
+		valuesByNamespace[value.DescribedObject.Namespace] = value.Value.MilliValue()
+	}
+	assert.Equal(t, map[string]int64{"somens": 1000, "otherns": 2000}, valuesByNamespace, "objects with the same name in different namespaces should get their own values")
+
+	value, err = prov.GetMetricByName(types.NamespacedName{Name: "web-0"}, provider.CustomMetricInfo{GroupResource: podsGR, Metric: "http_requests_total"}, labels.Everything())
+	require.NoError(t, err)
+	assert.Equal(t, "otherns", value.DescribedObject.Namespace, "ambiguous names should consistently use the first namespace")
+	assert.Equal(t, int64(2000), value.Value.MilliValue())
+}
+
+func TestResultPolicyDuplicates(t *testing.T) {
+	values := []pmodel.SampleValue{3, 1, 2}
+	testCases := []struct {
+		action   cfg.DuplicateAction
+		expected pmodel.SampleValue
+	}{
+		{action: "", expected: 3},
+		{action: cfg.DuplicateFirst, expected: 3},
+		{action: cfg.DuplicateSum, expected: 6},
+		{action: cfg.DuplicateMax, expected: 3},
+		{action: cfg.DuplicateMin, expected: 1},
+		{action: cfg.DuplicateAvg, expected: 2},
+	}
+
+	for _, testCase := range testCases {
+		policy, err := NewResultPolicy(&cfg.ResultPolicy{Duplicates: testCase.action}, nil)
+		require.NoError(t, err, "duplicates: %q", testCase.action)
+		value, err := policy.Reduce(values)
+		require.NoError(t, err, "duplicates: %q", testCase.action)
+		assert.Equal(t, testCase.expected, value, "duplicates: %q", testCase.action)
+	}
+
+	errorPolicy, err := NewResultPolicy(&cfg.ResultPolicy{Duplicates: cfg.DuplicateError}, nil)
+	require.NoError(t, err)
+	_, err = errorPolicy.Reduce(values)
+	assert.Error(t, err, "several values should be rejected")
+	value, err := errorPolicy.Reduce([]pmodel.SampleValue{4})
+	require.NoError(t, err, "single values should be accepted")
+	assert.Equal(t, pmodel.SampleValue(4), value)
+
+	_, err = NewResultPolicy(&cfg.ResultPolicy{Duplicates: "median"}, nil)
+	assert.Error(t, err, "unknown duplicate actions should be rejected")
+}
+
+func TestProviderDuplicateResults(t *testing.T) {
+	setupProvider := func(duplicates cfg.DuplicateAction) provider.CustomMetricsProvider {
+		rule := sumRule("http_requests_total")
+		rule.MetricsQuery = "<<.Series>>{<<.LabelMatchers>>}"
+		rule.Results = &cfg.ResultPolicy{Duplicates: duplicates}
+		prov, fakeProm := setupRuleProvider(t, rule, ProviderOptions{}, fakePod("somens", "web-0"))
+
+		fakeProm.series = map[prom.Selector][]prom.Series{
+			"http_requests_total": {
+				{Name: "http_requests_total", Labels: pmodel.LabelSet{"pod": "web-0", "namespace": "somens", "code": "200"}},
+				{Name: "http_requests_total", Labels: pmodel.LabelSet{"pod": "web-0", "namespace": "somens", "code": "500"}},
+			},
+		}
+		// the query doesn't aggregate, so there's a result for each status code
+		fakeProm.queryResults = map[prom.Selector]prom.QueryResult{
+			`http_requests_total{namespace="somens",pod="web-0"}`: {
+				Type: pmodel.ValVector,
+				Vector: &pmodel.Vector{
+					{Metric: pmodel.Metric{"pod": "web-0", "code": "500"}, Value: pmodel.SampleValue(2)},
+					{Metric: pmodel.Metric{"pod": "web-0", "code": "200"}, Value: pmodel.SampleValue(5)},
+				},
+			},
+		}
+		lister := prov.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
+		require.NoError(t, lister.updateMetrics())
+		return prov
+	}
+
+	podsGR := schema.GroupResource{Resource: "pods"}
+
+	value, err := setupProvider(cfg.DuplicateFirst).GetMetricByName(types.NamespacedName{Namespace: "somens", Name: "web-0"}, provider.CustomMetricInfo{GroupResource: podsGR, Namespaced: true, Metric: "http_requests_total"}, labels.Everything())
+	require.NoError(t, err)
+	assert.Equal(t, int64(5000), value.Value.MilliValue(), "the first result should be the same regardless of the order results are returned in")
+
+	value, err = setupProvider(cfg.DuplicateSum).GetMetricByName(types.NamespacedName{Namespace: "somens", Name: "web-0"}, provider.CustomMetricInfo{GroupResource: podsGR, Namespaced: true, Metric: "http_requests_total"}, labels.Everything())
+	require.NoError(t, err)
+	assert.Equal(t, int64(7000), value.Value.MilliValue(), "results for the same object should be summed")
+
+	_, err = setupProvider(cfg.DuplicateError).GetMetricByName(types.NamespacedName{Namespace: "somens", Name: "web-0"}, provider.CustomMetricInfo{GroupResource: podsGR, Namespaced: true, Metric: "http_requests_total"}, labels.Everything())
+	assert.Error(t, err, "several results for the same object should be rejected")
+}
+
+func TestProviderDescribedObjectVersions(t *testing.T) {
+	prov, fakeProm := setupRuleProvider(t, sumRule("http_requests_total"), ProviderOptions{})
+
+	fakeProm.series = map[prom.Selector][]prom.Series{
+		"http_requests_total": {
+			{Name: "http_requests_total", Labels: pmodel.LabelSet{"pod": "web-0", "deployment": "web", "namespace": "somens"}},
+		},
+	}
+	fakeProm.queryResults = map[prom.Selector]prom.QueryResult{
+		`sum(http_requests_total{namespace="somens",pod="web-0"}) by (pod)`: {
+			Type:   pmodel.ValVector,
+			Vector: &pmodel.Vector{{Metric: pmodel.Metric{"pod": "web-0"}, Value: pmodel.SampleValue(1)}},
+		},
+		`sum(http_requests_total{namespace="somens",deployment="web"}) by (deployment)`: {
+			Type:   pmodel.ValVector,
+			Vector: &pmodel.Vector{{Metric: pmodel.Metric{"deployment": "web"}, Value: pmodel.SampleValue(1)}},
+		},
+	}
+	lister := prov.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
+	require.NoError(t, lister.updateMetrics())
+
+	// objects should be described using their preferred served version
+	value, err := prov.GetMetricByName(types.NamespacedName{Namespace: "somens", Name: "web-0"}, provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "http_requests_total"}, labels.Everything())
+	require.NoError(t, err)
+	assert.Equal(t, "v1", value.DescribedObject.APIVersion)
+	assert.Equal(t, "Pod", value.DescribedObject.Kind)
+
+	value, err = prov.GetMetricByName(types.NamespacedName{Namespace: "somens", Name: "web"}, provider.CustomMetricInfo{GroupResource: schema.GroupResource{Group: "extensions", Resource: "deployments"}, Namespaced: true, Metric: "http_requests_total"}, labels.Everything())
+	require.NoError(t, err)
+	assert.Equal(t, "extensions/v1beta1", value.DescribedObject.APIVersion)
+	assert.Equal(t, "Deployment", value.DescribedObject.Kind)
+}
+
+func TestProviderServesBothAPIVersions(t *testing.T) {
+	prov, fakeProm := setupPrometheusProvider(t)
+	fakeProm.acceptibleInterval = pmodel.Interval{Start: 0, End: pmodel.Latest}
+
+	lister := prov.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
+	require.NoError(t, lister.updateMetrics())
+
+	fakeProm.queryResults = map[prom.Selector]prom.QueryResult{
+		`sum(rate(ingress_hits_total{namespace="somens",service="somesvc",verb="GET"}[1m])) by (service)`: {
+			Type:   pmodel.ValVector,
+			Vector: &pmodel.Vector{{Metric: pmodel.Metric{"service": "somesvc"}, Value: pmodel.SampleValue(4)}},
+		},
+	}
+
+	// fetch the metric the way the API server does for each version, converting
+	// the request options from, and the results to, that version
+	storage := metricstorage.NewREST(prov)
+	ctx := genericapirequest.WithNamespace(genericapirequest.WithRequestInfo(context.Background(), &genericapirequest.RequestInfo{
+		Resource:    "services",
+		Subresource: "ingress_hits",
+	}), "somens")
+	fetch := func(versionedOpts, versionedList runtime.Object) *custom_metrics.MetricValueList {
+		listOpts := &metainternalversion.ListOptions{FieldSelector: fields.OneTermEqualSelector("metadata.name", "somesvc")}
+		metricOpts := &custom_metrics.MetricListOptions{}
+		require.NoError(t, cmapiserver.Scheme.Convert(versionedOpts, metricOpts, nil))
+		res, err := storage.List(ctx, listOpts, metricOpts)
+		require.NoError(t, err)
+
+		// round-trip the results through the version, so that they can be compared
+		require.NoError(t, cmapiserver.Scheme.Convert(res, versionedList, nil))
+		values := &custom_metrics.MetricValueList{}
+		require.NoError(t, cmapiserver.Scheme.Convert(versionedList, values, nil))
+		for i := range values.Items {
+			// each fetch is timestamped separately
+			values.Items[i].Timestamp = metav1.Time{}
+		}
+		return values
+	}
+
+	v1beta1List := &cmv1beta1.MetricValueList{}
+	v1beta1Values := fetch(&cmv1beta1.MetricListOptions{MetricLabelSelector: "verb=GET"}, v1beta1List)
+	v1beta2List := &cmv1beta2.MetricValueList{}
+	v1beta2Values := fetch(&cmv1beta2.MetricListOptions{MetricLabelSelector: "verb=GET"}, v1beta2List)
+
+	assert.NotEmpty(t, v1beta1Values.Items)
+	assert.Equal(t, v1beta1Values, v1beta2Values, "both versions should serve the same values")
+
+	for i := range v1beta1List.Items {
+		assert.Equal(t, "ingress_hits", v1beta1List.Items[i].MetricName)
+		assert.Equal(t, "verb=GET", metav1.FormatLabelSelector(v1beta1List.Items[i].Selector), "values should carry their metric selector")
+		assert.Equal(t, "ingress_hits", v1beta2List.Items[i].Metric.Name)
+		assert.Equal(t, "verb=GET", metav1.FormatLabelSelector(v1beta2List.Items[i].Metric.Selector), "values should carry their metric selector")
+	}
+}
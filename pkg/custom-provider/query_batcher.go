@@ -0,0 +1,203 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	"github.com/prometheus/client_golang/prometheus"
+	pmodel "github.com/prometheus/common/model"
+	"k8s.io/apimachinery/pkg/labels"
+
+	prom "github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/client"
+)
+
+var (
+	// coalescedRequests counts requests which were answered by a query made for another request.
+	coalescedRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cmgateway_coalesced_requests_total",
+			Help: "Number of metrics requests answered by a query shared with other requests.  Broken down by reason (batched or in-flight)",
+		},
+		[]string{"reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(coalescedRequests)
+}
+
+// maxBatchSize is the largest number of objects fetched by a single batched query,
+// to keep the queries (and their results) to a reasonable size.
+const maxBatchSize = 100
+
+// batchQueryFunc fetches the results of a metric for the given objects.
+type batchQueryFunc func(info provider.CustomMetricInfo, namespace string, metricSelector labels.Selector, names ...string) (pmodel.Vector, error)
+
+// batchKey identifies the requests which can be answered by the same batched query.
+type batchKey struct {
+	info           provider.CustomMetricInfo
+	namespace      string
+	metricSelector string
+}
+
+// queryBatch collects the objects for a single batched query, and holds its results.
+type queryBatch struct {
+	metricSelector labels.Selector
+	names          map[string]struct{}
+
+	// done is closed once the results are available
+	done    chan struct{}
+	results pmodel.Vector
+	err     error
+	// size is the number of objects the results were fetched for
+	size int
+}
+
+// queryBatcher coalesces concurrent requests for a metric on individual objects into
+// a single query for all of them.  Requests for the same metric, namespace, and metric
+// selector which arrive within the batching window of each other share a query.
+type queryBatcher struct {
+	window time.Duration
+	query  batchQueryFunc
+
+	mu      sync.Mutex
+	batches map[batchKey]*queryBatch
+}
+
+// newQueryBatcher constructs a queryBatcher which fetches results with the given function.
+// Requests aren't batched if the window is zero.
+func newQueryBatcher(window time.Duration, query batchQueryFunc) *queryBatcher {
+	return &queryBatcher{
+		window:  window,
+		query:   query,
+		batches: make(map[batchKey]*queryBatch),
+	}
+}
+
+// Query fetches results of the given metric which include (but may not be limited to)
+// those for the named object, waiting for the batching window to close first.
+func (b *queryBatcher) Query(info provider.CustomMetricInfo, namespace string, metricSelector labels.Selector, name string) (pmodel.Vector, error) {
+	if b.window <= 0 {
+		return b.query(info, namespace, metricSelector, name)
+	}
+
+	key := batchKey{info: info, namespace: namespace, metricSelector: metricSelector.String()}
+
+	b.mu.Lock()
+	batch, open := b.batches[key]
+	if open {
+		coalescedRequests.WithLabelValues("batched").Inc()
+	} else {
+		batch = &queryBatch{
+			metricSelector: metricSelector,
+			names:          make(map[string]struct{}),
+			done:           make(chan struct{}),
+		}
+		b.batches[key] = batch
+		time.AfterFunc(b.window, func() { b.run(key, batch) })
+	}
+	batch.names[name] = struct{}{}
+	if len(batch.names) >= maxBatchSize {
+		// later requests will start a new batch
+		delete(b.batches, key)
+	}
+	b.mu.Unlock()
+
+	<-batch.done
+	if batch.err != nil && batch.size > 1 && !isFetchError(batch.err) {
+		// a single bad name (for instance, one which can't be looked up)
+		// fails the whole batched query, so retry with just this name, so
+		// that the other requests in the batch still succeed.  If Prometheus
+		// couldn't be queried at all, retrying would only multiply the queries
+		// sent to it, so that's left to the stale values instead.
+		return b.query(info, namespace, metricSelector, name)
+	}
+	return batch.results, batch.err
+}
+
+// run closes the given batch to new requests, and fetches its results.
+func (b *queryBatcher) run(key batchKey, batch *queryBatch) {
+	b.mu.Lock()
+	if b.batches[key] == batch {
+		delete(b.batches, key)
+	}
+	names := make([]string, 0, len(batch.names))
+	for name := range batch.names {
+		names = append(names, name)
+	}
+	b.mu.Unlock()
+
+	// keep the queries consistent, regardless of the order the requests arrived in
+	sort.Strings(names)
+	batch.results, batch.err = b.query(key.info, key.namespace, batch.metricSelector, names...)
+	batch.size = len(names)
+	close(batch.done)
+}
+
+// inflightKey identifies identical queries.
+type inflightKey struct {
+	query     prom.Selector
+	evaluator *RangeEvaluator
+}
+
+// inflightQuery holds the results of a query, once they're available.
+type inflightQuery struct {
+	// done is closed once the results are available
+	done    chan struct{}
+	results pmodel.Vector
+	err     error
+}
+
+// inflightQueries deduplicates identical queries which are made at the same time,
+// so that only one of them is actually sent to Prometheus.
+type inflightQueries struct {
+	mu      sync.Mutex
+	queries map[inflightKey]*inflightQuery
+}
+
+// Do runs the given function to fetch the results of the given query, unless the
+// same query is already in flight, in which case it waits for those results instead.
+func (q *inflightQueries) Do(query prom.Selector, evaluator *RangeEvaluator, fetch func() (pmodel.Vector, error)) (pmodel.Vector, error) {
+	key := inflightKey{query: query, evaluator: evaluator}
+
+	q.mu.Lock()
+	if q.queries == nil {
+		q.queries = make(map[inflightKey]*inflightQuery)
+	}
+	if inflight, found := q.queries[key]; found {
+		q.mu.Unlock()
+		coalescedRequests.WithLabelValues("in-flight").Inc()
+		<-inflight.done
+		return inflight.results, inflight.err
+	}
+	inflight := &inflightQuery{done: make(chan struct{})}
+	q.queries[key] = inflight
+	q.mu.Unlock()
+
+	inflight.results, inflight.err = fetch()
+
+	q.mu.Lock()
+	delete(q.queries, key)
+	q.mu.Unlock()
+	close(inflight.done)
+
+	return inflight.results, inflight.err
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+
+	pmodel "github.com/prometheus/common/model"
+
+	prom "github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/client"
+)
+
+// recordingBatchQuery records the calls made to a batchQueryFunc.
+type recordingBatchQuery struct {
+	mu    sync.Mutex
+	calls [][]string
+	// badName fails any query which includes it
+	badName string
+	// err, if set, fails every query
+	err error
+}
+
+func (r *recordingBatchQuery) query(info provider.CustomMetricInfo, namespace string, metricSelector labels.Selector, names ...string) (pmodel.Vector, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, append([]string{namespace}, names...))
+	if r.err != nil {
+		return nil, r.err
+	}
+	for _, name := range names {
+		if name == r.badName {
+			return nil, fmt.Errorf("unable to look up %q", name)
+		}
+	}
+	return pmodel.Vector{{Metric: pmodel.Metric{"namespace": pmodel.LabelValue(namespace)}, Value: pmodel.SampleValue(len(names))}}, nil
+}
+
+func TestQueryBatcher(t *testing.T) {
+	recorder := &recordingBatchQuery{}
+	batcher := newQueryBatcher(50*time.Millisecond, recorder.query)
+	info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "queue_length"}
+
+	requests := []struct {
+		namespace string
+		name      string
+	}{
+		{"somens", "pod-c"}, {"somens", "pod-a"}, {"somens", "pod-b"}, {"somens", "pod-a"}, {"otherns", "pod-a"},
+	}
+	results := make([]pmodel.Vector, len(requests))
+	var wg sync.WaitGroup
+	for i, request := range requests {
+		wg.Add(1)
+		go func(i int, namespace, name string) {
+			defer wg.Done()
+			res, err := batcher.Query(info, namespace, labels.Everything(), name)
+			assert.NoError(t, err)
+			results[i] = res
+		}(i, request.namespace, request.name)
+	}
+	wg.Wait()
+
+	assert.ElementsMatch(t, [][]string{{"somens", "pod-a", "pod-b", "pod-c"}, {"otherns", "pod-a"}}, recorder.calls, "requests in the same namespace should share a query")
+	for i, request := range requests {
+		require.Len(t, results[i], 1)
+		assert.Equal(t, pmodel.LabelValue(request.namespace), results[i][0].Metric["namespace"], "requests should get the results of their own batch")
+	}
+
+	// without a window, each request gets its own query
+	recorder = &recordingBatchQuery{}
+	batcher = newQueryBatcher(0, recorder.query)
+	_, err := batcher.Query(info, "somens", labels.Everything(), "pod-a")
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"somens", "pod-a"}}, recorder.calls)
+}
+
+func TestQueryBatcherIsolatesFailures(t *testing.T) {
+	recorder := &recordingBatchQuery{badName: "pod-bad"}
+	batcher := newQueryBatcher(50*time.Millisecond, recorder.query)
+	info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "queue_length"}
+
+	names := []string{"pod-a", "pod-bad"}
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			_, errs[i] = batcher.Query(info, "somens", labels.Everything(), name)
+		}(i, name)
+	}
+	wg.Wait()
+
+	assert.NoError(t, errs[0], "a valid name should not fail because of another name in its batch")
+	assert.Error(t, errs[1], "a bad name should still fail")
+	assert.ElementsMatch(t, [][]string{{"somens", "pod-a", "pod-bad"}, {"somens", "pod-a"}, {"somens", "pod-bad"}}, recorder.calls, "each name should be retried on its own after the batch fails")
+}
+
+func TestQueryBatcherDoesNotRetryFetchErrors(t *testing.T) {
+	recorder := &recordingBatchQuery{err: newFetchError()}
+	batcher := newQueryBatcher(50*time.Millisecond, recorder.query)
+	info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "queue_length"}
+
+	names := []string{"pod-a", "pod-b", "pod-c"}
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			_, errs[i] = batcher.Query(info, "somens", labels.Everything(), name)
+		}(i, name)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		assert.True(t, isFetchError(err), "request for %s should get the batch's fetch error, not %v", names[i], err)
+	}
+	assert.Len(t, recorder.calls, 1, "names should not be retried on their own when Prometheus couldn't be queried at all")
+}
+
+func TestInflightQueries(t *testing.T) {
+	var inflight inflightQueries
+	release := make(chan struct{})
+	fetches := 0
+	fetch := func() (pmodel.Vector, error) {
+		fetches++
+		<-release
+		return pmodel.Vector{{Value: 1}}, nil
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		res, err := inflight.Do("some_query", nil, fetch)
+		assert.NoError(t, err)
+		assert.Len(t, res, 1)
+	}()
+	// wait for the first query to be in flight
+	require.True(t, waitFor(func() bool {
+		inflight.mu.Lock()
+		defer inflight.mu.Unlock()
+		return len(inflight.queries) == 1
+	}))
+
+	coalesced := counterValue(t, coalescedRequests.WithLabelValues("in-flight"))
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		res, err := inflight.Do("some_query", nil, func() (pmodel.Vector, error) {
+			t.Error("identical queries should not be fetched while one is in flight")
+			return nil, nil
+		})
+		assert.NoError(t, err)
+		assert.Len(t, res, 1)
+	}()
+	// wait for the second query to start waiting on the first
+	require.True(t, waitFor(func() bool {
+		return counterValue(t, coalescedRequests.WithLabelValues("in-flight")) > coalesced
+	}))
+	close(release)
+	wg.Wait()
+	assert.Equal(t, 1, fetches)
+
+	// once the results are in, the query should be fetched again
+	res, err := inflight.Do("some_query", nil, func() (pmodel.Vector, error) { return pmodel.Vector{}, nil })
+	require.NoError(t, err)
+	assert.Len(t, res, 0)
+}
+
+// counterValue fetches the current value of the given counter.
+func counterValue(t *testing.T, counter prometheus.Counter) float64 {
+	var metric dto.Metric
+	require.NoError(t, counter.Write(&metric))
+	return metric.GetCounter().GetValue()
+}
+
+func TestProviderBatchesSingleRequests(t *testing.T) {
+	prov, fakeProm := setupRuleProvider(t, sumRule("queue_length"), ProviderOptions{BatchWindow: 50 * time.Millisecond}, fakePod("somens", "web-0"))
+
+	fakeProm.series = map[prom.Selector][]prom.Series{
+		"queue_length": {
+			{Name: "queue_length", Labels: pmodel.LabelSet{"pod": "web-0", "namespace": "somens"}},
+		},
+	}
+	fakeProm.queryResults = map[prom.Selector]prom.QueryResult{
+		`sum(queue_length{namespace="somens",pod=~"web-0|web-1|web-2"}) by (pod)`: {
+			Type: pmodel.ValVector,
+			Vector: &pmodel.Vector{
+				{Metric: pmodel.Metric{"pod": "web-0"}, Value: pmodel.SampleValue(1)},
+				{Metric: pmodel.Metric{"pod": "web-1"}, Value: pmodel.SampleValue(2)},
+			},
+		},
+	}
+	lister := prov.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
+	require.NoError(t, lister.updateMetrics())
+
+	podsGR := schema.GroupResource{Resource: "pods"}
+	values := map[string]int64{}
+	var valuesMu sync.Mutex
+	var wg sync.WaitGroup
+	for _, name := range []string{"web-2", "web-0", "web-1"} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			value, err := prov.GetMetricByName(types.NamespacedName{Namespace: "somens", Name: name}, provider.CustomMetricInfo{GroupResource: podsGR, Namespaced: true, Metric: "queue_length"}, labels.Everything())
+			if name == "web-2" {
+				assert.Error(t, err, "objects without results should still be reported as missing")
+				return
+			}
+			if assert.NoError(t, err, name) {
+				valuesMu.Lock()
+				values[name] = value.Value.MilliValue()
+				valuesMu.Unlock()
+			}
+		}(name)
+	}
+	wg.Wait()
+
+	assert.Equal(t, map[string]int64{"web-0": 1000, "web-1": 2000}, values, "each request should get the value for its own object")
+	assert.Len(t, fakeProm.queries, 1, "concurrent requests should share a single query")
+}
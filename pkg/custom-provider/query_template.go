@@ -0,0 +1,144 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	pmodel "github.com/prometheus/common/model"
+)
+
+// defaultRateWindow is the value of `.RateWindow` in metrics query templates
+// when no rate window is configured.
+const defaultRateWindow = "2m"
+
+// queryTemplateFuncs are the helper functions available in metrics query templates.
+// As with name templates, functions take the value being transformed last.
+var queryTemplateFuncs = template.FuncMap{
+	"join":        func(sep string, values []string) string { return strings.Join(values, sep) },
+	"quote":       quotePromQL,
+	"regexEscape": regexp.QuoteMeta,
+}
+
+// promQLStringEscaper escapes the characters which can't appear as they are in
+// a double-quoted PromQL string.  PromQL strings are UTF-8, so everything else
+// (including non-ASCII text) is left alone, unlike with Go's quoting.
+var promQLStringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// quotePromQL produces a double-quoted PromQL string literal.
+func quotePromQL(value string) string {
+	return `"` + promQLStringEscaper.Replace(value) + `"`
+}
+
+// newQueryTemplate parses and validates a metrics query template, which may refer
+// to the given constants.
+func newQueryTemplate(queryTemplate string, constants map[string]string, rateWindow string) (*template.Template, error) {
+	tmpl, err := template.New("metrics-query").Delims("<<", ">>").Funcs(queryTemplateFuncs).Parse(queryTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse metrics query template %q: %v", queryTemplate, err)
+	}
+
+	if tmpl.Tree != nil {
+		if err := checkConstantRefs(tmpl.Tree.Root, constants); err != nil {
+			return nil, fmt.Errorf("invalid metrics query template %q: %v", queryTemplate, err)
+		}
+	}
+
+	// try the template out, to catch references to unknown fields, and misused functions
+	if err := tmpl.Execute(ioutil.Discard, exampleQueryArgs(constants, rateWindow)); err != nil {
+		return nil, fmt.Errorf("invalid metrics query template %q: %v", queryTemplate, err)
+	}
+
+	return tmpl, nil
+}
+
+// exampleQueryArgs produces arguments for trying out metrics query templates.
+func exampleQueryArgs(constants map[string]string, rateWindow string) queryTemplateArgs {
+	return queryTemplateArgs{
+		Series:            "series",
+		LabelMatchers:     `label="value"`,
+		LabelValuesByName: map[string][]string{"label": {"value"}},
+		GroupBy:           "label",
+		GroupBySlice:      []string{"label"},
+		Resource:          "pods",
+		Kind:              "Pod",
+		Constants:         constants,
+		RateWindow:        rateWindow,
+	}
+}
+
+// labelMatchersSentinel stands in for the label matchers when checking that
+// a metrics query template uses them.
+const labelMatchersSentinel = `__label_matchers__="sentinel"`
+
+// rendersLabelMatchers checks that the given metrics query template includes the
+// label matchers in the queries it produces, as opposed to just mentioning them
+// (in a comment, or in a branch which isn't taken, say).
+func rendersLabelMatchers(tmpl *template.Template, constants map[string]string, rateWindow string) (bool, error) {
+	args := exampleQueryArgs(constants, rateWindow)
+	args.LabelMatchers = labelMatchersSentinel
+	var query bytes.Buffer
+	if err := tmpl.Execute(&query, args); err != nil {
+		return false, err
+	}
+	return strings.Contains(query.String(), labelMatchersSentinel), nil
+}
+
+// parseRateWindow checks that the given rate window is a valid Prometheus duration,
+// returning the default window if it's empty.
+func parseRateWindow(rateWindow string) (string, error) {
+	if rateWindow == "" {
+		return defaultRateWindow, nil
+	}
+	if _, err := pmodel.ParseDuration(rateWindow); err != nil {
+		return "", fmt.Errorf("unable to parse rate window %q: %v", rateWindow, err)
+	}
+	return rateWindow, nil
+}
+
+// checkConstantRefs walks the given template node, checking that each constant
+// referred to as `.Constants.<name>` has been defined.
+func checkConstantRefs(node parse.Node, constants map[string]string) error {
+	return walkTemplate(node, func(node parse.Node) error {
+		switch node := node.(type) {
+		case *parse.FieldNode:
+			return checkConstantRef(node.Ident, constants)
+		case *parse.VariableNode:
+			if node.Ident[0] == "$" {
+				return checkConstantRef(node.Ident[1:], constants)
+			}
+		}
+		return nil
+	})
+}
+
+// checkConstantRef checks the constant referred to by the given field chain, if any.
+func checkConstantRef(ident []string, constants map[string]string) error {
+	if len(ident) < 2 || ident[0] != "Constants" {
+		return nil
+	}
+	if _, defined := constants[ident[1]]; !defined {
+		return fmt.Errorf("constant %q is not defined", ident[1])
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	pmodel "github.com/prometheus/common/model"
+
+	prom "github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/client"
+	"github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/config"
+)
+
+// RangeEvaluator evaluates queries over a window of time, reducing the results
+// for each series to a single value.
+type RangeEvaluator struct {
+	window     time.Duration
+	step       time.Duration
+	reduce     config.RangeReduction
+	percentile float64
+	ahead      time.Duration
+}
+
+// NewRangeEvaluator constructs a RangeEvaluator from the given configuration.
+func NewRangeEvaluator(cfg config.RangeEvaluation) (*RangeEvaluator, error) {
+	evaluator := &RangeEvaluator{reduce: cfg.Reduce}
+
+	window, err := parsePositiveDuration("window", cfg.Window)
+	if err != nil {
+		return nil, err
+	}
+	evaluator.window = window
+
+	if cfg.Step == "" {
+		evaluator.step = evaluator.window / 30
+		if evaluator.step < time.Second {
+			evaluator.step = time.Second
+		}
+	} else {
+		evaluator.step, err = parsePositiveDuration("step", cfg.Step)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch cfg.Reduce {
+	case config.ReduceMean, config.ReduceMax:
+	case config.ReducePercentile:
+		if math.IsNaN(cfg.Percentile) || cfg.Percentile < 0 || cfg.Percentile > 100 {
+			return nil, fmt.Errorf("percentile %v must be between 0 and 100", cfg.Percentile)
+		}
+		evaluator.percentile = cfg.Percentile
+	case config.ReduceForecast:
+		evaluator.ahead, err = parsePositiveDuration("ahead", cfg.Ahead)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown reduction %q, must be one of %q, %q, %q, or %q", cfg.Reduce, config.ReduceMean, config.ReduceMax, config.ReducePercentile, config.ReduceForecast)
+	}
+
+	return evaluator, nil
+}
+
+// parsePositiveDuration parses the given Prometheus duration, which must be present and non-zero.
+func parsePositiveDuration(field string, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, fmt.Errorf("%s must be specified", field)
+	}
+	duration, err := pmodel.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse %s %q: %v", field, value, err)
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("%s %q must be greater than zero", field, value)
+	}
+	return time.Duration(duration), nil
+}
+
+// Range returns the range over which to evaluate queries at the given time.
+func (e *RangeEvaluator) Range(now pmodel.Time) prom.Range {
+	return prom.Range{
+		Start: now.Add(-e.window),
+		End:   now,
+		Step:  e.step,
+	}
+}
+
+// Reduce reduces each series in the given results of a range query to a single
+// sample at the given time.  Series without enough samples to reduce are left out.
+func (e *RangeEvaluator) Reduce(matrix pmodel.Matrix, now pmodel.Time) pmodel.Vector {
+	res := make(pmodel.Vector, 0, len(matrix))
+	for _, stream := range matrix {
+		value, ok := e.reduceSamples(stream.Values, now)
+		if !ok {
+			continue
+		}
+		res = append(res, &pmodel.Sample{
+			Metric:    stream.Metric,
+			Value:     value,
+			Timestamp: now,
+		})
+	}
+	return res
+}
+
+// reduceSamples reduces the given samples from a single series into one value.
+// NaN samples (from a division by zero, for instance) are skipped, so a series
+// with only NaN samples has no value.
+func (e *RangeEvaluator) reduceSamples(samples []pmodel.SamplePair, now pmodel.Time) (pmodel.SampleValue, bool) {
+	samples = withoutNaN(samples)
+	if len(samples) == 0 {
+		return 0, false
+	}
+
+	switch e.reduce {
+	case config.ReduceMax:
+		max := samples[0].Value
+		for _, sample := range samples[1:] {
+			if sample.Value > max {
+				max = sample.Value
+			}
+		}
+		return max, true
+	case config.ReducePercentile:
+		values := make([]float64, len(samples))
+		for i, sample := range samples {
+			values[i] = float64(sample.Value)
+		}
+		sort.Float64s(values)
+		// interpolate between the closest ranks, as Prometheus' quantile functions do
+		rank := e.percentile / 100 * float64(len(values)-1)
+		lower := int(math.Floor(rank))
+		upper := int(math.Ceil(rank))
+		weight := rank - float64(lower)
+		return pmodel.SampleValue(values[lower]*(1-weight) + values[upper]*weight), true
+	case config.ReduceForecast:
+		return forecast(samples, now.Add(e.ahead))
+	default:
+		var sum float64
+		for _, sample := range samples {
+			sum += float64(sample.Value)
+		}
+		return pmodel.SampleValue(sum / float64(len(samples))), true
+	}
+}
+
+// withoutNaN returns the given samples without any NaN samples, only copying
+// them if there are any.
+func withoutNaN(samples []pmodel.SamplePair) []pmodel.SamplePair {
+	for i, sample := range samples {
+		if !math.IsNaN(float64(sample.Value)) {
+			continue
+		}
+		res := append(make([]pmodel.SamplePair, 0, len(samples)-1), samples[:i]...)
+		for _, sample := range samples[i+1:] {
+			if !math.IsNaN(float64(sample.Value)) {
+				res = append(res, sample)
+			}
+		}
+		return res
+	}
+	return samples
+}
+
+// forecast fits a line to the given samples using simple linear regression,
+// and returns its value at the given time.  At least two samples are needed.
+func forecast(samples []pmodel.SamplePair, at pmodel.Time) (pmodel.SampleValue, bool) {
+	if len(samples) < 2 {
+		return 0, false
+	}
+
+	// use times relative to the forecast time, to avoid losing precision
+	var sumX, sumY, sumXY, sumX2 float64
+	for _, sample := range samples {
+		x := float64(sample.Timestamp.Sub(at)) / float64(time.Second)
+		y := float64(sample.Value)
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumX2 += x * x
+	}
+	n := float64(len(samples))
+	covXY := sumXY - sumX*sumY/n
+	varX := sumX2 - sumX*sumX/n
+	if varX == 0 {
+		return 0, false
+	}
+	slope := covXY / varX
+	intercept := sumY/n - slope*sumX/n
+
+	// the forecast time is at x = 0
+	return pmodel.SampleValue(intercept), true
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	pmodel "github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+
+	prom "github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/client"
+	cfg "github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/config"
+)
+
+// samplesEvery produces samples with the given values, one minute apart, ending at the given time.
+func samplesEvery(end pmodel.Time, values ...float64) []pmodel.SamplePair {
+	samples := make([]pmodel.SamplePair, len(values))
+	for i, value := range values {
+		samples[i] = pmodel.SamplePair{
+			Timestamp: end.Add(-time.Duration(len(values)-1-i) * time.Minute),
+			Value:     pmodel.SampleValue(value),
+		}
+	}
+	return samples
+}
+
+func TestRangeEvaluatorReductions(t *testing.T) {
+	now := pmodel.TimeFromUnix(1530000000)
+	testCases := []struct {
+		title    string
+		cfg      cfg.RangeEvaluation
+		values   []float64
+		expected float64
+		noValue  bool
+	}{
+		{title: "mean", cfg: cfg.RangeEvaluation{Window: "5m", Reduce: cfg.ReduceMean}, values: []float64{1, 2, 3, 6}, expected: 3},
+		{title: "max", cfg: cfg.RangeEvaluation{Window: "5m", Reduce: cfg.ReduceMax}, values: []float64{1, 7, 3, 6}, expected: 7},
+		{title: "median", cfg: cfg.RangeEvaluation{Window: "5m", Reduce: cfg.ReducePercentile, Percentile: 50}, values: []float64{4, 1, 3, 2}, expected: 2.5},
+		{title: "high percentile", cfg: cfg.RangeEvaluation{Window: "5m", Reduce: cfg.ReducePercentile, Percentile: 100}, values: []float64{4, 1, 3, 2}, expected: 4},
+		{title: "forecast of a trend", cfg: cfg.RangeEvaluation{Window: "5m", Reduce: cfg.ReduceForecast, Ahead: "2m"}, values: []float64{1, 2, 3, 4}, expected: 6},
+		{title: "forecast of a flat line", cfg: cfg.RangeEvaluation{Window: "5m", Reduce: cfg.ReduceForecast, Ahead: "10m"}, values: []float64{5, 5, 5}, expected: 5},
+		{title: "forecast with too few samples", cfg: cfg.RangeEvaluation{Window: "5m", Reduce: cfg.ReduceForecast, Ahead: "2m"}, values: []float64{5}, noValue: true},
+		{title: "no samples", cfg: cfg.RangeEvaluation{Window: "5m", Reduce: cfg.ReduceMean}, noValue: true},
+		{title: "mean skipping NaN", cfg: cfg.RangeEvaluation{Window: "5m", Reduce: cfg.ReduceMean}, values: []float64{1, math.NaN(), 3, 8}, expected: 4},
+		{title: "max skipping NaN", cfg: cfg.RangeEvaluation{Window: "5m", Reduce: cfg.ReduceMax}, values: []float64{math.NaN(), 7, 3}, expected: 7},
+		{title: "median skipping NaN", cfg: cfg.RangeEvaluation{Window: "5m", Reduce: cfg.ReducePercentile, Percentile: 50}, values: []float64{4, math.NaN(), 1, 3, math.NaN()}, expected: 3},
+		{title: "low percentile skipping NaN", cfg: cfg.RangeEvaluation{Window: "5m", Reduce: cfg.ReducePercentile, Percentile: 0}, values: []float64{4, math.NaN(), 2}, expected: 2},
+		{title: "forecast skipping NaN", cfg: cfg.RangeEvaluation{Window: "5m", Reduce: cfg.ReduceForecast, Ahead: "1m"}, values: []float64{1, 2, math.NaN()}, expected: 4},
+		{title: "only NaN samples", cfg: cfg.RangeEvaluation{Window: "5m", Reduce: cfg.ReduceMean}, values: []float64{math.NaN(), math.NaN()}, noValue: true},
+		{title: "max of only NaN samples", cfg: cfg.RangeEvaluation{Window: "5m", Reduce: cfg.ReduceMax}, values: []float64{math.NaN()}, noValue: true},
+		{title: "percentile of only NaN samples", cfg: cfg.RangeEvaluation{Window: "5m", Reduce: cfg.ReducePercentile, Percentile: 50}, values: []float64{math.NaN()}, noValue: true},
+	}
+
+	for _, testCase := range testCases {
+		evaluator, err := NewRangeEvaluator(testCase.cfg)
+		require.NoError(t, err, testCase.title)
+
+		metric := pmodel.Metric{"pod": "somepod"}
+		res := evaluator.Reduce(pmodel.Matrix{{Metric: metric, Values: samplesEvery(now, testCase.values...)}}, now)
+		if testCase.noValue {
+			assert.Empty(t, res, testCase.title)
+			continue
+		}
+		require.Len(t, res, 1, testCase.title)
+		assert.Equal(t, metric, res[0].Metric, testCase.title)
+		assert.Equal(t, now, res[0].Timestamp, testCase.title)
+		assert.InDelta(t, testCase.expected, float64(res[0].Value), 1e-9, testCase.title)
+	}
+}
+
+func TestRangeEvaluatorConfig(t *testing.T) {
+	evaluator, err := NewRangeEvaluator(cfg.RangeEvaluation{Window: "15m", Reduce: cfg.ReduceMean})
+	require.NoError(t, err)
+	now := pmodel.TimeFromUnix(1530000000)
+	assert.Equal(t, prom.Range{Start: now.Add(-15 * time.Minute), End: now, Step: 30 * time.Second}, evaluator.Range(now), "the step should default to a thirtieth of the window")
+
+	invalid := []cfg.RangeEvaluation{
+		{Reduce: cfg.ReduceMean},
+		{Window: "5 minutes", Reduce: cfg.ReduceMean},
+		{Window: "5m", Step: "0s", Reduce: cfg.ReduceMean},
+		{Window: "5m", Reduce: "median"},
+		{Window: "5m", Reduce: cfg.ReducePercentile, Percentile: 101},
+		{Window: "5m", Reduce: cfg.ReduceForecast},
+	}
+	for _, evalCfg := range invalid {
+		_, err := NewRangeEvaluator(evalCfg)
+		assert.Error(t, err, "configuration %+v should be rejected", evalCfg)
+	}
+}
+
+func TestProviderRangeEvaluation(t *testing.T) {
+	rule := sumRule("queue_length")
+	rule.Evaluation = &cfg.RangeEvaluation{Window: "10m", Step: "1m", Reduce: cfg.ReduceMax}
+	prov, fakeProm := setupRuleProvider(t, rule, ProviderOptions{}, fakePod("somens", "somepod"))
+
+	fakeProm.series = map[prom.Selector][]prom.Series{
+		"queue_length": {
+			{Name: "queue_length", Labels: pmodel.LabelSet{"pod": "somepod", "namespace": "somens"}},
+		},
+	}
+	now := pmodel.Now()
+	fakeProm.rangeQueryResults = map[prom.Selector]prom.QueryResult{
+		`sum(queue_length{namespace="somens",pod="somepod"}) by (pod)`: {
+			Type: pmodel.ValMatrix,
+			Matrix: &pmodel.Matrix{
+				{Metric: pmodel.Metric{"pod": "somepod"}, Values: samplesEvery(now, 3, 12, 4)},
+			},
+		},
+		`sum(queue_length{namespace="somens",pod=~"somepod"}) by (pod)`: {
+			Type: pmodel.ValMatrix,
+			Matrix: &pmodel.Matrix{
+				{Metric: pmodel.Metric{"pod": "somepod"}, Values: samplesEvery(now, 3, 12, 4)},
+			},
+		},
+	}
+	lister := prov.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
+	require.NoError(t, lister.updateMetrics())
+
+	podsGR := schema.GroupResource{Resource: "pods"}
+	value, err := prov.GetMetricByName(types.NamespacedName{Namespace: "somens", Name: "somepod"}, provider.CustomMetricInfo{GroupResource: podsGR, Namespaced: true, Metric: "queue_length"}, labels.Everything())
+	require.NoError(t, err)
+	assert.Equal(t, int64(12000), value.Value.MilliValue())
+	assert.Equal(t, 10*time.Minute, fakeProm.lastRange.End.Sub(fakeProm.lastRange.Start))
+	assert.Equal(t, time.Minute, fakeProm.lastRange.Step)
+
+	values, err := prov.GetMetricBySelector("somens", labels.Everything(), provider.CustomMetricInfo{GroupResource: podsGR, Namespaced: true, Metric: "queue_length"}, labels.Everything())
+	require.NoError(t, err)
+	require.Len(t, values.Items, 1)
+	assert.Equal(t, int64(12000), values.Items[0].Value.MilliValue())
+}
@@ -0,0 +1,187 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+const (
+	// RelistAnnotation is the annotation on the relist ConfigMap which requests a relist
+	// whenever its value changes.
+	RelistAnnotation = "custom-metrics.kairosinc.com/relist-requested-at"
+
+	// relistSourceHTTP, relistSourceSignal, relistSourceConfigMap, and relistSourceTargets
+	// identify where relist requests came from.
+	relistSourceHTTP      = "http"
+	relistSourceSignal    = "signal"
+	relistSourceConfigMap = "configmap"
+	relistSourceTargets   = "targets"
+)
+
+var (
+	// relistRequests counts requests for an immediate relist.
+	relistRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cmgateway_relist_requests_total",
+			Help: "Number of requests for an immediate relist of available metrics.  Broken down by source, and by whether they were accepted or rate-limited",
+		},
+		[]string{"source", "result"},
+	)
+
+	configMapResource = schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+)
+
+func init() {
+	prometheus.MustRegister(relistRequests)
+}
+
+// RelistTrigger requests immediate relists of the available metrics from a discovery
+// runner, on demand.  Requests are rate-limited, so that they can't be used to overload
+// Prometheus.
+type RelistTrigger struct {
+	discovery   DiscoveryRunner
+	minInterval time.Duration
+
+	mu          sync.Mutex
+	lastRelist  time.Time
+	lastRequest string
+}
+
+// NewRelistTrigger constructs a RelistTrigger which allows at most one relist of the
+// given discovery runner per minimum interval.
+func NewRelistTrigger(discovery DiscoveryRunner, minInterval time.Duration) *RelistTrigger {
+	return &RelistTrigger{
+		discovery:   discovery,
+		minInterval: minInterval,
+	}
+}
+
+// Trigger requests an immediate relist on behalf of the given source.  It returns an
+// error if a relist was triggered too recently.
+func (t *RelistTrigger) Trigger(source string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if since := time.Since(t.lastRelist); !t.lastRelist.IsZero() && since < t.minInterval {
+		relistRequests.WithLabelValues(source, "rate-limited").Inc()
+		return fmt.Errorf("a relist was requested %v ago, another may be requested in %v", since.Round(time.Second), (t.minInterval - since).Round(time.Second))
+	}
+	t.lastRelist = time.Now()
+
+	relistRequests.WithLabelValues(source, "accepted").Inc()
+	klog.V(2).Infof("relist of available metrics requested by %s", source)
+	t.discovery.Relist()
+	return nil
+}
+
+// ServeHTTP triggers a relist on POST requests.  It's expected to be served behind the
+// API server's authentication and authorization.
+func (t *RelistTrigger) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "relists must be requested with POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := t.Trigger(relistSourceHTTP); err != nil {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// TriggerOnSignal triggers a relist each time a signal is received from the given
+// channel (as registered with os/signal), until the stop channel is closed.
+func (t *RelistTrigger) TriggerOnSignal(signals <-chan os.Signal, stopChan <-chan struct{}) {
+	go func() {
+		for {
+			select {
+			case <-stopChan:
+				return
+			case <-signals:
+				if err := t.Trigger(relistSourceSignal); err != nil {
+					klog.Warningf("ignoring relist signal: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// WatchConfigMap triggers a relist each time the RelistAnnotation on the given ConfigMap
+// changes, until the stop channel is closed.
+func (t *RelistTrigger) WatchConfigMap(client dynamic.Interface, namespace, name string, stopChan <-chan struct{}) {
+	resClient := client.Resource(configMapResource).Namespace(namespace)
+	nameSelector := fields.OneTermEqualSelector("metadata.name", name).String()
+	lw := &cache.ListWatch{
+		ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+			opts.FieldSelector = nameSelector
+			return resClient.List(opts)
+		},
+		WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+			opts.FieldSelector = nameSelector
+			return resClient.Watch(opts)
+		},
+	}
+	informer := cache.NewSharedIndexInformer(lw, &unstructured.Unstructured{}, 0, cache.Indexers{})
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			// the initial value doesn't request anything, it's just what changes are compared with
+			t.noteConfigMap(obj, false)
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			t.noteConfigMap(obj, true)
+		},
+	})
+	go informer.Run(stopChan)
+}
+
+// noteConfigMap records the value of the RelistAnnotation on the given ConfigMap,
+// triggering a relist if it has changed (and trigger is set).
+func (t *RelistTrigger) noteConfigMap(obj interface{}, trigger bool) {
+	configMap, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	requested := configMap.GetAnnotations()[RelistAnnotation]
+
+	t.mu.Lock()
+	changed := requested != t.lastRequest
+	t.lastRequest = requested
+	t.mu.Unlock()
+
+	if !trigger || !changed || requested == "" {
+		return
+	}
+	if err := t.Trigger(relistSourceConfigMap); err != nil {
+		klog.Warningf("ignoring relist requested by ConfigMap %s/%s: %v", configMap.GetNamespace(), configMap.GetName(), err)
+	}
+}
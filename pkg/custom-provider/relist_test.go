@@ -0,0 +1,103 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	pmodel "github.com/prometheus/common/model"
+)
+
+func TestRelistTriggerRateLimits(t *testing.T) {
+	discovery := &fakeDiscoveryRunner{}
+	trigger := NewRelistTrigger(discovery, time.Minute)
+
+	require.NoError(t, trigger.Trigger(relistSourceSignal))
+	assert.Error(t, trigger.Trigger(relistSourceSignal), "relists within the minimum interval should be rejected")
+	assert.Equal(t, 1, discovery.relists)
+
+	trigger.lastRelist = time.Now().Add(-2 * time.Minute)
+	require.NoError(t, trigger.Trigger(relistSourceSignal), "relists after the minimum interval should be accepted")
+	assert.Equal(t, 2, discovery.relists)
+}
+
+func TestRelistTriggerHTTP(t *testing.T) {
+	discovery := &fakeDiscoveryRunner{}
+	trigger := NewRelistTrigger(discovery, time.Minute)
+
+	resp := httptest.NewRecorder()
+	trigger.ServeHTTP(resp, httptest.NewRequest("GET", "/relist", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.Code, "relists should only be requested with POST")
+
+	resp = httptest.NewRecorder()
+	trigger.ServeHTTP(resp, httptest.NewRequest("POST", "/relist", nil))
+	assert.Equal(t, http.StatusAccepted, resp.Code)
+
+	resp = httptest.NewRecorder()
+	trigger.ServeHTTP(resp, httptest.NewRequest("POST", "/relist", nil))
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code, "relists should be rate-limited")
+	assert.Equal(t, 1, discovery.relists)
+}
+
+func TestRelistTriggerConfigMap(t *testing.T) {
+	discovery := &fakeDiscoveryRunner{}
+	trigger := NewRelistTrigger(discovery, 0)
+	configMap := func(requested string) *unstructured.Unstructured {
+		obj := &unstructured.Unstructured{}
+		obj.SetNamespace("monitoring")
+		obj.SetName("adapter-relist")
+		if requested != "" {
+			obj.SetAnnotations(map[string]string{RelistAnnotation: requested})
+		}
+		return obj
+	}
+
+	trigger.noteConfigMap(configMap("2018-07-01T10:00:00Z"), false)
+	assert.Equal(t, 0, discovery.relists, "the initial annotation should not trigger a relist")
+
+	trigger.noteConfigMap(configMap("2018-07-01T10:00:00Z"), true)
+	assert.Equal(t, 0, discovery.relists, "unrelated changes should not trigger a relist")
+
+	trigger.noteConfigMap(configMap("2018-07-01T11:00:00Z"), true)
+	assert.Equal(t, 1, discovery.relists, "changing the annotation should trigger a relist")
+
+	trigger.noteConfigMap(configMap(""), true)
+	assert.Equal(t, 1, discovery.relists, "removing the annotation should not trigger a relist")
+}
+
+func TestCachingMetricsListerRelist(t *testing.T) {
+	prov, fakeProm := setupPrometheusProvider(t)
+	fakeProm.acceptibleInterval = pmodel.Interval{Start: 0, End: pmodel.Latest}
+	lister := prov.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
+	lister.updateInterval = time.Hour
+
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	lister.RunUntil(stopChan)
+	require.True(t, waitFor(func() bool { return !lister.LastDiscovery().IsZero() }), "metrics should be discovered on startup")
+
+	firstDiscovery := lister.LastDiscovery()
+	lister.Relist()
+	assert.True(t, waitFor(func() bool { return lister.LastDiscovery().After(firstDiscovery) }), "metrics should be relisted on request, without waiting for the interval")
+}
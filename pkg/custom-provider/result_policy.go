@@ -0,0 +1,163 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+	pmodel "github.com/prometheus/common/model"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/config"
+)
+
+var (
+	// duplicateResults counts query results which were reduced into the result for
+	// another object, since they refer to the same object.
+	duplicateResults = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cmgateway_duplicate_results_total",
+			Help: "Number of extra query results for objects which already had a result.  Broken down by metric",
+		},
+		[]string{"metric"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(duplicateResults)
+}
+
+// ResultPolicy determines how unusual query results are handled, and how results
+// are presented.  The zero value drops non-finite results, leaves objects without
+// results missing, and presents results as plain decimal numbers.
+type ResultPolicy struct {
+	nonFinite    config.NonFiniteAction
+	missingValue *pmodel.SampleValue
+	duplicates   config.DuplicateAction
+	converter    *ValueConverter
+}
+
+// NewResultPolicy constructs a ResultPolicy from the given configuration, which may be
+// nil, presenting results with the given converter (or the default one, if it's nil).
+func NewResultPolicy(cfg *config.ResultPolicy, converter *ValueConverter) (ResultPolicy, error) {
+	policy := ResultPolicy{nonFinite: config.NonFiniteDrop, duplicates: config.DuplicateFirst, converter: converter}
+	if cfg == nil {
+		return policy, nil
+	}
+
+	switch cfg.NonFinite {
+	case "":
+	case config.NonFiniteDrop, config.NonFiniteClamp, config.NonFiniteError:
+		policy.nonFinite = cfg.NonFinite
+	default:
+		return ResultPolicy{}, fmt.Errorf("unknown non-finite result action %q, must be one of %q, %q, or %q", cfg.NonFinite, config.NonFiniteDrop, config.NonFiniteClamp, config.NonFiniteError)
+	}
+
+	switch cfg.Duplicates {
+	case "":
+	case config.DuplicateFirst, config.DuplicateSum, config.DuplicateMax, config.DuplicateMin, config.DuplicateAvg, config.DuplicateError:
+		policy.duplicates = cfg.Duplicates
+	default:
+		return ResultPolicy{}, fmt.Errorf("unknown duplicate result action %q, must be one of %q, %q, %q, %q, %q, or %q", cfg.Duplicates, config.DuplicateFirst, config.DuplicateSum, config.DuplicateMax, config.DuplicateMin, config.DuplicateAvg, config.DuplicateError)
+	}
+
+	if cfg.MissingValue != nil {
+		missing := pmodel.SampleValue(*cfg.MissingValue)
+		if math.IsNaN(*cfg.MissingValue) || math.Abs(*cfg.MissingValue) > policy.valueConverter().MaxValue() {
+			return ResultPolicy{}, fmt.Errorf("missing value %v cannot be presented in the API", *cfg.MissingValue)
+		}
+		policy.missingValue = &missing
+	}
+
+	return policy, nil
+}
+
+// valueConverter returns the converter used to present results.
+func (p ResultPolicy) valueConverter() *ValueConverter {
+	if p.converter == nil {
+		return defaultValueConverter
+	}
+	return p.converter
+}
+
+// Reduce reduces the given (non-empty) results for a single object, which should be
+// in order of their labels, to a single result.  An error is returned if there are
+// several results, and the policy is to fail such requests.
+func (p ResultPolicy) Reduce(values []pmodel.SampleValue) (pmodel.SampleValue, error) {
+	if len(values) == 1 {
+		return values[0], nil
+	}
+
+	res := values[0]
+	switch p.duplicates {
+	case config.DuplicateSum, config.DuplicateAvg:
+		for _, value := range values[1:] {
+			res += value
+		}
+		if p.duplicates == config.DuplicateAvg {
+			res /= pmodel.SampleValue(len(values))
+		}
+	case config.DuplicateMax:
+		for _, value := range values[1:] {
+			res = pmodel.SampleValue(math.Max(float64(res), float64(value)))
+		}
+	case config.DuplicateMin:
+		for _, value := range values[1:] {
+			res = pmodel.SampleValue(math.Min(float64(res), float64(value)))
+		}
+	case config.DuplicateError:
+		return 0, fmt.Errorf("%v results for the same object", len(values))
+	}
+	return res, nil
+}
+
+// Value applies the policy to the result for an object, if one was found.  It returns
+// the value to present, and whether or not there is a value to present.  An error is
+// returned if the result is non-finite and the policy is to fail such requests.
+func (p ResultPolicy) Value(value pmodel.SampleValue, found bool) (pmodel.SampleValue, bool, error) {
+	if found {
+		rawValue := float64(value)
+		switch {
+		case !math.IsNaN(rawValue) && !math.IsInf(rawValue, 0):
+			return value, true, nil
+		case p.nonFinite == config.NonFiniteClamp:
+			if math.IsNaN(rawValue) {
+				return 0, true, nil
+			}
+			if rawValue > 0 {
+				return pmodel.SampleValue(p.valueConverter().MaxValue()), true, nil
+			}
+			return pmodel.SampleValue(-p.valueConverter().MaxValue()), true, nil
+		case p.nonFinite == config.NonFiniteError:
+			return 0, false, fmt.Errorf("non-finite result %v", value)
+		}
+		// otherwise, drop the value, and treat it as missing
+	}
+
+	if p.missingValue != nil {
+		return *p.missingValue, true, nil
+	}
+	return 0, false, nil
+}
+
+// Quantity presents the given result (which should be the value returned by Value)
+// as a quantity.  It returns an error if the result is too large to be presented.
+func (p ResultPolicy) Quantity(value pmodel.SampleValue) (*resource.Quantity, error) {
+	return p.valueConverter().Quantity(value)
+}
@@ -0,0 +1,349 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+
+	"github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/config"
+)
+
+var (
+	// RuleGroupVersion is the group-version of the discovery rule custom resources.
+	RuleGroupVersion = schema.GroupVersion{Group: "custom-metrics.kairosinc.com", Version: "v1alpha1"}
+
+	// NamespacedRuleResource is the resource for namespaced discovery rules (MetricsDiscoveryRule).
+	NamespacedRuleResource = RuleGroupVersion.WithResource("metricsdiscoveryrules")
+	// ClusterRuleResource is the resource for cluster-scoped discovery rules (ClusterMetricsDiscoveryRule).
+	ClusterRuleResource = RuleGroupVersion.WithResource("clustermetricsdiscoveryrules")
+)
+
+const (
+	// RuleConditionCompiled indicates whether or not the rule in a discovery rule
+	// object could be turned into a MetricNamer.
+	RuleConditionCompiled = "Compiled"
+
+	ruleReasonCompiled      = "RuleCompiled"
+	ruleReasonCompileFailed = "CompileFailed"
+)
+
+// compiledRule is a discovery rule object that has been turned into a namer.
+type compiledRule struct {
+	// key is the namespace/name key of the object
+	key string
+	// resource is the resource (namespaced or cluster) that the object came from
+	resource schema.GroupVersionResource
+	// uid and generation identify the version of the spec this was compiled from
+	uid        types.UID
+	generation int64
+
+	// namer is the compiled namer, or nil if the rule failed to compile
+	namer MetricNamer
+	// err is the compilation error, if any
+	err error
+}
+
+// RuleResourceSource is a NamerSource which produces namers from discovery
+// rule custom resources (both MetricsDiscoveryRule and ClusterMetricsDiscoveryRule).
+// Objects are watched with informers, and compiled lazily on discovery.  After
+// each discovery run, the status of each object is updated to reflect whether
+// it compiled and how many metrics it currently exposes.
+type RuleResourceSource struct {
+	client  dynamic.Interface
+	mapper  apimeta.RESTMapper
+	lookups *ObjectLookupCache
+	// queryDefaults are applied to each rule before it's compiled
+	queryDefaults config.QueryDefaults
+
+	informers map[schema.GroupVersionResource]cache.SharedIndexInformer
+
+	mu sync.Mutex
+	// compiled caches compiled rules by object key, so that namers (and their
+	// label caches) survive across discovery runs
+	compiled map[schema.GroupVersionResource]map[string]*compiledRule
+	// lastRules is the set of rules (compiled or not) seen during the last call to Namers
+	lastRules []*compiledRule
+}
+
+// NewRuleResourceSource constructs a new RuleResourceSource which watches discovery rule
+// objects using the given dynamic client.  Rules which look up objects by label value use
+// the given lookup cache, and all rules use the given query defaults.  The source must be
+// started with Run or RunUntil.
+func NewRuleResourceSource(client dynamic.Interface, mapper apimeta.RESTMapper, lookups *ObjectLookupCache, queryDefaults config.QueryDefaults, resyncPeriod time.Duration) *RuleResourceSource {
+	src := &RuleResourceSource{
+		client:        client,
+		mapper:        mapper,
+		lookups:       lookups,
+		queryDefaults: queryDefaults,
+		informers:     make(map[schema.GroupVersionResource]cache.SharedIndexInformer),
+		compiled:      make(map[schema.GroupVersionResource]map[string]*compiledRule),
+	}
+
+	for _, res := range []schema.GroupVersionResource{NamespacedRuleResource, ClusterRuleResource} {
+		resClient := client.Resource(res)
+		lw := &cache.ListWatch{
+			ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+				return resClient.List(opts)
+			},
+			WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+				return resClient.Watch(opts)
+			},
+		}
+		src.informers[res] = cache.NewSharedIndexInformer(lw, &unstructured.Unstructured{}, resyncPeriod, cache.Indexers{})
+		src.compiled[res] = make(map[string]*compiledRule)
+	}
+
+	return src
+}
+
+func (s *RuleResourceSource) Run() {
+	s.RunUntil(wait.NeverStop)
+}
+
+func (s *RuleResourceSource) RunUntil(stopChan <-chan struct{}) {
+	for _, informer := range s.informers {
+		go informer.Run(stopChan)
+	}
+}
+
+// HasSynced checks if all the underlying informers have completed their initial list.
+func (s *RuleResourceSource) HasSynced() bool {
+	for _, informer := range s.informers {
+		if !informer.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *RuleResourceSource) Namers() []MetricNamer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var namers []MetricNamer
+	var rules []*compiledRule
+
+	// produce namers in a consistent order, so that discovery is stable across runs
+	resources := []schema.GroupVersionResource{ClusterRuleResource, NamespacedRuleResource}
+	for _, res := range resources {
+		objs := s.informers[res].GetStore().List()
+		seen := make(map[string]struct{}, len(objs))
+		resRules := make([]*compiledRule, 0, len(objs))
+
+		for _, rawObj := range objs {
+			obj, ok := rawObj.(*unstructured.Unstructured)
+			if !ok {
+				continue
+			}
+			rule := s.compile(res, obj)
+			seen[rule.key] = struct{}{}
+			resRules = append(resRules, rule)
+		}
+
+		// forget about objects that have gone away
+		for key := range s.compiled[res] {
+			if _, ok := seen[key]; !ok {
+				delete(s.compiled[res], key)
+			}
+		}
+
+		sort.Slice(resRules, func(i, j int) bool { return resRules[i].key < resRules[j].key })
+		for _, rule := range resRules {
+			rules = append(rules, rule)
+			if rule.namer == nil {
+				continue
+			}
+			namers = append(namers, rule.namer)
+		}
+	}
+
+	s.lastRules = rules
+
+	return namers
+}
+
+// compile fetches the cached compiled form of the given object, compiling it
+// if the spec has changed since the last compilation.  It must be called with
+// the lock held.
+func (s *RuleResourceSource) compile(res schema.GroupVersionResource, obj *unstructured.Unstructured) *compiledRule {
+	key := obj.GetName()
+	if obj.GetNamespace() != "" {
+		key = obj.GetNamespace() + "/" + key
+	}
+
+	if existing, ok := s.compiled[res][key]; ok && existing.uid == obj.GetUID() && existing.generation == obj.GetGeneration() {
+		return existing
+	}
+
+	rule := &compiledRule{
+		key:        key,
+		resource:   res,
+		uid:        obj.GetUID(),
+		generation: obj.GetGeneration(),
+	}
+
+	discoveryRule, err := ruleFromObject(obj)
+	if err == nil {
+		// namespaced rule objects may only ever expose metrics for their own namespace
+		if obj.GetNamespace() != "" {
+			discoveryRule.Namespace = obj.GetNamespace()
+		}
+		rule.namer, err = NamerFromRule(s.queryDefaults.ApplyTo(*discoveryRule), s.mapper, s.lookups)
+	}
+	if err != nil {
+		klog.Errorf("unable to compile discovery rule %s %q, skipping: %v", res.Resource, key, err)
+		rule.err = err
+	}
+
+	s.compiled[res][key] = rule
+	return rule
+}
+
+// ruleFromObject extracts the discovery rule from the spec of a discovery rule object.
+func ruleFromObject(obj *unstructured.Unstructured) (*config.DiscoveryRule, error) {
+	spec, found, err := unstructured.NestedMap(obj.Object, "spec")
+	if err != nil {
+		return nil, fmt.Errorf("unable to read rule spec: %v", err)
+	}
+	if !found {
+		return nil, fmt.Errorf("rule has no spec")
+	}
+	specJSON, err := json.Marshal(spec)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read rule spec: %v", err)
+	}
+	return config.RuleFromYAML(specJSON)
+}
+
+// ReportMetricCounts updates the status of each rule object seen during the last
+// call to Namers with its compilation status and number of exposed metrics.
+func (s *RuleResourceSource) ReportMetricCounts(counts map[MetricNamer]int) {
+	s.mu.Lock()
+	rules := s.lastRules
+	s.mu.Unlock()
+
+	for _, rule := range rules {
+		count := 0
+		if rule.namer != nil {
+			count = counts[rule.namer]
+		}
+		if err := s.updateStatus(rule, count); err != nil {
+			// we'll try again after the next discovery run
+			klog.Errorf("unable to update status of discovery rule %s %q: %v", rule.resource.Resource, rule.key, err)
+		}
+	}
+}
+
+// updateStatus writes the status for the given rule, if it has changed.
+func (s *RuleResourceSource) updateStatus(rule *compiledRule, exposedMetrics int) error {
+	rawObj, exists, err := s.informers[rule.resource].GetStore().GetByKey(rule.key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+	obj, ok := rawObj.(*unstructured.Unstructured)
+	if !ok || obj.GetUID() != rule.uid {
+		// the object was replaced since we last looked
+		return nil
+	}
+
+	condition := map[string]interface{}{
+		"type":    RuleConditionCompiled,
+		"status":  string(metav1.ConditionTrue),
+		"reason":  ruleReasonCompiled,
+		"message": "",
+	}
+	if rule.err != nil {
+		condition["status"] = string(metav1.ConditionFalse)
+		condition["reason"] = ruleReasonCompileFailed
+		condition["message"] = rule.err.Error()
+	}
+
+	// keep the transition time if nothing about the condition changed
+	oldConditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	transitionTime := metav1.Now().UTC().Format(time.RFC3339)
+	for _, rawOldCond := range oldConditions {
+		oldCond, ok := rawOldCond.(map[string]interface{})
+		if !ok || oldCond["type"] != RuleConditionCompiled {
+			continue
+		}
+		if oldCond["status"] == condition["status"] {
+			if oldTime, ok := oldCond["lastTransitionTime"].(string); ok {
+				transitionTime = oldTime
+			}
+		}
+	}
+	condition["lastTransitionTime"] = transitionTime
+
+	newStatus := map[string]interface{}{
+		"observedGeneration": rule.generation,
+		"exposedMetrics":     int64(exposedMetrics),
+		"conditions":         []interface{}{condition},
+	}
+	oldStatus, _, _ := unstructured.NestedMap(obj.Object, "status")
+	if reflect.DeepEqual(normalizeJSON(oldStatus), normalizeJSON(newStatus)) {
+		return nil
+	}
+
+	newObj := obj.DeepCopy()
+	if err := unstructured.SetNestedField(newObj.Object, newStatus, "status"); err != nil {
+		return err
+	}
+
+	var client dynamic.ResourceInterface
+	if newObj.GetNamespace() != "" {
+		client = s.client.Resource(rule.resource).Namespace(newObj.GetNamespace())
+	} else {
+		client = s.client.Resource(rule.resource)
+	}
+	_, err = client.UpdateStatus(newObj, metav1.UpdateOptions{})
+	return err
+}
+
+// normalizeJSON round-trips the given value through JSON, so that values from
+// the API server (which decode integers as int64) can be compared with locally
+// constructed values.
+func normalizeJSON(val interface{}) interface{} {
+	raw, err := json.Marshal(val)
+	if err != nil {
+		return val
+	}
+	var res interface{}
+	if err := json.Unmarshal(raw, &res); err != nil {
+		return val
+	}
+	return res
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakedyn "k8s.io/client-go/dynamic/fake"
+
+	cfg "github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/config"
+)
+
+func ruleObject(kind, namespace, name string, spec map[string]interface{}) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": RuleGroupVersion.String(),
+			"kind":       kind,
+			"metadata": map[string]interface{}{
+				"name":       name,
+				"uid":        namespace + "-" + name,
+				"generation": int64(1),
+			},
+			"spec": spec,
+		},
+	}
+	if namespace != "" {
+		obj.SetNamespace(namespace)
+	}
+	return obj
+}
+
+func setupRuleResourceSource(t *testing.T, objs ...*unstructured.Unstructured) (*RuleResourceSource, *fakedyn.FakeDynamicClient) {
+	rawObjs := make([]runtime.Object, len(objs))
+	for i, obj := range objs {
+		rawObjs[i] = obj
+	}
+	client := fakedyn.NewSimpleDynamicClient(runtime.NewScheme(), rawObjs...)
+	src := NewRuleResourceSource(client, restMapper(), nil, cfg.QueryDefaults{}, 1*time.Minute)
+
+	// populate the informer stores directly, instead of running the informers
+	for _, obj := range objs {
+		res := ClusterRuleResource
+		if obj.GetNamespace() != "" {
+			res = NamespacedRuleResource
+		}
+		require.NoError(t, src.informers[res].GetStore().Add(obj))
+	}
+
+	return src, client
+}
+
+func TestRuleResourceSourceNamers(t *testing.T) {
+	validSpec := map[string]interface{}{
+		"seriesQuery":  `{__name__="http_requests_total",namespace!=""}`,
+		"resources":    map[string]interface{}{"template": "<<.Resource>>"},
+		"name":         map[string]interface{}{"matches": "^(.*)_total$"},
+		"metricsQuery": "sum(rate(<<.Series>>{<<.LabelMatchers>>}[2m])) by (<<.GroupBy>>)",
+	}
+	invalidSpec := map[string]interface{}{
+		"seriesQuery":  `{__name__="http_requests_total",namespace!=""}`,
+		"name":         map[string]interface{}{"matches": "^(.*)_(.*)$"},
+		"metricsQuery": "sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)",
+	}
+
+	src, _ := setupRuleResourceSource(t,
+		ruleObject("MetricsDiscoveryRule", "somens", "b-rule", validSpec),
+		ruleObject("MetricsDiscoveryRule", "somens", "a-rule", invalidSpec),
+		ruleObject("ClusterMetricsDiscoveryRule", "", "cluster-rule", validSpec),
+	)
+
+	namers := src.Namers()
+	require.Len(t, namers, 2, "only the rules that compiled should produce namers")
+	assert.Equal(t, []string{"cluster-rule", "somens/a-rule", "somens/b-rule"}, ruleKeys(src.lastRules), "rules should be ordered cluster-scoped first, then by key")
+	assert.Error(t, src.lastRules[1].err, "the rule with ambiguous captures should have failed to compile")
+
+	// an unchanged object should keep its namer across calls
+	assert.Equal(t, namers, src.Namers(), "unchanged rules should not be recompiled")
+}
+
+func TestRuleResourceSourceStatus(t *testing.T) {
+	spec := map[string]interface{}{
+		"seriesQuery":  `{__name__="http_requests_total",namespace!=""}`,
+		"resources":    map[string]interface{}{"template": "<<.Resource>>"},
+		"metricsQuery": "sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)",
+	}
+	src, client := setupRuleResourceSource(t, ruleObject("ClusterMetricsDiscoveryRule", "", "cluster-rule", spec))
+
+	namers := src.Namers()
+	require.Len(t, namers, 1)
+	src.ReportMetricCounts(map[MetricNamer]int{namers[0]: 3})
+
+	updated, err := client.Resource(ClusterRuleResource).Get("cluster-rule", metav1.GetOptions{})
+	require.NoError(t, err)
+
+	exposed, _, err := unstructured.NestedInt64(updated.Object, "status", "exposedMetrics")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), exposed, "status should report the number of exposed metrics")
+
+	conditions, _, err := unstructured.NestedSlice(updated.Object, "status", "conditions")
+	require.NoError(t, err)
+	require.Len(t, conditions, 1)
+	assert.Equal(t, RuleConditionCompiled, conditions[0].(map[string]interface{})["type"])
+	assert.Equal(t, "True", conditions[0].(map[string]interface{})["status"])
+}
+
+func ruleKeys(rules []*compiledRule) []string {
+	keys := make([]string, len(rules))
+	for i, rule := range rules {
+		keys[i] = rule.key
+	}
+	return keys
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	prom "github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/client"
+	"github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/config"
+)
+
+// mergeSourceLabel is the label used to keep the results of different series
+// apart until they are summed.
+const mergeSourceLabel = "adapter_merge_source"
+
+// SeriesMerger combines the queries for several series backing the same metric
+// into a single query.
+type SeriesMerger struct {
+	strategy config.MergeStrategy
+	order    []*regexp.Regexp
+}
+
+// NewSeriesMerger constructs a SeriesMerger from the given configuration.
+func NewSeriesMerger(cfg config.SeriesMerge) (*SeriesMerger, error) {
+	merger := &SeriesMerger{
+		strategy: cfg.Strategy,
+		order:    make([]*regexp.Regexp, len(cfg.Order)),
+	}
+
+	switch merger.strategy {
+	case "":
+		merger.strategy = config.MergeFirst
+	case config.MergeFirst, config.MergeOr, config.MergeSum:
+	default:
+		return nil, fmt.Errorf("unknown merge strategy %q, must be one of %q, %q, or %q", cfg.Strategy, config.MergeFirst, config.MergeOr, config.MergeSum)
+	}
+
+	for i, expr := range cfg.Order {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("unable to compile merge order expression %q: %v", expr, err)
+		}
+		merger.order[i] = re
+	}
+
+	return merger, nil
+}
+
+// rank returns the preference of the given series name, with lower ranks
+// being more preferred.
+func (m *SeriesMerger) rank(series string) int {
+	for i, re := range m.order {
+		if re.MatchString(series) {
+			return i
+		}
+	}
+	return len(m.order)
+}
+
+// Less checks if the series with the given name is preferred over the other series.
+func (m *SeriesMerger) Less(series, other string) bool {
+	seriesRank, otherRank := m.rank(series), m.rank(other)
+	if seriesRank != otherRank {
+		return seriesRank < otherRank
+	}
+	return series < other
+}
+
+// Merge combines the given queries, which should be in order of preference,
+// into a single query.
+func (m *SeriesMerger) Merge(queries []prom.Selector) prom.Selector {
+	if len(queries) == 1 {
+		return queries[0]
+	}
+
+	parts := make([]string, len(queries))
+	switch m.strategy {
+	case config.MergeOr:
+		for i, query := range queries {
+			parts[i] = "(" + string(query) + ")"
+		}
+		return prom.Selector(strings.Join(parts, " or "))
+	case config.MergeSum:
+		for i, query := range queries {
+			parts[i] = fmt.Sprintf("label_replace(%s, %q, %q, \"\", \"\")", query, mergeSourceLabel, strconv.Itoa(i))
+		}
+		return prom.Selector(fmt.Sprintf("sum without(%s) (%s)", mergeSourceLabel, strings.Join(parts, " or ")))
+	default:
+		// each series is only used if none of the preceding series have any results
+		wrapped := make([]string, len(queries))
+		for i, query := range queries {
+			wrapped[i] = "(" + string(query) + ")"
+		}
+		parts[0] = wrapped[0]
+		for i := 1; i < len(queries); i++ {
+			parts[i] = fmt.Sprintf("(%s unless on() (%s))", wrapped[i], strings.Join(wrapped[:i], " or "))
+		}
+		return prom.Selector(strings.Join(parts, " or "))
+	}
+}
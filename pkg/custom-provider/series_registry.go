@@ -18,14 +18,18 @@ package provider
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 
 	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 
 	prom "github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/client"
-	"github.com/golang/glog"
 	pmodel "github.com/prometheus/common/model"
+	"k8s.io/klog"
 )
 
 // NB: container metrics sourced from cAdvisor don't consistently follow naming conventions,
@@ -49,18 +53,84 @@ type SeriesRegistry interface {
 	// ListAllMetrics lists all metrics known to this registry
 	ListAllMetrics() []provider.CustomMetricInfo
 	// SeriesForMetric looks up the minimum required series information to make a query for the given metric
-	// against the given resource (namespace may be empty for non-namespaced resources)
-	QueryForMetric(info provider.CustomMetricInfo, namespace string, resourceNames ...string) (query prom.Selector, found bool)
-	// MatchValuesToNames matches result values to resource names for the given metric and value set
-	MatchValuesToNames(metricInfo provider.CustomMetricInfo, values pmodel.Vector) (matchedValues map[string]pmodel.SampleValue, found bool)
+	// against the given resource (namespace may be empty for non-namespaced resources), restricted to the
+	// series matching the given metric selector.  The label selector of the request (which may be empty) is
+	// made available to the query.
+	QueryForMetric(info provider.CustomMetricInfo, namespace string, selector labels.Selector, metricSelector labels.Selector, resourceNames ...string) (query prom.Selector, found bool)
+	// MatchValuesToNames matches result values to objects for the given metric, namespace (which
+	// may be empty for non-namespaced resources, or requests across all namespaces), and value set.
+	// Values are keyed by namespace (when known) and name, so that objects with the same name in
+	// different namespaces are kept apart.  If several values refer to the same object, they're
+	// all returned, in order of their labels.
+	MatchValuesToNames(metricInfo provider.CustomMetricInfo, namespace string, values pmodel.Vector) (matchedValues map[types.NamespacedName][]pmodel.SampleValue, found bool)
+	// MetricCountsByNamer returns the number of metrics currently registered by each namer
+	MetricCountsByNamer() map[MetricNamer]int
+	// DeprecatedAliasFor checks if the given metric, in the given namespace (which may be
+	// empty for non-namespaced resources), is a deprecated alias for another metric,
+	// returning the name of that metric if so
+	DeprecatedAliasFor(metricInfo provider.CustomMetricInfo, namespace string) (target string, deprecated bool)
+	// ResultPolicyFor returns the policy for handling unusual query results, and presenting results, for the given
+	// metric in the given namespace (which may be empty for non-namespaced resources)
+	ResultPolicyFor(metricInfo provider.CustomMetricInfo, namespace string) ResultPolicy
+	// RangeEvaluatorFor returns the evaluator used to evaluate queries for the given metric
+	// over a window of time, or nil if they should be evaluated at a single instant
+	RangeEvaluatorFor(metricInfo provider.CustomMetricInfo, namespace string) *RangeEvaluator
 }
 
 type seriesInfo struct {
-	// seriesName is the name of the corresponding Prometheus series
-	seriesName string
+	// sources are the Prometheus series backing the metric, in order of
+	// preference.  There is only more than one if the namer merges series.
+	sources []seriesSource
 
 	// namer is the MetricNamer used to name this series
 	namer MetricNamer
+
+	// alias is set if the metric is an alias for another metric
+	alias *seriesAlias
+}
+
+// seriesAlias describes the metric that an alias refers to.
+type seriesAlias struct {
+	// target is the name of the metric that the alias refers to
+	target string
+	// deprecated indicates that the alias should no longer be used
+	deprecated bool
+}
+
+// seriesSource identifies a single Prometheus series backing a metric.
+type seriesSource struct {
+	// seriesName is the name of the corresponding Prometheus series
+	seriesName string
+	// seriesLabels are the labels of the series that the metric name depends on
+	seriesLabels pmodel.LabelSet
+}
+
+// equal checks if the two sources refer to the same series.
+func (s seriesSource) equal(other seriesSource) bool {
+	return s.seriesName == other.seriesName && s.seriesLabels.Equal(other.seriesLabels)
+}
+
+// withSource returns a copy of the series info with the given source added in order
+// of the preference given by the merger, unless it's already present.
+func (i seriesInfo) withSource(source seriesSource, merger *SeriesMerger) seriesInfo {
+	for _, existing := range i.sources {
+		if existing.equal(source) {
+			return i
+		}
+	}
+
+	sources := make([]seriesSource, 0, len(i.sources)+1)
+	sources = append(sources, i.sources...)
+	sources = append(sources, source)
+	sort.SliceStable(sources, func(a, b int) bool {
+		if sources[a].seriesName != sources[b].seriesName {
+			return merger.Less(sources[a].seriesName, sources[b].seriesName)
+		}
+		return sources[a].seriesLabels.Before(sources[b].seriesLabels)
+	})
+
+	i.sources = sources
+	return i
 }
 
 // overridableSeriesRegistry is a basic SeriesRegistry
@@ -69,10 +139,19 @@ type basicSeriesRegistry struct {
 
 	// info maps metric info to information about the corresponding series
 	info map[provider.CustomMetricInfo]seriesInfo
+	// namespacedInfo maps namespaces to metric info for series from namers
+	// restricted to that namespace.  These take precedence over info when
+	// querying in the corresponding namespace.
+	namespacedInfo map[string]map[provider.CustomMetricInfo]seriesInfo
 	// metrics is the list of all known metrics
 	metrics []provider.CustomMetricInfo
+	// namerCounts is the number of known metrics produced by each namer
+	namerCounts map[MetricNamer]int
 
 	mapper apimeta.RESTMapper
+
+	// changes records the metrics added and removed by each update, if non-nil
+	changes *DiscoveryChangeLog
 }
 
 func (r *basicSeriesRegistry) SetSeries(newSeriesSlices [][]prom.Series, namers []MetricNamer) error {
@@ -81,16 +160,48 @@ func (r *basicSeriesRegistry) SetSeries(newSeriesSlices [][]prom.Series, namers
 	}
 
 	newInfo := make(map[provider.CustomMetricInfo]seriesInfo)
+	newNamespacedInfo := make(map[string]map[provider.CustomMetricInfo]seriesInfo)
 	for i, newSeries := range newSeriesSlices {
 		namer := namers[i]
+
+		targetInfo := newInfo
+		var namespaceLbl pmodel.LabelName
+		restrictedNS := namer.Namespace()
+		if restrictedNS != "" {
+			var err error
+			namespaceLbl, err = namer.LabelForResource(nsGroupResource)
+			if err != nil {
+				klog.Errorf("unable to determine namespace label for rule restricted to namespace %q, skipping: %v", restrictedNS, err)
+				continue
+			}
+			if newNamespacedInfo[restrictedNS] == nil {
+				newNamespacedInfo[restrictedNS] = make(map[provider.CustomMetricInfo]seriesInfo)
+			}
+			targetInfo = newNamespacedInfo[restrictedNS]
+		}
+
 		for _, series := range newSeries {
+			// namespace-restricted rules may not see series from other namespaces
+			if restrictedNS != "" && string(series.Labels[namespaceLbl]) != restrictedNS {
+				klog.V(6).Infof("ignoring series %q outside of namespace %q", series.String(), restrictedNS)
+				continue
+			}
+
 			// TODO: warn if it doesn't match any resources
 			resources, namespaced := namer.ResourcesForSeries(series)
 			name, err := namer.MetricNameForSeries(series)
 			if err != nil {
-				glog.Errorf("unable to name series %q, skipping: %v", series.String(), err)
+				klog.Errorf("unable to name series %q, skipping: %v", series.String(), err)
 				continue
 			}
+			aliases, err := namer.MetricAliasesForSeries(series)
+			if err != nil {
+				klog.Errorf("unable to produce aliases for series %q, skipping aliases: %v", series.String(), err)
+			}
+			source := seriesSource{
+				seriesName:   series.Name,
+				seriesLabels: namer.SeriesLabelsForName(series),
+			}
 			for _, resource := range resources {
 				info := provider.CustomMetricInfo{
 					GroupResource: resource,
@@ -103,10 +214,17 @@ func (r *basicSeriesRegistry) SetSeries(newSeriesSlices [][]prom.Series, namers
 					info.Namespaced = false
 				}
 
+				// namespace-restricted rules may only expose metrics on namespaced resources
+				if restrictedNS != "" && !isNamespacedResource(r.mapper, resource) {
+					continue
+				}
+
 				// we don't need to re-normalize, because the metric namer should have already normalized for us
-				newInfo[info] = seriesInfo{
-					seriesName: series.Name,
-					namer:      namer,
+				addSeriesSource(targetInfo, info, source, namer, nil)
+				for _, alias := range aliases {
+					aliasInfo := info
+					aliasInfo.Metric = alias.Name
+					addSeriesSource(targetInfo, aliasInfo, source, namer, &seriesAlias{target: name, deprecated: alias.Deprecated})
 				}
 			}
 		}
@@ -114,19 +232,115 @@ func (r *basicSeriesRegistry) SetSeries(newSeriesSlices [][]prom.Series, namers
 
 	// regenerate metrics
 	newMetrics := make([]provider.CustomMetricInfo, 0, len(newInfo))
-	for info := range newInfo {
+	newCounts := make(map[MetricNamer]int, len(namers))
+	for info, seriesInfo := range newInfo {
 		newMetrics = append(newMetrics, info)
+		if seriesInfo.alias == nil {
+			newCounts[seriesInfo.namer]++
+		}
+	}
+	// the same metric may be exposed in several namespaces, but should only be listed once
+	listed := make(map[provider.CustomMetricInfo]struct{})
+	for _, nsInfo := range newNamespacedInfo {
+		for info, seriesInfo := range nsInfo {
+			if seriesInfo.alias == nil {
+				newCounts[seriesInfo.namer]++
+			}
+			if _, ok := newInfo[info]; ok {
+				continue
+			}
+			if _, ok := listed[info]; ok {
+				continue
+			}
+			listed[info] = struct{}{}
+			newMetrics = append(newMetrics, info)
+		}
 	}
 
 	r.mu.Lock()
-	defer r.mu.Unlock()
-
+	oldInfo, oldNamespacedInfo, oldMetrics := r.info, r.namespacedInfo, r.metrics
 	r.info = newInfo
+	r.namespacedInfo = newNamespacedInfo
 	r.metrics = newMetrics
+	r.namerCounts = newCounts
+	r.mu.Unlock()
+
+	// everything is new the first time around, which isn't worth reporting
+	if oldInfo == nil {
+		klog.Infof("discovered %d available metrics", len(newMetrics))
+		return nil
+	}
+	change := diffMetrics(oldMetrics, newMetrics, func(info provider.CustomMetricInfo) []string {
+		return backingSeries(oldInfo, oldNamespacedInfo, info)
+	}, func(info provider.CustomMetricInfo) []string {
+		return backingSeries(newInfo, newNamespacedInfo, info)
+	})
+	if r.changes != nil && (len(change.Added) > 0 || len(change.Removed) > 0) {
+		r.changes.Record(change)
+	}
 
 	return nil
 }
 
+// backingSeries describes the series backing the given metric, in any namespace.
+func backingSeries(info map[provider.CustomMetricInfo]seriesInfo, namespacedInfo map[string]map[provider.CustomMetricInfo]seriesInfo, metricInfo provider.CustomMetricInfo) []string {
+	var series []string
+	seen := make(map[string]struct{})
+	addSeries := func(seriesInfo seriesInfo, found bool) {
+		if !found {
+			return
+		}
+		for _, source := range seriesInfo.sources {
+			name := source.seriesName
+			if len(source.seriesLabels) > 0 {
+				name += source.seriesLabels.String()
+			}
+			if _, ok := seen[name]; ok {
+				continue
+			}
+			seen[name] = struct{}{}
+			series = append(series, name)
+		}
+	}
+
+	seriesInfo, found := info[metricInfo]
+	addSeries(seriesInfo, found)
+	for _, nsInfo := range namespacedInfo {
+		seriesInfo, found := nsInfo[metricInfo]
+		addSeries(seriesInfo, found)
+	}
+	sort.Strings(series)
+	return series
+}
+
+// addSeriesSource records that the given series backs the given metric.  Metrics
+// with the same name take precedence over aliases.
+func addSeriesSource(targetInfo map[provider.CustomMetricInfo]seriesInfo, info provider.CustomMetricInfo, source seriesSource, namer MetricNamer, alias *seriesAlias) {
+	existing, exists := targetInfo[info]
+	if exists && (existing.alias == nil) != (alias == nil) {
+		if alias != nil {
+			klog.V(2).Infof("ignoring alias %s for %q, since a metric with the same name exists", info.String(), alias.target)
+			return
+		}
+		klog.V(2).Infof("replacing alias %s for %q, since a metric with the same name exists", info.String(), existing.alias.target)
+		exists = false
+	}
+
+	if merger := namer.Merger(); merger != nil && exists && existing.namer == namer {
+		targetInfo[info] = existing.withSource(source, merger)
+		return
+	}
+	if exists && existing.namer == namer && !existing.sources[0].equal(source) {
+		klog.V(2).Infof("series %s%s and %s%s both produce metric %s, using the latter", existing.sources[0].seriesName, existing.sources[0].seriesLabels, source.seriesName, source.seriesLabels, info.String())
+	}
+
+	targetInfo[info] = seriesInfo{
+		sources: []seriesSource{source},
+		namer:   namer,
+		alias:   alias,
+	}
+}
+
 func (r *basicSeriesRegistry) ListAllMetrics() []provider.CustomMetricInfo {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
@@ -134,65 +348,169 @@ func (r *basicSeriesRegistry) ListAllMetrics() []provider.CustomMetricInfo {
 	return r.metrics
 }
 
-func (r *basicSeriesRegistry) QueryForMetric(metricInfo provider.CustomMetricInfo, namespace string, resourceNames ...string) (prom.Selector, bool) {
+func (r *basicSeriesRegistry) MetricCountsByNamer() map[MetricNamer]int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.namerCounts
+}
+
+func (r *basicSeriesRegistry) QueryForMetric(metricInfo provider.CustomMetricInfo, namespace string, selector labels.Selector, metricSelector labels.Selector, resourceNames ...string) (prom.Selector, bool) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
 	if len(resourceNames) == 0 {
-		glog.Errorf("no resource names requested while producing a query for metric %s", metricInfo.String())
+		klog.Errorf("no resource names requested while producing a query for metric %s", metricInfo.String())
 		return "", false
 	}
 
 	metricInfo, _, err := metricInfo.Normalized(r.mapper)
 	if err != nil {
-		glog.Errorf("unable to normalize group resource while producing a query: %v", err)
+		klog.Errorf("unable to normalize group resource while producing a query: %v", err)
 		return "", false
 	}
 
-	info, infoFound := r.info[metricInfo]
+	info, infoFound := r.seriesInfoFor(metricInfo, namespace)
 	if !infoFound {
-		glog.V(10).Infof("metric %v not registered", metricInfo)
+		klog.V(10).Infof("metric %v not registered", metricInfo)
 		return "", false
 	}
 
-	query, err := info.namer.QueryForSeries(info.seriesName, metricInfo.GroupResource, namespace, resourceNames...)
+	queries := make([]prom.Selector, len(info.sources))
+	for i, source := range info.sources {
+		query, err := info.namer.QueryForSeries(source.seriesName, source.seriesLabels, metricInfo.GroupResource, namespace, selector, metricSelector, resourceNames...)
+		if err != nil {
+			klog.Errorf("unable to construct query for metric %s from series %s: %v", metricInfo.String(), source.seriesName, err)
+			return "", false
+		}
+		queries[i] = query
+	}
+
+	if len(queries) == 1 {
+		return queries[0], true
+	}
+	return info.namer.Merger().Merge(queries), true
+}
+
+func (r *basicSeriesRegistry) DeprecatedAliasFor(metricInfo provider.CustomMetricInfo, namespace string) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	metricInfo, _, err := metricInfo.Normalized(r.mapper)
 	if err != nil {
-		glog.Errorf("unable to construct query for metric %s: %v", metricInfo.String(), err)
 		return "", false
 	}
 
-	return query, true
+	info, infoFound := r.seriesInfoFor(metricInfo, namespace)
+	if !infoFound || info.alias == nil || !info.alias.deprecated {
+		return "", false
+	}
+	return info.alias.target, true
 }
 
-func (r *basicSeriesRegistry) MatchValuesToNames(metricInfo provider.CustomMetricInfo, values pmodel.Vector) (matchedValues map[string]pmodel.SampleValue, found bool) {
+func (r *basicSeriesRegistry) ResultPolicyFor(metricInfo provider.CustomMetricInfo, namespace string) ResultPolicy {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
 	metricInfo, _, err := metricInfo.Normalized(r.mapper)
 	if err != nil {
-		glog.Errorf("unable to normalize group resource while matching values to names: %v", err)
-		return nil, false
+		return ResultPolicy{}
 	}
 
-	info, infoFound := r.info[metricInfo]
+	info, infoFound := r.seriesInfoFor(metricInfo, namespace)
 	if !infoFound {
-		return nil, false
+		return ResultPolicy{}
 	}
+	return info.namer.ResultPolicy()
+}
 
-	resourceLbl, err := info.namer.LabelForResource(metricInfo.GroupResource)
+func (r *basicSeriesRegistry) RangeEvaluatorFor(metricInfo provider.CustomMetricInfo, namespace string) *RangeEvaluator {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	metricInfo, _, err := metricInfo.Normalized(r.mapper)
 	if err != nil {
-		glog.Errorf("unable to construct resource label for metric %s: %v", metricInfo.String(), err)
+		return nil
+	}
+
+	info, infoFound := r.seriesInfoFor(metricInfo, namespace)
+	if !infoFound {
+		return nil
+	}
+	return info.namer.RangeEvaluator()
+}
+
+func (r *basicSeriesRegistry) MatchValuesToNames(metricInfo provider.CustomMetricInfo, namespace string, values pmodel.Vector) (matchedValues map[types.NamespacedName][]pmodel.SampleValue, found bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	metricInfo, _, err := metricInfo.Normalized(r.mapper)
+	if err != nil {
+		klog.Errorf("unable to normalize group resource while matching values to names: %v", err)
+		return nil, false
+	}
+
+	info, infoFound := r.seriesInfoFor(metricInfo, namespace)
+	if !infoFound {
 		return nil, false
 	}
 
-	res := make(map[string]pmodel.SampleValue, len(values))
+	// order the values by their labels, so that duplicates are always reduced in the same order
+	sortedValues := make(pmodel.Vector, 0, len(values))
 	for _, val := range values {
-		if val == nil {
-			// skip empty values
+		// skip empty values
+		if val != nil {
+			sortedValues = append(sortedValues, val)
+		}
+	}
+	sort.SliceStable(sortedValues, func(i, j int) bool {
+		return sortedValues[i].Metric.Before(sortedValues[j].Metric)
+	})
+
+	res := make(map[types.NamespacedName][]pmodel.SampleValue, len(sortedValues))
+	for _, val := range sortedValues {
+		object, ok := info.namer.ObjectForLabels(metricInfo.GroupResource, namespace, val.Metric)
+		if !ok {
+			klog.V(6).Infof("unable to determine %s in namespace %q for result %s, skipping", metricInfo.GroupResource.String(), namespace, val.Metric.String())
 			continue
 		}
-		res[string(val.Metric[resourceLbl])] = val.Value
+		res[object] = append(res[object], val.Value)
 	}
 
 	return res, true
 }
+
+// seriesInfoFor looks up the series information for the given (normalized) metric
+// in the given namespace, preferring series from namers restricted to that namespace.
+// It must be called with at least a read lock held.
+func (r *basicSeriesRegistry) seriesInfoFor(metricInfo provider.CustomMetricInfo, namespace string) (seriesInfo, bool) {
+	if namespace != "" {
+		if info, found := r.namespacedInfo[namespace][metricInfo]; found {
+			return info, true
+		}
+	}
+
+	info, found := r.info[metricInfo]
+	if !found && namespace == "" && !metricInfo.Namespaced && metricInfo.GroupResource != nsGroupResource {
+		// requests across all namespaces for namespaced objects use the series with namespaces
+		namespacedInfo := metricInfo
+		namespacedInfo.Namespaced = true
+		info, found = r.info[namespacedInfo]
+	}
+	return info, found
+}
+
+// isNamespacedResource checks if the given group-resource refers to namespaced objects.
+func isNamespacedResource(mapper apimeta.RESTMapper, resource schema.GroupResource) bool {
+	kind, err := mapper.KindFor(resource.WithVersion(""))
+	if err != nil {
+		klog.Errorf("unable to determine the kind of resource %s: %v", resource.String(), err)
+		return false
+	}
+	mapping, err := mapper.RESTMapping(kind.GroupKind(), kind.Version)
+	if err != nil {
+		klog.Errorf("unable to determine the scope of resource %s: %v", resource.String(), err)
+		return false
+	}
+	return mapping.Scope.Name() == apimeta.RESTScopeNameNamespace
+}
@@ -17,7 +17,9 @@ limitations under the License.
 package provider
 
 import (
+	"regexp"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -28,10 +30,16 @@ import (
 	coreapi "k8s.io/api/core/v1"
 	extapi "k8s.io/api/extensions/v1beta1"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	fakedyn "k8s.io/client-go/dynamic/fake"
 
 	config "github.com/kairosinc/custom-metrics-prometheus-adapter/cmd/config-gen/utils"
 	prom "github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/client"
+	cfg "github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/config"
 )
 
 // restMapper creates a RESTMapper with just the types we need for
@@ -53,7 +61,7 @@ func restMapper() apimeta.RESTMapper {
 
 func setupMetricNamer(t testing.TB) []MetricNamer {
 	cfg := config.DefaultConfig(1*time.Minute, "kube_")
-	namers, err := NamersFromConfig(cfg, restMapper())
+	namers, err := NamersFromConfig(cfg, restMapper(), nil)
 	require.NoError(t, err)
 	return namers
 }
@@ -131,10 +139,11 @@ func TestSeriesRegistry(t *testing.T) {
 
 	// make sure each metric got registered and can form queries
 	testCases := []struct {
-		title         string
-		info          provider.CustomMetricInfo
-		namespace     string
-		resourceNames []string
+		title          string
+		info           provider.CustomMetricInfo
+		namespace      string
+		resourceNames  []string
+		metricSelector labels.Selector
 
 		expectedQuery string
 	}{
@@ -188,6 +197,15 @@ func TestSeriesRegistry(t *testing.T) {
 
 			expectedQuery: "sum(rate(ingress_hits_total{kube_namespace=\"somens\",kube_pod=\"somepod\"}[1m])) by (kube_pod)",
 		},
+		{
+			title:          "namespaced metrics counter / metric selector",
+			info:           provider.CustomMetricInfo{schema.GroupResource{Resource: "pod"}, true, "ingress_hits"},
+			namespace:      "somens",
+			resourceNames:  []string{"somepod"},
+			metricSelector: labels.SelectorFromSet(labels.Set{"verb": "GET"}),
+
+			expectedQuery: "sum(rate(ingress_hits_total{kube_namespace=\"somens\",kube_pod=\"somepod\",verb=\"GET\"}[1m])) by (kube_pod)",
+		},
 		{
 			title:         "namespaced metrics gauge",
 			info:          provider.CustomMetricInfo{schema.GroupResource{Resource: "service"}, true, "service_proxy_packets"},
@@ -229,7 +247,11 @@ func TestSeriesRegistry(t *testing.T) {
 	}
 
 	for _, testCase := range testCases {
-		outputQuery, found := registry.QueryForMetric(testCase.info, testCase.namespace, testCase.resourceNames...)
+		metricSelector := testCase.metricSelector
+		if metricSelector == nil {
+			metricSelector = labels.Everything()
+		}
+		outputQuery, found := registry.QueryForMetric(testCase.info, testCase.namespace, labels.Everything(), metricSelector, testCase.resourceNames...)
 		if !assert.True(found, "%s: metric %v should available", testCase.title, testCase.info) {
 			continue
 		}
@@ -265,6 +287,143 @@ func TestSeriesRegistry(t *testing.T) {
 	assert.Equal(expectedMetrics, allMetrics, "should have listed all expected metrics")
 }
 
+func TestSeriesRegistryNamespaceRestriction(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	rule := cfg.DiscoveryRule{
+		SeriesQuery:  `{__name__="http_requests_total"}`,
+		Resources:    cfg.ResourceMapping{Template: "kube_<<.Resource>>"},
+		Name:         cfg.NameMapping{Matches: "^(.*)_total$"},
+		MetricsQuery: "sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)",
+		Namespace:    "teamns",
+	}
+	namer, err := NamerFromRule(rule, restMapper(), nil)
+	require.NoError(err)
+
+	registry := &basicSeriesRegistry{
+		mapper: restMapper(),
+	}
+	require.NoError(registry.SetSeries([][]prom.Series{
+		{
+			{
+				Name:   "http_requests_total",
+				Labels: pmodel.LabelSet{"kube_pod": "somepod", "kube_namespace": "teamns"},
+			},
+			{
+				Name:   "http_requests_total",
+				Labels: pmodel.LabelSet{"kube_service": "othersvc", "kube_namespace": "otherns"},
+			},
+			{
+				Name:   "http_requests_total",
+				Labels: pmodel.LabelSet{"kube_node": "somenode"},
+			},
+		},
+	}, []MetricNamer{namer}))
+
+	expectedMetrics := []provider.CustomMetricInfo{
+		{schema.GroupResource{Resource: "pods"}, true, "http_requests"},
+	}
+	assert.Equal(expectedMetrics, registry.ListAllMetrics(), "only namespaced resources from series in the rule's namespace should be listed")
+	assert.Equal(map[MetricNamer]int{namer: 1}, registry.MetricCountsByNamer())
+
+	podInfo := provider.CustomMetricInfo{schema.GroupResource{Resource: "pods"}, true, "http_requests"}
+	query, found := registry.QueryForMetric(podInfo, "teamns", labels.Everything(), labels.Everything(), "somepod")
+	require.True(found, "metric should be available in the rule's namespace")
+	assert.Equal(prom.Selector(`sum(http_requests_total{kube_namespace="teamns",kube_pod="somepod"}) by (kube_pod,kube_namespace)`), query)
+
+	_, found = registry.QueryForMetric(podInfo, "otherns", labels.Everything(), labels.Everything(), "somepod")
+	assert.False(found, "metric should not be available outside of the rule's namespace")
+
+	// the namer itself should never produce queries for other namespaces
+	query, err = namer.QueryForSeries("http_requests_total", nil, schema.GroupResource{Resource: "pods"}, "", labels.Everything(), labels.Everything(), "somepod")
+	require.NoError(err)
+	assert.Equal(prom.Selector(`sum(http_requests_total{kube_namespace="teamns",kube_pod="somepod"}) by (kube_pod,kube_namespace)`), query, "the rule's namespace should be injected")
+	_, err = namer.QueryForSeries("http_requests_total", nil, schema.GroupResource{Resource: "pods"}, "otherns", labels.Everything(), labels.Everything(), "somepod")
+	assert.Error(err)
+	_, err = namer.QueryForSeries("http_requests_total", nil, nsGroupResource, "", labels.Everything(), labels.Everything(), "otherns")
+	assert.Error(err)
+}
+
+func TestSeriesRegistryNamespaceRestrictionQueryTemplates(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	rule := cfg.DiscoveryRule{
+		SeriesQuery:  `{__name__="http_requests_total"}`,
+		Resources:    cfg.ResourceMapping{Template: "kube_<<.Resource>>"},
+		Name:         cfg.NameMapping{Matches: "^(.*)_total$"},
+		MetricsQuery: `sum(<<.Series>>{kube_namespace="otherns"}) by (kube_pod)`,
+		Namespace:    "teamns",
+	}
+	_, err := NamerFromRule(rule, restMapper(), nil)
+	assert.Error(err, "namespace-restricted rules must use the label matchers")
+
+	// merely mentioning the label matchers doesn't restrict the query
+	rule.MetricsQuery = `sum(<<.Series>>{kube_namespace="otherns"<</* .LabelMatchers */>>}) by (kube_pod)`
+	_, err = NamerFromRule(rule, restMapper(), nil)
+	if assert.Error(err, "label matchers in a comment should not count as using them") {
+		assert.Contains(err.Error(), "must use .LabelMatchers")
+	}
+	rule.MetricsQuery = `sum(<<.Series>>{kube_namespace="otherns"<<if false>>,<<.LabelMatchers>><<end>>}) by (kube_pod)`
+	_, err = NamerFromRule(rule, restMapper(), nil)
+	if assert.Error(err, "label matchers in a branch which isn't taken should not count as using them") {
+		assert.Contains(err.Error(), "must use .LabelMatchers")
+	}
+
+	// the label matchers may be used while still selecting series from elsewhere
+	rule.MetricsQuery = `sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>) or sum(<<.Series>>{kube_namespace="otherns"}) by (<<.GroupBy>>)`
+	namer, err := NamerFromRule(rule, restMapper(), nil)
+	require.NoError(err)
+
+	registry := &basicSeriesRegistry{
+		mapper: restMapper(),
+	}
+	require.NoError(registry.SetSeries([][]prom.Series{
+		{
+			{
+				Name:   "http_requests_total",
+				Labels: pmodel.LabelSet{"kube_pod": "somepod", "kube_namespace": "teamns"},
+			},
+		},
+	}, []MetricNamer{namer}))
+
+	podInfo := provider.CustomMetricInfo{schema.GroupResource{Resource: "pods"}, true, "http_requests"}
+	values, found := registry.MatchValuesToNames(podInfo, "teamns", pmodel.Vector{
+		{Metric: pmodel.Metric{"kube_pod": "somepod", "kube_namespace": "teamns"}, Value: 1},
+		{Metric: pmodel.Metric{"kube_pod": "otherpod", "kube_namespace": "otherns"}, Value: 2},
+		{Metric: pmodel.Metric{"kube_pod": "thirdpod"}, Value: 3},
+	})
+	require.True(found)
+	assert.Equal(map[types.NamespacedName][]pmodel.SampleValue{
+		{Namespace: "teamns", Name: "somepod"}: {1},
+	}, values, "only results labeled with the rule's namespace should be used")
+}
+
+func TestQueryForSeriesEscapesNames(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	namer, err := NamerFromRule(cfg.DiscoveryRule{
+		SeriesQuery:  `node_load1`,
+		Resources:    cfg.ResourceMapping{Template: "<<.Resource>>"},
+		MetricsQuery: "sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)",
+	}, restMapper(), nil)
+	require.NoError(err)
+
+	nodes := schema.GroupResource{Resource: "nodes"}
+	query, err := namer.QueryForSeries("node_load1", nil, nodes, "", labels.Everything(), labels.Everything(), "node-1.example.com", "node-2.example.com")
+	require.NoError(err)
+	assert.Equal(prom.Selector(`sum(node_load1{node=~"node-1\\.example\\.com|node-2\\.example\\.com"}) by (node)`), query, "dots in names should only match dots")
+
+	query, err = namer.QueryForSeries("node_load1", nil, nodes, "", labels.Everything(), labels.Everything(), `evil"} or vector(1) #`)
+	require.NoError(err)
+	assert.Equal(prom.Selector(`sum(node_load1{node="evil\"} or vector(1) #"}) by (node)`), query, "names should not be able to escape their matcher")
+
+	_, err = namer.QueryForSeries("node_load1", nil, nodes, "", labels.Everything(), labels.Everything(), "bad\xff")
+	assert.Error(err, "names which can't be label values should be rejected")
+}
+
 func BenchmarkSetSeries(b *testing.B) {
 	namers := setupMetricNamer(b)
 	registry := &basicSeriesRegistry{
@@ -318,3 +477,574 @@ func (s metricInfoSorter) Less(i, j int) bool {
 func (s metricInfoSorter) Swap(i, j int) {
 	s[i], s[j] = s[j], s[i]
 }
+
+func TestLabelValueTransforms(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		transform cfg.LabelValueTransform
+		namespace string
+		name      string
+		matching  []string
+		ignored   []string
+	}{
+		{
+			desc:      "namespace/name values",
+			transform: cfg.LabelValueTransform{NamespaceSeparator: "/"},
+			namespace: "somens",
+			name:      "web-1",
+			matching:  []string{"somens/web-1"},
+			ignored:   []string{"otherns/web-1", "web-1", "somens/web-10"},
+		},
+		{
+			desc:      "prefixed, upper-case hostnames",
+			transform: cfg.LabelValueTransform{TrimPrefix: "node-", Lowercase: true},
+			name:      "worker.example.com",
+			matching:  []string{"node-Worker.Example.COM", "worker.example.com"},
+			ignored:   []string{"node-workerXexample.com", "other-worker.example.com"},
+		},
+		{
+			desc:      "host:port instances",
+			transform: cfg.LabelValueTransform{Matches: `^(?P<name>[^:]+):(?P<port>\d+)$`},
+			name:      "somenode",
+			matching:  []string{"somenode:9100"},
+			ignored:   []string{"somenode", "othernode:9100", "somenode:metrics"},
+		},
+	}
+
+	for _, tc := range testCases {
+		transform, err := newLabelValueTransform(tc.transform)
+		require.NoError(t, err, tc.desc)
+
+		matcherRaw, err := transform.ValueMatcher(tc.namespace, tc.name)
+		require.NoError(t, err, tc.desc)
+		// Prometheus anchors label matchers
+		matcher := regexp.MustCompile("^(?:" + matcherRaw + ")$")
+
+		for _, value := range tc.matching {
+			assert.True(t, matcher.MatchString(value), "%s: matcher %q should match %q", tc.desc, matcherRaw, value)
+			ns, name, ok := transform.ObjectForValue(value)
+			if assert.True(t, ok, "%s: should be able to convert %q", tc.desc, value) {
+				assert.Equal(t, tc.namespace, ns, "%s: wrong namespace for %q", tc.desc, value)
+				assert.Equal(t, tc.name, name, "%s: wrong name for %q", tc.desc, value)
+			}
+		}
+		for _, value := range tc.ignored {
+			// the matcher may be broader than the transform, but never produce the wrong object
+			if !matcher.MatchString(value) {
+				continue
+			}
+			ns, name, ok := transform.ObjectForValue(value)
+			assert.False(t, ok && ns == tc.namespace && name == tc.name, "%s: %q should not convert to the requested object", tc.desc, value)
+		}
+	}
+
+	_, err := newLabelValueTransform(cfg.LabelValueTransform{Matches: `^([^:]+):(\d+)$`})
+	assert.Error(t, err, "multiple unnamed capture groups should be rejected")
+	_, err = newLabelValueTransform(cfg.LabelValueTransform{Matches: `^node-.*$`})
+	assert.Error(t, err, "expressions without capture groups should be rejected")
+}
+
+func TestSeriesRegistryValueTransforms(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	rule := cfg.DiscoveryRule{
+		SeriesQuery: `{__name__="http_requests_total"}`,
+		Resources: cfg.ResourceMapping{
+			Template: "kube_<<.Resource>>",
+			Values: map[string]cfg.LabelValueTransform{
+				"kube_pod": {NamespaceSeparator: "/"},
+			},
+		},
+		Name:         cfg.NameMapping{Matches: "^(.*)_total$"},
+		MetricsQuery: "sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)",
+	}
+	namer, err := NamerFromRule(rule, restMapper(), nil)
+	require.NoError(err)
+
+	registry := &basicSeriesRegistry{
+		mapper: restMapper(),
+	}
+	require.NoError(registry.SetSeries([][]prom.Series{
+		{
+			{
+				Name:   "http_requests_total",
+				Labels: pmodel.LabelSet{"kube_pod": "somens/somepod"},
+			},
+		},
+	}, []MetricNamer{namer}))
+
+	podInfo := provider.CustomMetricInfo{schema.GroupResource{Resource: "pods"}, true, "http_requests"}
+	assert.Equal([]provider.CustomMetricInfo{podInfo}, registry.ListAllMetrics(), "series with the namespace in the pod label should be namespaced")
+
+	query, found := registry.QueryForMetric(podInfo, "somens", labels.Everything(), labels.Everything(), "somepod")
+	require.True(found)
+	assert.Equal(prom.Selector(`sum(http_requests_total{kube_pod=~"somens/(?:somepod)"}) by (kube_pod)`), query, "the namespace should be matched as part of the pod label")
+
+	values, found := registry.MatchValuesToNames(podInfo, "somens", pmodel.Vector{
+		{Metric: pmodel.Metric{"kube_pod": "somens/somepod"}, Value: 1},
+		{Metric: pmodel.Metric{"kube_pod": "otherns/otherpod"}, Value: 2},
+		{Metric: pmodel.Metric{"kube_pod": "malformed"}, Value: 3},
+	})
+	require.True(found)
+	assert.Equal(map[types.NamespacedName][]pmodel.SampleValue{{Namespace: "somens", Name: "somepod"}: {1}}, values, "values should be converted to names, skipping other namespaces and malformed values")
+}
+
+func TestSeriesRegistryObjectLookup(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// don't actually run the informers -- we'll fill their stores directly
+	stopCh := make(chan struct{})
+	close(stopCh)
+	lookups := NewObjectLookupCache(fakedyn.NewSimpleDynamicClient(runtime.NewScheme()), restMapper(), 1*time.Minute, stopCh)
+
+	nodeLookup := cfg.ObjectLookup{NodeAddressType: "InternalIP"}
+	podLookup := cfg.ObjectLookup{Field: "status.podIP"}
+	rule := cfg.DiscoveryRule{
+		SeriesQuery: `{__name__="connections"}`,
+		Resources: cfg.ResourceMapping{
+			Overrides: map[string]cfg.GroupResource{
+				"instance":  {Resource: "node"},
+				"pod_ip":    {Resource: "pod"},
+				"namespace": {Resource: "namespace"},
+			},
+			Values: map[string]cfg.LabelValueTransform{
+				"instance": {Matches: "^(.+):[0-9]+$", Lookup: &nodeLookup},
+				"pod_ip":   {Lookup: &podLookup},
+			},
+		},
+		MetricsQuery: "sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)",
+	}
+	namer, err := NamerFromRule(rule, restMapper(), lookups)
+	require.NoError(err)
+
+	nodes, err := lookups.lookupFor(schema.GroupResource{Resource: "nodes"}, nodeLookup)
+	require.NoError(err)
+	require.NoError(nodes.informer.GetStore().Add(&unstructured.Unstructured{Object: map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "somenode"},
+		"status": map[string]interface{}{
+			"addresses": []interface{}{
+				map[string]interface{}{"type": "Hostname", "address": "somenode"},
+				map[string]interface{}{"type": "InternalIP", "address": "10.0.3.4"},
+			},
+		},
+	}}))
+	pods, err := lookups.lookupFor(schema.GroupResource{Resource: "pods"}, podLookup)
+	require.NoError(err)
+	for _, ns := range []string{"somens", "otherns"} {
+		require.NoError(pods.informer.GetStore().Add(&unstructured.Unstructured{Object: map[string]interface{}{
+			"metadata": map[string]interface{}{"name": ns + "-pod", "namespace": ns},
+			"status":   map[string]interface{}{"podIP": "10.1.0.1"},
+		}}))
+	}
+
+	registry := &basicSeriesRegistry{
+		mapper: restMapper(),
+	}
+	require.NoError(registry.SetSeries([][]prom.Series{
+		{
+			{
+				Name:   "connections",
+				Labels: pmodel.LabelSet{"instance": "10.0.3.4:9100"},
+			},
+			{
+				Name:   "connections",
+				Labels: pmodel.LabelSet{"pod_ip": "10.1.0.1", "namespace": "somens"},
+			},
+		},
+	}, []MetricNamer{namer}))
+
+	nodeInfo := provider.CustomMetricInfo{schema.GroupResource{Resource: "nodes"}, false, "connections"}
+	query, found := registry.QueryForMetric(nodeInfo, "", labels.Everything(), labels.Everything(), "somenode")
+	require.True(found)
+	assert.Equal(prom.Selector(`sum(connections{instance=~"(?-m:\\A(10\\.0\\.3\\.4):[0-9]+$)"}) by (instance)`), query, "the node name should have been converted to its address")
+
+	_, found = registry.QueryForMetric(nodeInfo, "", labels.Everything(), labels.Everything(), "unknownnode")
+	assert.False(found, "querying for an unknown node should fail")
+
+	values, found := registry.MatchValuesToNames(nodeInfo, "", pmodel.Vector{
+		{Metric: pmodel.Metric{"instance": "10.0.3.4:9100"}, Value: 1},
+		{Metric: pmodel.Metric{"instance": "10.0.3.5:9100"}, Value: 2},
+	})
+	require.True(found)
+	assert.Equal(map[types.NamespacedName][]pmodel.SampleValue{{Name: "somenode"}: {1}}, values, "addresses should be converted back to node names")
+
+	podInfo := provider.CustomMetricInfo{schema.GroupResource{Resource: "pods"}, true, "connections"}
+	query, found = registry.QueryForMetric(podInfo, "somens", labels.Everything(), labels.Everything(), "somens-pod")
+	require.True(found)
+	assert.Equal(prom.Selector(`sum(connections{namespace="somens",pod_ip=~"(?:10\\.1\\.0\\.1)"}) by (pod_ip)`), query)
+
+	values, found = registry.MatchValuesToNames(podInfo, "somens", pmodel.Vector{
+		{Metric: pmodel.Metric{"pod_ip": "10.1.0.1", "namespace": "somens"}, Value: 1},
+	})
+	require.True(found)
+	assert.Equal(map[types.NamespacedName][]pmodel.SampleValue{{Namespace: "somens", Name: "somens-pod"}: {1}}, values, "pod IPs should be looked up in the requested namespace")
+
+	// pod IPs are only unique within a namespace, so they can't be looked up without one
+	_, err = pods.KeysForName("", "somens-pod")
+	assert.Error(err, "looking up a namespaced object without a namespace should be rejected")
+	_, _, err = pods.NameForKey("", "10.1.0.1")
+	assert.Error(err, "looking up a namespaced object without a namespace should be rejected")
+	_, found = registry.QueryForMetric(podInfo, "", labels.Everything(), labels.Everything(), "somens-pod")
+	assert.False(found, "querying for pods across all namespaces by IP should fail")
+	values, found = registry.MatchValuesToNames(podInfo, "", pmodel.Vector{
+		{Metric: pmodel.Metric{"pod_ip": "10.1.0.1", "namespace": "otherns"}, Value: 1},
+		{Metric: pmodel.Metric{"pod_ip": "10.1.0.1"}, Value: 2},
+	})
+	require.True(found)
+	assert.Equal(map[types.NamespacedName][]pmodel.SampleValue{{Namespace: "otherns", Name: "otherns-pod"}: {1}}, values, "pod IPs should be looked up in the namespace of the series, when known")
+
+	_, err = NamerFromRule(rule, restMapper(), nil)
+	assert.Error(err, "rules with lookups should require a lookup cache")
+}
+
+func TestSeriesRegistryCompositeNames(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	rule := cfg.DiscoveryRule{
+		SeriesQuery: `{__name__="jobs_processed"}`,
+		Resources: cfg.ResourceMapping{
+			Overrides: map[string]cfg.GroupResource{
+				"namespace": {Resource: "namespace"},
+			},
+			Composites: []cfg.CompositeResource{
+				{GroupResource: cfg.GroupResource{Group: "extensions", Resource: "deployment"}, Name: "<<.app>>-<<.component>>"},
+			},
+		},
+		MetricsQuery: "sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)",
+	}
+	namer, err := NamerFromRule(rule, restMapper(), nil)
+	require.NoError(err)
+
+	registry := &basicSeriesRegistry{
+		mapper: restMapper(),
+	}
+	require.NoError(registry.SetSeries([][]prom.Series{
+		{
+			{
+				Name:   "jobs_processed",
+				Labels: pmodel.LabelSet{"namespace": "somens", "app": "billing", "component": "worker"},
+			},
+			{
+				Name:   "jobs_processed",
+				Labels: pmodel.LabelSet{"namespace": "somens", "app": "incomplete"},
+			},
+		},
+	}, []MetricNamer{namer}))
+
+	depInfo := provider.CustomMetricInfo{schema.GroupResource{Group: "extensions", Resource: "deployments"}, true, "jobs_processed"}
+	allMetrics := registry.ListAllMetrics()
+	expectedMetrics := []provider.CustomMetricInfo{
+		depInfo,
+		{schema.GroupResource{Resource: "namespaces"}, false, "jobs_processed"},
+	}
+	sort.Sort(metricInfoSorter(allMetrics))
+	sort.Sort(metricInfoSorter(expectedMetrics))
+	assert.Equal(expectedMetrics, allMetrics, "deployments should only be associated with series that have all the composite labels")
+
+	query, found := registry.QueryForMetric(depInfo, "somens", labels.Everything(), labels.Everything(), "billing-worker")
+	require.True(found)
+	assert.Equal(prom.Selector(`sum(jobs_processed{namespace="somens",app="billing",component="worker"}) by (app,component)`), query)
+
+	// ambiguous names should match every possible split, and several names every combination
+	query, found = registry.QueryForMetric(depInfo, "somens", labels.Everything(), labels.Everything(), "my-app-worker", "billing-worker")
+	require.True(found)
+	assert.Equal(prom.Selector(`sum(jobs_processed{namespace="somens",app=~"my|my-app|billing",component=~"app-worker|worker"}) by (app,component)`), query)
+
+	// ...but only the requested names should be matched in the results
+	values, found := registry.MatchValuesToNames(depInfo, "somens", pmodel.Vector{
+		{Metric: pmodel.Metric{"app": "my-app", "component": "worker"}, Value: 1},
+		{Metric: pmodel.Metric{"app": "billing", "component": "worker"}, Value: 2},
+		{Metric: pmodel.Metric{"app": "billing"}, Value: 3},
+	})
+	require.True(found)
+	assert.Equal(map[types.NamespacedName][]pmodel.SampleValue{{Namespace: "somens", Name: "my-app-worker"}: {1}, {Namespace: "somens", Name: "billing-worker"}: {2}}, values)
+
+	// names with too many combinations of values should be queried separately
+	query, found = registry.QueryForMetric(depInfo, "somens", labels.Everything(), labels.Everything(), "a-w", "b-x", "c-y", "d-z")
+	require.True(found)
+	assert.Equal(prom.Selector(`(sum(jobs_processed{namespace="somens",app="a",component="w"}) by (app,component)) or `+
+		`(sum(jobs_processed{namespace="somens",app="b",component="x"}) by (app,component)) or `+
+		`(sum(jobs_processed{namespace="somens",app="c",component="y"}) by (app,component)) or `+
+		`(sum(jobs_processed{namespace="somens",app="d",component="z"}) by (app,component))`), query)
+
+	_, found = registry.QueryForMetric(depInfo, "somens", labels.Everything(), labels.Everything(), "nodash")
+	assert.False(found, "names which can't be split into label values should fail to produce a query")
+
+	for _, invalid := range []string{"<<.app | printf \"%s\">>", "<<if .app>>x<<end>>", "static"} {
+		_, err := newCompositeName(invalid)
+		assert.Error(err, "name template %q should have been rejected", invalid)
+	}
+}
+
+func TestCompositeNameSplitIsBounded(t *testing.T) {
+	// with adjacent label references and a suffix that never matches, every way of
+	// splitting the name has to be tried, and there are billions of them
+	composite, err := newCompositeName("<<.a>><<.b>><<.c>><<.d>>-suffix")
+	require.NoError(t, err)
+	name := strings.Repeat("x", 2000)
+
+	steps := maxCompositeSplitSteps
+	_, err = composite.splitName(name, 0, make(map[pmodel.LabelName]string), &steps, func(map[pmodel.LabelName]string) bool {
+		return true
+	})
+	assert.Error(t, err, "the search should give up once it runs out of steps")
+	assert.Equal(t, 0, steps)
+
+	_, _, err = composite.LabelMatchers("short-suffix", name)
+	assert.Error(t, err, "names which take too long to split should be rejected")
+
+	// ordinary names should be split well within the limit
+	composite, err = newCompositeName("<<.app>>-<<.component>>")
+	require.NoError(t, err)
+	steps = maxCompositeSplitSteps
+	_, err = composite.splitName("my-billing-app-worker", 0, make(map[pmodel.LabelName]string), &steps, func(map[pmodel.LabelName]string) bool {
+		return true
+	})
+	assert.NoError(t, err)
+}
+
+func TestCompositeNameSplitsOnCharacters(t *testing.T) {
+	composite, err := newCompositeName("<<.app>><<.component>>")
+	require.NoError(t, err)
+
+	// each of these characters takes several bytes, which must stay together
+	_, values, err := composite.LabelMatchers("日本")
+	require.NoError(t, err, "names with multi-byte characters should be split between characters")
+	assert.Equal(t, map[string][]string{"app": {"日"}, "component": {"本"}}, values)
+}
+
+func TestSeriesRegistryNameTemplates(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	rule := cfg.DiscoveryRule{
+		SeriesQuery: `{__name__=~"^app_.*"}`,
+		Resources:   cfg.ResourceMapping{Template: "kube_<<.Resource>>"},
+		Name: cfg.NameMapping{
+			Matches: `^app_(?P<subsystem>[^_]+)_(?P<name>.+)_total$`,
+			As:      `<<.Match.subsystem | lower>>_<<.Match.name | snakeCase>>_<<.Labels.code>>`,
+		},
+		MetricsQuery: "sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)",
+	}
+	namer, err := NamerFromRule(rule, restMapper(), nil)
+	require.NoError(err)
+
+	registry := &basicSeriesRegistry{
+		mapper: restMapper(),
+	}
+	require.NoError(registry.SetSeries([][]prom.Series{
+		{
+			{
+				Name:   "app_HTTP_RequestsServed_total",
+				Labels: pmodel.LabelSet{"kube_pod": "somepod", "kube_namespace": "somens", "code": "200"},
+			},
+			{
+				Name:   "app_HTTP_RequestsServed_total",
+				Labels: pmodel.LabelSet{"kube_pod": "somepod", "kube_namespace": "somens", "code": "500"},
+			},
+			{
+				// no code label, so it can't be named
+				Name:   "app_HTTP_RequestsServed_total",
+				Labels: pmodel.LabelSet{"kube_pod": "somepod", "kube_namespace": "somens"},
+			},
+		},
+	}, []MetricNamer{namer}))
+
+	var names []string
+	for _, info := range registry.ListAllMetrics() {
+		if info.GroupResource.Resource == "pods" {
+			names = append(names, info.Metric)
+		}
+	}
+	sort.Strings(names)
+	assert.Equal([]string{"http_requests_served_200", "http_requests_served_500"}, names)
+
+	// the labels used in the name should be used to find the original series again
+	podInfo := provider.CustomMetricInfo{schema.GroupResource{Resource: "pods"}, true, "http_requests_served_500"}
+	query, found := registry.QueryForMetric(podInfo, "somens", labels.Everything(), labels.Everything(), "somepod")
+	require.True(found)
+	assert.Equal(prom.Selector(`sum(app_HTTP_RequestsServed_total{kube_namespace="somens",kube_pod="somepod",code="500"}) by (kube_pod)`), query)
+
+	// several capture groups with one called `name` should default to that group
+	rule.Name.As = ""
+	namer, err = NamerFromRule(rule, restMapper(), nil)
+	require.NoError(err)
+	name, err := namer.MetricNameForSeries(prom.Series{Name: "app_HTTP_RequestsServed_total"})
+	require.NoError(err)
+	assert.Equal("RequestsServed", name)
+
+	for _, invalid := range []string{`<<index .Labels "code">>`, `<<range .Labels>>x<<end>>`, `<<printf "%v" .>>`, `<<.Match.name | nosuchfunc>>`} {
+		rule.Name.As = invalid
+		_, err := NamerFromRule(rule, restMapper(), nil)
+		assert.Error(err, "name template %q should have been rejected", invalid)
+	}
+}
+
+func TestSeriesRegistryMergedSeries(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	rule := cfg.DiscoveryRule{
+		SeriesQuery: `{__name__=~"^(http|http_server)_requests_total$"}`,
+		Resources:   cfg.ResourceMapping{Template: "kube_<<.Resource>>"},
+		Name: cfg.NameMapping{
+			Matches: `^(http|http_server)_requests_total$`,
+			As:      "http_requests",
+		},
+		MetricsQuery: "sum(<<.Series>>{<<.LabelMatchers>>}) by (<<.GroupBy>>)",
+		Merge: &cfg.SeriesMerge{
+			Order: []string{"^http_server_"},
+		},
+	}
+	series := [][]prom.Series{
+		{
+			{
+				Name:   "http_requests_total",
+				Labels: pmodel.LabelSet{"kube_pod": "somepod", "kube_namespace": "somens"},
+			},
+			{
+				Name:   "http_server_requests_total",
+				Labels: pmodel.LabelSet{"kube_pod": "somepod", "kube_namespace": "somens"},
+			},
+			{
+				// the same series with different labels shouldn't be listed twice
+				Name:   "http_requests_total",
+				Labels: pmodel.LabelSet{"kube_pod": "otherpod", "kube_namespace": "somens"},
+			},
+		},
+	}
+	podInfo := provider.CustomMetricInfo{schema.GroupResource{Resource: "pods"}, true, "http_requests"}
+	oldQuery := `(sum(http_requests_total{kube_namespace="somens",kube_pod="somepod"}) by (kube_pod))`
+	newQuery := `(sum(http_server_requests_total{kube_namespace="somens",kube_pod="somepod"}) by (kube_pod))`
+
+	tests := []struct {
+		strategy cfg.MergeStrategy
+		expected string
+	}{
+		{
+			strategy: "",
+			expected: newQuery + " or (" + oldQuery + " unless on() (" + newQuery + "))",
+		},
+		{
+			strategy: cfg.MergeOr,
+			expected: newQuery + " or " + oldQuery,
+		},
+		{
+			strategy: cfg.MergeSum,
+			expected: `sum without(adapter_merge_source) (label_replace(sum(http_server_requests_total{kube_namespace="somens",kube_pod="somepod"}) by (kube_pod), "adapter_merge_source", "0", "", "") or label_replace(sum(http_requests_total{kube_namespace="somens",kube_pod="somepod"}) by (kube_pod), "adapter_merge_source", "1", "", ""))`,
+		},
+	}
+
+	for _, test := range tests {
+		rule.Merge.Strategy = test.strategy
+		namer, err := NamerFromRule(rule, restMapper(), nil)
+		require.NoError(err)
+
+		registry := &basicSeriesRegistry{
+			mapper: restMapper(),
+		}
+		require.NoError(registry.SetSeries(series, []MetricNamer{namer}))
+
+		query, found := registry.QueryForMetric(podInfo, "somens", labels.Everything(), labels.Everything(), "somepod")
+		require.True(found)
+		assert.Equal(prom.Selector(test.expected), query, "strategy %q should have produced the expected query", test.strategy)
+	}
+
+	// without merging, only one series should be used
+	rule.Merge = nil
+	namer, err := NamerFromRule(rule, restMapper(), nil)
+	require.NoError(err)
+	registry := &basicSeriesRegistry{
+		mapper: restMapper(),
+	}
+	require.NoError(registry.SetSeries(series, []MetricNamer{namer}))
+	query, found := registry.QueryForMetric(podInfo, "somens", labels.Everything(), labels.Everything(), "somepod")
+	require.True(found)
+	assert.NotContains(string(query), " or ")
+
+	rule.Merge = &cfg.SeriesMerge{Strategy: "max"}
+	_, err = NamerFromRule(rule, restMapper(), nil)
+	assert.Error(err, "unknown merge strategies should be rejected")
+}
+
+func TestNameWords(t *testing.T) {
+	for input, expected := range map[string][]string{
+		"http_requests_total": {"http", "requests", "total"},
+		"httpRequestsTotal":   {"http", "requests", "total"},
+		"HTTPRequests":        {"http", "requests"},
+		"queue-depth.v2":      {"queue", "depth", "v2"},
+		"GCPauseSeconds":      {"gc", "pause", "seconds"},
+		"":                    nil,
+	} {
+		assert.Equal(t, expected, nameWords(input), "unexpected words for %q", input)
+	}
+}
+
+func TestQueryTemplateContext(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	defaults := cfg.QueryDefaults{
+		Constants:  map[string]string{"job": "web", "cluster": "prod"},
+		RateWindow: "5m",
+	}
+	rule := defaults.ApplyTo(cfg.DiscoveryRule{
+		SeriesQuery: `http_requests_total`,
+		Resources:   cfg.ResourceMapping{Template: "<<.Resource>>"},
+		MetricsQuery: `sum(rate(<<.Series>>{<<.LabelMatchers>>,job=<<quote .Constants.job>>,cluster=<<quote .Constants.cluster>>}[<<.RateWindow>>])) by (<<join "," .GroupBySlice>>)` +
+			` # <<.Kind>> <<.Resource>> <<.Namespace>> <<quote .LabelSelector>> <<regexEscape "a.b">>`,
+		Constants: map[string]string{"cluster": "staging"},
+	})
+	namer, err := NamerFromRule(rule, restMapper(), nil)
+	require.NoError(err)
+
+	selector, err := labels.Parse("app=web")
+	require.NoError(err)
+	query, err := namer.QueryForSeries("http_requests_total", nil, schema.GroupResource{Resource: "pods"}, "somens", selector, labels.Everything(), "somepod", "otherpod")
+	require.NoError(err)
+	assert.Equal(prom.Selector(`sum(rate(http_requests_total{namespace="somens",pod=~"somepod|otherpod",job="web",cluster="staging"}[5m])) by (pod) # Pod pods somens "app=web" a\.b`), query, "rule constants should override global ones")
+
+	// quoting should only escape what PromQL requires, leaving non-ASCII text alone
+	rule = cfg.DiscoveryRule{
+		SeriesQuery:  `http_requests_total`,
+		Resources:    cfg.ResourceMapping{Template: "<<.Resource>>"},
+		MetricsQuery: `sum(<<.Series>>{<<.LabelMatchers>>,region=<<quote .Constants.region>>,note=<<quote .Constants.note>>}) by (<<.GroupBy>>)`,
+		Constants:    map[string]string{"region": "zürich-東京", "note": "say \"hi\"\\\n"},
+	}
+	namer, err = NamerFromRule(rule, restMapper(), nil)
+	require.NoError(err)
+	query, err = namer.QueryForSeries("http_requests_total", nil, schema.GroupResource{Resource: "pods"}, "somens", labels.Everything(), labels.Everything(), "somepod")
+	require.NoError(err)
+	assert.Equal(prom.Selector(`sum(http_requests_total{namespace="somens",pod="somepod",region="zürich-東京",note="say \"hi\"\\\n"}) by (pod)`), query)
+
+	// the rate window has a default
+	rule = cfg.DiscoveryRule{
+		SeriesQuery:  `http_requests_total`,
+		Resources:    cfg.ResourceMapping{Template: "<<.Resource>>"},
+		MetricsQuery: `sum(rate(<<.Series>>{<<.LabelMatchers>>}[<<.RateWindow>>])) by (<<.GroupBy>>)`,
+	}
+	namer, err = NamerFromRule(rule, restMapper(), nil)
+	require.NoError(err)
+	query, err = namer.QueryForSeries("http_requests_total", nil, schema.GroupResource{Resource: "pods"}, "somens", labels.Everything(), labels.Everything(), "somepod")
+	require.NoError(err)
+	assert.Equal(prom.Selector(`sum(rate(http_requests_total{namespace="somens",pod="somepod"}[2m])) by (pod)`), query)
+
+	// mistakes in templates should be caught when rules are loaded
+	invalidRules := map[string]cfg.DiscoveryRule{
+		"undefined constant":   {MetricsQuery: `<<.Series>>{job="<<.Constants.job>>"}`},
+		"unknown field":        {MetricsQuery: `<<.Series>>{<<.LabelMatcher>>}`},
+		"misused helper":       {MetricsQuery: `<<.Series>>{pod=~"<<join "|" .Series>>"}`},
+		"unknown helper":       {MetricsQuery: `<<.Series>>{pod=<<squote .Series>>}`},
+		"invalid rate window":  {MetricsQuery: `rate(<<.Series>>[<<.RateWindow>>])`, RateWindow: "two minutes"},
+		"undefined $ constant": {MetricsQuery: `<<range .GroupBySlice>><<$.Constants.job>><<end>>`},
+	}
+	for title, rule := range invalidRules {
+		rule.SeriesQuery = `http_requests_total`
+		rule.Resources = cfg.ResourceMapping{Template: "<<.Resource>>"}
+		_, err := NamerFromRule(rule, restMapper(), nil)
+		assert.Error(err, "rule with %s should be rejected", title)
+	}
+}
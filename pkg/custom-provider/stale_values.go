@@ -0,0 +1,138 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	"github.com/prometheus/client_golang/prometheus"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+)
+
+var (
+	// staleValuesServed counts values served from the stale value cache.
+	staleValuesServed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cmgateway_stale_values_served_total",
+			Help: "Number of metric values served from the last-known-good cache while Prometheus was unavailable.  Broken down by metric",
+		},
+		[]string{"metric"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(staleValuesServed)
+}
+
+// fetchError indicates that results couldn't be fetched from Prometheus at all,
+// as opposed to a request failing for some other reason.
+type fetchError struct {
+	*apierr.StatusError
+}
+
+// newFetchError constructs a fetchError, which doesn't leak any details of the
+// underlying error to the user.
+func newFetchError() error {
+	return fetchError{apierr.NewInternalError(fmt.Errorf("unable to fetch metrics"))}
+}
+
+// isFetchError checks if the given error indicates that Prometheus was unavailable.
+func isFetchError(err error) bool {
+	_, ok := err.(fetchError)
+	return ok
+}
+
+// staleValueKey identifies the value of a metric for a particular object.
+type staleValueKey struct {
+	info           provider.CustomMetricInfo
+	object         types.NamespacedName
+	metricSelector string
+}
+
+// StaleValueCache holds the most recent value of each metric for each object, so
+// that they can be served while Prometheus is unavailable.
+type StaleValueCache struct {
+	maxAge time.Duration
+
+	mu        sync.Mutex
+	values    map[staleValueKey]custom_metrics.MetricValue
+	lastPrune time.Time
+}
+
+// NewStaleValueCache constructs a StaleValueCache which serves values up to the given age.
+func NewStaleValueCache(maxAge time.Duration) *StaleValueCache {
+	return &StaleValueCache{
+		maxAge:    maxAge,
+		values:    make(map[staleValueKey]custom_metrics.MetricValue),
+		lastPrune: time.Now(),
+	}
+}
+
+// Store records the given value of a metric for the given object, replacing any older
+// value for the same object.  The object is identified as it was requested (so without a
+// namespace for root-scoped requests), which may differ from the value's described object.
+func (c *StaleValueCache) Store(info provider.CustomMetricInfo, metricSelector labels.Selector, object types.NamespacedName, value custom_metrics.MetricValue) {
+	key := staleValueKey{
+		info:           info,
+		object:         object,
+		metricSelector: metricSelector.String(),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.values[key] = value
+
+	// forget about objects which haven't been seen for a while, so that deleted ones don't pile up
+	now := time.Now()
+	if now.Sub(c.lastPrune) < c.maxAge {
+		return
+	}
+	for key, value := range c.values {
+		if now.Sub(value.Timestamp.Time) > c.maxAge {
+			delete(c.values, key)
+		}
+	}
+	c.lastPrune = now
+}
+
+// Lookup fetches the most recent value of a metric for the given object (identified as
+// it was when the value was stored), as long as it's no older than the maximum age, and
+// counts it as served.  The value keeps its original timestamp.
+func (c *StaleValueCache) Lookup(info provider.CustomMetricInfo, metricSelector labels.Selector, object types.NamespacedName) (*custom_metrics.MetricValue, bool) {
+	key := staleValueKey{
+		info:           info,
+		object:         object,
+		metricSelector: metricSelector.String(),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	value, found := c.values[key]
+	if !found || time.Since(value.Timestamp.Time) > c.maxAge {
+		return nil, false
+	}
+	staleValuesServed.WithLabelValues(info.Metric).Inc()
+	return &value, true
+}
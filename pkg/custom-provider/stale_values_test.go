@@ -0,0 +1,129 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/kubernetes-incubator/custom-metrics-apiserver/pkg/provider"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+
+	pmodel "github.com/prometheus/common/model"
+
+	prom "github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/client"
+)
+
+func TestStaleValueCache(t *testing.T) {
+	cache := NewStaleValueCache(5 * time.Minute)
+	info := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "queue_length"}
+	valueAt := func(name string, timestamp time.Time) custom_metrics.MetricValue {
+		return custom_metrics.MetricValue{
+			DescribedObject: custom_metrics.ObjectReference{Kind: "Pod", APIVersion: "v1", Namespace: "somens", Name: name},
+			Metric:          custom_metrics.MetricIdentifier{Name: info.Metric},
+			Timestamp:       metav1.Time{timestamp},
+		}
+	}
+
+	recent := valueAt("recent", time.Now().Add(-time.Minute))
+	cache.Store(info, labels.Everything(), types.NamespacedName{Namespace: "somens", Name: "recent"}, recent)
+	cache.Store(info, labels.Everything(), types.NamespacedName{Namespace: "somens", Name: "old"}, valueAt("old", time.Now().Add(-10*time.Minute)))
+
+	value, found := cache.Lookup(info, labels.Everything(), types.NamespacedName{Namespace: "somens", Name: "recent"})
+	require.True(t, found, "recent values should be served")
+	assert.Equal(t, recent, *value, "values should keep their original timestamps")
+
+	_, found = cache.Lookup(info, labels.Everything(), types.NamespacedName{Namespace: "somens", Name: "old"})
+	assert.False(t, found, "values older than the maximum age should not be served")
+	_, found = cache.Lookup(info, labels.SelectorFromSet(labels.Set{"queue": "high"}), types.NamespacedName{Namespace: "somens", Name: "recent"})
+	assert.False(t, found, "values should only be served for the same metric selector")
+	_, found = cache.Lookup(info, labels.Everything(), types.NamespacedName{Namespace: "otherns", Name: "recent"})
+	assert.False(t, found, "values should only be served for the same object")
+}
+
+func TestProviderServesStaleValues(t *testing.T) {
+	setupProvider := func(staleValues *StaleValueCache) (provider.CustomMetricsProvider, *fakePromClient) {
+		prov, fakeProm := setupRuleProvider(t, sumRule("queue_length"), ProviderOptions{StaleValues: staleValues}, fakePod("somens", "web-0"))
+		fakeProm.series = map[prom.Selector][]prom.Series{
+			"queue_length": {
+				{Name: "queue_length", Labels: pmodel.LabelSet{"pod": "web-0", "namespace": "somens"}},
+			},
+		}
+		fakeProm.queryResults = map[prom.Selector]prom.QueryResult{
+			`sum(queue_length{namespace="somens",pod="web-0"}) by (pod)`: {
+				Type:   pmodel.ValVector,
+				Vector: &pmodel.Vector{{Metric: pmodel.Metric{"pod": "web-0"}, Value: pmodel.SampleValue(3)}},
+			},
+		}
+		lister := prov.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
+		require.NoError(t, lister.updateMetrics())
+		return prov, fakeProm
+	}
+	breakPrometheus := func(fakeProm *fakePromClient) {
+		fakeProm.errQueries = map[prom.Selector]error{
+			`sum(queue_length{namespace="somens",pod="web-0"}) by (pod)`: fmt.Errorf("connection refused"),
+		}
+	}
+	podsGR := schema.GroupResource{Resource: "pods"}
+
+	prov, fakeProm := setupProvider(NewStaleValueCache(5 * time.Minute))
+	_, err := prov.GetMetricByName(types.NamespacedName{Namespace: "somens", Name: "web-0"}, provider.CustomMetricInfo{GroupResource: podsGR, Namespaced: true, Metric: "queue_length"}, labels.Everything())
+	require.NoError(t, err)
+	// the most recent value for the object comes from the list
+	freshList, err := prov.GetMetricBySelector("somens", labels.Everything(), provider.CustomMetricInfo{GroupResource: podsGR, Namespaced: true, Metric: "queue_length"}, labels.Everything())
+	require.NoError(t, err)
+
+	breakPrometheus(fakeProm)
+	stale, err := prov.GetMetricByName(types.NamespacedName{Namespace: "somens", Name: "web-0"}, provider.CustomMetricInfo{GroupResource: podsGR, Namespaced: true, Metric: "queue_length"}, labels.Everything())
+	require.NoError(t, err, "the last known value should be served while Prometheus is unavailable")
+	require.Len(t, freshList.Items, 1)
+	assert.Equal(t, freshList.Items[0], *stale)
+	staleList, err := prov.GetMetricBySelector("somens", labels.Everything(), provider.CustomMetricInfo{GroupResource: podsGR, Namespaced: true, Metric: "queue_length"}, labels.Everything())
+	require.NoError(t, err, "the last known values should be served while Prometheus is unavailable")
+	assert.Equal(t, freshList.Items, staleList.Items)
+
+	// without a cache, requests fail as normal
+	prov, fakeProm = setupProvider(nil)
+	_, err = prov.GetMetricByName(types.NamespacedName{Namespace: "somens", Name: "web-0"}, provider.CustomMetricInfo{GroupResource: podsGR, Namespaced: true, Metric: "queue_length"}, labels.Everything())
+	require.NoError(t, err)
+	breakPrometheus(fakeProm)
+	_, err = prov.GetMetricByName(types.NamespacedName{Namespace: "somens", Name: "web-0"}, provider.CustomMetricInfo{GroupResource: podsGR, Namespaced: true, Metric: "queue_length"}, labels.Everything())
+	assert.Error(t, err)
+
+	// root-scoped requests for namespaced objects should be served from values stored for them
+	prov, fakeProm = setupProvider(NewStaleValueCache(5 * time.Minute))
+	fakeProm.queryResults[`sum(queue_length{pod="web-0"}) by (pod,namespace)`] = prom.QueryResult{
+		Type:   pmodel.ValVector,
+		Vector: &pmodel.Vector{{Metric: pmodel.Metric{"pod": "web-0", "namespace": "somens"}, Value: pmodel.SampleValue(3)}},
+	}
+	fresh, err := prov.GetMetricByName(types.NamespacedName{Name: "web-0"}, provider.CustomMetricInfo{GroupResource: podsGR, Metric: "queue_length"}, labels.Everything())
+	require.NoError(t, err)
+	assert.Equal(t, "somens", fresh.DescribedObject.Namespace)
+	fakeProm.errQueries = map[prom.Selector]error{
+		`sum(queue_length{pod="web-0"}) by (pod,namespace)`: fmt.Errorf("connection refused"),
+	}
+	stale, err = prov.GetMetricByName(types.NamespacedName{Name: "web-0"}, provider.CustomMetricInfo{GroupResource: podsGR, Metric: "queue_length"}, labels.Everything())
+	require.NoError(t, err, "the last known value should be served for root-scoped requests while Prometheus is unavailable")
+	assert.Equal(t, fresh, stale)
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"time"
+
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+
+	pmodel "github.com/prometheus/common/model"
+
+	prom "github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/client"
+)
+
+// targetRelistJitter is the maximum fraction of the relist delay added to it at random,
+// so that several adapters watching the same Prometheus don't relist in lockstep.
+const targetRelistJitter = 0.5
+
+// TargetWatcher polls the set of targets that Prometheus is scraping, and requests an
+// early relist of the available metrics whenever it changes, so that metrics for new
+// workloads show up without waiting for the next relist interval.  Relists are delayed,
+// to give Prometheus time to scrape the new targets, and the delay backs off while the
+// targets keep changing, so that churn can't cause a relist storm.  Relists go through
+// a RelistTrigger, so they're subject to the same rate limit as other relist requests.
+type TargetWatcher struct {
+	promClient   prom.Client
+	relists      *RelistTrigger
+	pollInterval time.Duration
+	minDelay     time.Duration
+	maxDelay     time.Duration
+
+	// the remaining fields are only used from the polling loop
+
+	// polled is set once the targets have been successfully polled
+	polled bool
+	// fingerprint identifies the set of targets seen by the last successful poll
+	fingerprint uint64
+	// changedWhilePending is set when the targets change while a relist is already scheduled
+	changedWhilePending bool
+	// delay is the delay (before jitter) used when the last relist was scheduled
+	delay time.Duration
+	// lastRelist is the time at which the last relist was accepted
+	lastRelist time.Time
+}
+
+// NewTargetWatcher constructs a TargetWatcher which polls the targets of the given
+// client at the given interval, and requests relists from the given trigger.  Relists
+// are delayed by at least the minimum delay, doubling while the targets keep changing
+// up to the maximum delay (normally the relist interval, past which an early relist is
+// pointless).  The poll interval and both delays must be positive, and the maximum
+// delay must be at least the minimum delay.
+func NewTargetWatcher(promClient prom.Client, relists *RelistTrigger, pollInterval, minDelay, maxDelay time.Duration) (*TargetWatcher, error) {
+	if pollInterval <= 0 {
+		return nil, fmt.Errorf("invalid target poll interval %v, must be positive", pollInterval)
+	}
+	if minDelay <= 0 {
+		return nil, fmt.Errorf("invalid target relist delay %v, must be positive", minDelay)
+	}
+	if maxDelay <= 0 {
+		return nil, fmt.Errorf("invalid maximum target relist delay %v, must be positive", maxDelay)
+	}
+	if maxDelay < minDelay {
+		return nil, fmt.Errorf("invalid maximum target relist delay %v, must be at least the minimum delay %v", maxDelay, minDelay)
+	}
+	return &TargetWatcher{
+		promClient:   promClient,
+		relists:      relists,
+		pollInterval: pollInterval,
+		minDelay:     minDelay,
+		maxDelay:     maxDelay,
+	}, nil
+}
+
+func (w *TargetWatcher) Run() {
+	w.RunUntil(wait.NeverStop)
+}
+
+func (w *TargetWatcher) RunUntil(stopChan <-chan struct{}) {
+	go func() {
+		defer utilruntime.HandleCrash()
+
+		ticker := time.NewTicker(w.pollInterval)
+		defer ticker.Stop()
+
+		// relist fires when the scheduled relist is due, and is nil when none is scheduled
+		relist := w.poll(nil)
+		for {
+			select {
+			case <-stopChan:
+				return
+			case <-ticker.C:
+				relist = w.poll(relist)
+			case <-relist:
+				relist = w.relist(time.Now())
+			}
+		}
+	}()
+}
+
+// poll fetches the active targets, and schedules a relist if they've changed and no
+// relist is scheduled yet.  It returns the scheduled relist, if any.
+func (w *TargetWatcher) poll(scheduled <-chan time.Time) <-chan time.Time {
+	ctx, cancel := context.WithTimeout(context.Background(), w.pollInterval)
+	defer cancel()
+
+	targets, err := w.promClient.Targets(ctx)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("unable to list Prometheus targets: %v", err))
+		return scheduled
+	}
+	if !w.noteTargets(targets.Active) {
+		return scheduled
+	}
+	if scheduled != nil {
+		w.changedWhilePending = true
+		return scheduled
+	}
+	return w.schedule(time.Now())
+}
+
+// relist requests the scheduled relist.  If it's rate-limited, it's scheduled again
+// and returned.  If the targets changed while it was pending, Prometheus may not have
+// scraped the latest ones yet, so another relist is scheduled and returned.
+func (w *TargetWatcher) relist(now time.Time) <-chan time.Time {
+	if err := w.relists.Trigger(relistSourceTargets); err != nil {
+		klog.V(2).Infof("unable to relist available metrics for changed Prometheus targets, trying again later: %v", err)
+		w.changedWhilePending = false
+		return w.schedule(now)
+	}
+	w.lastRelist = now
+
+	if !w.changedWhilePending {
+		return nil
+	}
+	w.changedWhilePending = false
+	return w.schedule(now)
+}
+
+// schedule schedules a relist after the next delay.
+func (w *TargetWatcher) schedule(now time.Time) <-chan time.Time {
+	delay := w.nextDelay(now)
+	klog.V(2).Infof("active Prometheus targets changed, relisting available metrics in %v", delay.Round(time.Second))
+	return time.After(delay)
+}
+
+// noteTargets records the given set of active targets, returning whether it differs
+// from the set seen by the previous poll.  The first set seen is never a change.
+func (w *TargetWatcher) noteTargets(targets []prom.Target) bool {
+	fingerprint := targetsFingerprint(targets)
+	changed := w.polled && fingerprint != w.fingerprint
+	w.polled = true
+	w.fingerprint = fingerprint
+	return changed
+}
+
+// nextDelay calculates the delay before a relist scheduled at the given time.  The delay
+// starts at the minimum, and doubles for each relist scheduled until it reaches the maximum.
+// It resets once the targets have been stable for the maximum delay after a relist.
+func (w *TargetWatcher) nextDelay(now time.Time) time.Duration {
+	if w.delay == 0 || now.Sub(w.lastRelist) > w.maxDelay {
+		w.delay = w.minDelay
+	} else {
+		w.delay *= 2
+	}
+	if w.delay > w.maxDelay {
+		w.delay = w.maxDelay
+	}
+	return wait.Jitter(w.delay, targetRelistJitter)
+}
+
+// targetsFingerprint identifies a set of targets by their labels, independently of their
+// order and of the results of their scrapes.
+func targetsFingerprint(targets []prom.Target) uint64 {
+	fingerprints := make(pmodel.Fingerprints, len(targets))
+	for i, target := range targets {
+		fingerprints[i] = target.Labels.Fingerprint()
+	}
+	sort.Sort(fingerprints)
+
+	hash := fnv.New64a()
+	buf := make([]byte, 8)
+	for _, fingerprint := range fingerprints {
+		binary.LittleEndian.PutUint64(buf, uint64(fingerprint))
+		hash.Write(buf)
+	}
+	return hash.Sum64()
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	pmodel "github.com/prometheus/common/model"
+
+	prom "github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/client"
+)
+
+func podTarget(pod string, health string) prom.Target {
+	return prom.Target{
+		Labels:    pmodel.LabelSet{"job": "web", "namespace": "somens", "pod": pmodel.LabelValue(pod)},
+		ScrapeURL: "http://" + pod + ":8080/metrics",
+		Health:    health,
+	}
+}
+
+func TestTargetWatcherNoteTargets(t *testing.T) {
+	watcher, err := NewTargetWatcher(&fakePromClient{}, NewRelistTrigger(&fakeDiscoveryRunner{}, 0), time.Minute, time.Second, time.Minute)
+	require.NoError(t, err)
+
+	assert.False(t, watcher.noteTargets([]prom.Target{podTarget("web-0", "up"), podTarget("web-1", "up")}), "the initial targets should not be a change")
+	assert.False(t, watcher.noteTargets([]prom.Target{podTarget("web-1", "down"), podTarget("web-0", "up")}), "reordered targets and scrape results should not be a change")
+	assert.True(t, watcher.noteTargets([]prom.Target{podTarget("web-0", "up"), podTarget("web-1", "up"), podTarget("web-2", "unknown")}), "new targets should be a change")
+	assert.True(t, watcher.noteTargets([]prom.Target{podTarget("web-0", "up"), podTarget("web-2", "up")}), "removed targets should be a change")
+	assert.False(t, watcher.noteTargets([]prom.Target{podTarget("web-0", "up"), podTarget("web-2", "up")}))
+}
+
+func TestTargetWatcherBackoff(t *testing.T) {
+	watcher, err := NewTargetWatcher(&fakePromClient{}, NewRelistTrigger(&fakeDiscoveryRunner{}, 0), time.Minute, time.Minute, 5*time.Minute)
+	require.NoError(t, err)
+	assertDelay := func(now time.Time, expected time.Duration, msg string) {
+		delay := watcher.nextDelay(now)
+		assert.True(t, delay >= expected && delay <= expected+expected/2, "%s: expected %v plus jitter, got %v", msg, expected, delay)
+		watcher.relist(now.Add(delay))
+	}
+
+	now := time.Now()
+	assertDelay(now, time.Minute, "the first relist should use the minimum delay")
+	now = now.Add(2 * time.Minute)
+	assertDelay(now, 2*time.Minute, "the delay should double while targets keep changing")
+	now = now.Add(3 * time.Minute)
+	assertDelay(now, 4*time.Minute, "the delay should double while targets keep changing")
+	now = now.Add(6 * time.Minute)
+	assertDelay(now, 5*time.Minute, "the delay should be capped at the maximum")
+
+	now = now.Add(20 * time.Minute)
+	assertDelay(now, time.Minute, "the delay should reset once targets have been stable")
+}
+
+func TestTargetWatcherRequiresDelay(t *testing.T) {
+	_, err := NewTargetWatcher(&fakePromClient{}, NewRelistTrigger(&fakeDiscoveryRunner{}, 0), time.Minute, 0, time.Minute)
+	assert.Error(t, err, "a zero relist delay should be rejected")
+	_, err = NewTargetWatcher(&fakePromClient{}, NewRelistTrigger(&fakeDiscoveryRunner{}, 0), time.Minute, -time.Second, time.Minute)
+	assert.Error(t, err, "a negative relist delay should be rejected")
+	_, err = NewTargetWatcher(&fakePromClient{}, NewRelistTrigger(&fakeDiscoveryRunner{}, 0), 0, time.Second, time.Minute)
+	assert.Error(t, err, "a zero poll interval should be rejected")
+	_, err = NewTargetWatcher(&fakePromClient{}, NewRelistTrigger(&fakeDiscoveryRunner{}, 0), time.Minute, time.Second, 0)
+	assert.Error(t, err, "a zero maximum relist delay should be rejected")
+	_, err = NewTargetWatcher(&fakePromClient{}, NewRelistTrigger(&fakeDiscoveryRunner{}, 0), time.Minute, time.Minute, time.Second)
+	assert.Error(t, err, "a maximum relist delay shorter than the minimum should be rejected")
+	_, err = NewTargetWatcher(&fakePromClient{}, NewRelistTrigger(&fakeDiscoveryRunner{}, 0), time.Minute, time.Minute, time.Minute)
+	assert.NoError(t, err, "equal minimum and maximum relist delays should be allowed")
+}
+
+func TestTargetWatcherRateLimited(t *testing.T) {
+	discovery := &fakeDiscoveryRunner{}
+	relists := NewRelistTrigger(discovery, time.Hour)
+	require.NoError(t, relists.Trigger(relistSourceHTTP))
+	watcher, err := NewTargetWatcher(&fakePromClient{}, relists, time.Minute, time.Minute, 5*time.Minute)
+	require.NoError(t, err)
+
+	rateLimited := relistRequests.WithLabelValues(relistSourceTargets, "rate-limited")
+	rateLimitedBefore := counterValue(t, rateLimited)
+	assert.NotNil(t, watcher.relist(time.Now()), "a rate-limited relist should be scheduled again")
+	assert.Equal(t, 1, discovery.relists, "relists should respect the minimum relist interval")
+	assert.Equal(t, rateLimitedBefore+1, counterValue(t, rateLimited))
+}
+
+func TestTargetWatcherRelists(t *testing.T) {
+	prov, fakeProm := setupPrometheusProvider(t)
+	fakeProm.acceptibleInterval = pmodel.Interval{Start: 0, End: pmodel.Latest}
+	fakeProm.targets = prom.TargetsResult{Active: []prom.Target{podTarget("web-0", "up")}}
+	lister := prov.(*prometheusProvider).SeriesRegistry.(*cachingMetricsLister)
+	lister.updateInterval = time.Hour
+
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	lister.RunUntil(stopChan)
+	require.True(t, waitFor(func() bool { return !lister.LastDiscovery().IsZero() }), "metrics should be discovered on startup")
+	firstDiscovery := lister.LastDiscovery()
+
+	relists := relistRequests.WithLabelValues(relistSourceTargets, "accepted")
+	relistsBefore := counterValue(t, relists)
+	watcher, err := NewTargetWatcher(fakeProm, NewRelistTrigger(lister, 0), 10*time.Millisecond, time.Millisecond, time.Second)
+	require.NoError(t, err)
+	watcher.RunUntil(stopChan)
+	require.True(t, waitFor(func() bool {
+		fakeProm.mu.Lock()
+		defer fakeProm.mu.Unlock()
+		return fakeProm.targetsCalls > 0
+	}), "targets should be polled on startup")
+
+	fakeProm.mu.Lock()
+	fakeProm.targets = prom.TargetsResult{Active: []prom.Target{podTarget("web-0", "up"), podTarget("web-1", "up")}}
+	fakeProm.mu.Unlock()
+	assert.True(t, waitFor(func() bool { return lister.LastDiscovery().After(firstDiscovery) }), "metrics should be relisted when targets change")
+	assert.True(t, counterValue(t, relists) > relistsBefore)
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+	pmodel "github.com/prometheus/common/model"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/kairosinc/custom-metrics-prometheus-adapter/pkg/config"
+)
+
+var (
+	// valueOverflows counts query results which were too large to present in the API.
+	valueOverflows = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cmgateway_metric_value_overflows_total",
+			Help: "Number of query results which were too large to be presented in the API.  Broken down by metric",
+		},
+		[]string{"metric"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(valueOverflows)
+}
+
+// maxQuantityValue is the smallest magnitude which doesn't fit in the (int64)
+// value of a quantity, once it's been scaled to the quantity's precision.
+const maxQuantityValue = float64(math.MaxInt64)
+
+// defaultValueConverter presents values as plain decimal numbers, with a
+// precision of one thousandth.
+var defaultValueConverter = mustValueConverter("", nil)
+
+// ValueConverter converts query results into quantities, in a particular unit.
+type ValueConverter struct {
+	// factor converts a result into an integer number of units of the precision.
+	factor    float64
+	precision resource.Scale
+	format    resource.Format
+	// maxValue is the largest magnitude of result which can be converted.
+	maxValue float64
+}
+
+// NewValueConverter constructs a ValueConverter for the given unit, which may be
+// empty, and scale, which may be nil.
+func NewValueConverter(unit config.ValueUnit, scale *float64) (*ValueConverter, error) {
+	converter := &ValueConverter{
+		factor:    1,
+		precision: resource.Milli,
+		format:    resource.DecimalSI,
+	}
+
+	switch unit {
+	case "":
+	case config.UnitBytes:
+		converter.precision = 0
+		converter.format = resource.BinarySI
+	case config.UnitSeconds:
+		converter.precision = resource.Nano
+	case config.UnitPercent:
+		converter.factor = 100
+	default:
+		return nil, fmt.Errorf("unknown unit %q, must be one of %q, %q, or %q", unit, config.UnitBytes, config.UnitSeconds, config.UnitPercent)
+	}
+
+	if scale != nil {
+		if *scale == 0 || math.IsNaN(*scale) || math.IsInf(*scale, 0) {
+			return nil, fmt.Errorf("scale %v must be finite and non-zero", *scale)
+		}
+		converter.factor *= *scale
+	}
+	converter.factor *= math.Pow10(-int(converter.precision))
+	if math.IsInf(converter.factor, 0) || converter.factor == 0 {
+		return nil, fmt.Errorf("scale %v is too large or too small to present values", *scale)
+	}
+
+	// find the largest value which won't overflow once rounding errors are accounted for
+	converter.maxValue = math.Nextafter(maxQuantityValue, 0) / math.Abs(converter.factor)
+	for math.Abs(converter.maxValue*converter.factor) >= maxQuantityValue {
+		converter.maxValue = math.Nextafter(converter.maxValue, 0)
+	}
+
+	return converter, nil
+}
+
+// mustValueConverter constructs a ValueConverter, panicking on error.
+func mustValueConverter(unit config.ValueUnit, scale *float64) *ValueConverter {
+	converter, err := NewValueConverter(unit, scale)
+	if err != nil {
+		panic(err)
+	}
+	return converter
+}
+
+// MaxValue returns the largest magnitude of result which can be converted into a quantity.
+func (c *ValueConverter) MaxValue() float64 {
+	return c.maxValue
+}
+
+// Quantity converts the given result into a quantity.  It returns an error if the
+// result is non-finite, or too large to be presented.
+func (c *ValueConverter) Quantity(value pmodel.SampleValue) (*resource.Quantity, error) {
+	scaled := math.Round(float64(value) * c.factor)
+	if math.IsNaN(scaled) || math.Abs(scaled) >= maxQuantityValue {
+		return nil, fmt.Errorf("value %v is out of range (the largest value which can be presented is %v)", value, c.maxValue)
+	}
+
+	quantity := resource.NewScaledQuantity(int64(scaled), c.precision)
+	quantity.Format = c.format
+	return quantity, nil
+}